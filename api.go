@@ -0,0 +1,784 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The JSON API lives under /api/v1 and goes through the same ReleaseStore as
+// the HTML handlers. Successful responses are wrapped in {"data": ...}, with
+// a "meta" object on paginated listings, and every error uses the envelope
+// {"error": {"status": 404, "message": "release not found"}}.
+
+type apiMeta struct {
+	Page       int `json:"page"`
+	PageSize   int `json:"page_size"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+type apiResponse struct {
+	Data interface{} `json:"data"`
+	Meta *apiMeta    `json:"meta,omitempty"`
+}
+
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// releasePatch holds the fields accepted by PATCH /api/v1/releases/{id}.
+// Fields left out of the request body keep their current value.
+type releasePatch struct {
+	Title                     *string `json:"title"`
+	Artist                    *string `json:"artist"`
+	Year                      *int    `json:"year"`
+	CatalogNumber             *string `json:"catalog_number"`
+	Label                     *string `json:"label"`
+	Format                    *string `json:"format"`
+	Physical                  *string `json:"physical"`
+	Rating                    *string `json:"rating"`
+	Released                  *string `json:"released"`
+	CollectionFolder          *string `json:"collection_folder"`
+	DateAdded                 *string `json:"date_added"`
+	CollectionMediaCondition  *string `json:"collection_media_condition"`
+	CollectionSleeveCondition *string `json:"collection_sleeve_condition"`
+	CollectionNotes           *string `json:"collection_notes"`
+	Wanted                    *bool   `json:"wanted"`
+}
+
+// apply sets the fields present in the patch on an update.
+func (p releasePatch) apply(u *ReleaseUpdate) (changed bool) {
+	for _, field := range []struct {
+		patch  *string
+		update *string
+	}{
+		{p.Title, &u.Title}, {p.Artist, &u.Artist}, {p.CatalogNumber, &u.CatalogNumber}, {p.Label, &u.Label},
+		{p.Format, &u.Format}, {p.Physical, &u.Physical}, {p.Rating, &u.Rating}, {p.Released, &u.Released},
+		{p.CollectionFolder, &u.CollectionFolder}, {p.DateAdded, &u.DateAdded},
+		{p.CollectionMediaCondition, &u.CollectionMediaCondition},
+		{p.CollectionSleeveCondition, &u.CollectionSleeveCondition}, {p.CollectionNotes, &u.CollectionNotes},
+	} {
+		if field.patch != nil {
+			*field.update = *field.patch
+			changed = true
+		}
+	}
+	if p.Year != nil {
+		u.Year = *p.Year
+		changed = true
+	}
+	return changed
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+func writeAPIData(w http.ResponseWriter, status int, data interface{}) {
+	writeJSON(w, status, apiResponse{Data: data})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, struct {
+		Error apiError `json:"error"`
+	}{apiError{Status: status, Message: message}})
+}
+
+// writeStoreError maps store errors to API errors, hiding database details.
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errReleaseNotFound) {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeAPIError(w, http.StatusInternalServerError, "internal server error")
+}
+
+// decodeJSONBody decodes the request body into v, rejecting unknown fields.
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return errors.New("invalid JSON body: " + err.Error())
+	}
+	return nil
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// apiHandler routes every /api/v1/ request.
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	// Parameters and JSON bodies are checked against the OpenAPI document first
+	if err := openAPISpec.validateRequest(r); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiBasePath), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "releases":
+		apiReleasesHandler(w, r)
+	case parts[0] == "releases" && len(parts) >= 2:
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid release ID: "+parts[1])
+			return
+		}
+		switch {
+		case len(parts) == 2:
+			apiReleaseHandler(w, r, id)
+		case len(parts) == 3 && parts[2] == "tags":
+			apiReleaseTagsHandler(w, r, id, "")
+		case len(parts) == 4 && parts[2] == "tags":
+			apiReleaseTagsHandler(w, r, id, parts[3])
+		case len(parts) == 3 && parts[2] == "wanted":
+			apiReleaseWantedHandler(w, r, id)
+		case len(parts) == 3 && parts[2] == "tracks":
+			apiReleaseTracksHandler(w, r, id)
+		case len(parts) == 3 && parts[2] == "status":
+			apiReleaseStatusHandler(w, r, id)
+		case len(parts) == 3 && parts[2] == "history":
+			apiReleaseHistoryHandler(w, r, id)
+		default:
+			writeAPIError(w, http.StatusNotFound, "not found")
+		}
+	case path == "lookup":
+		apiLookupHandler(w, r)
+	case path == "tags":
+		apiCountsHandler(w, r, store.TagCounts)
+	case path == "artists":
+		apiCountsHandler(w, r, store.ArtistCounts)
+	case path == "stats":
+		apiStatsHandler(w, r)
+	case path == "imports":
+		apiImportHandler(w, r)
+	case path == "scrape":
+		apiScrapeHandler(w, r)
+	case path == "history":
+		apiHistoryHandler(w, r)
+	case parts[0] == "history" && len(parts) == 3 && parts[2] == "undo":
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid change ID: "+parts[1])
+			return
+		}
+		apiUndoHandler(w, r, func(origin changeOrigin) ([]ReleaseChange, error) { return undoChange(origin, id) })
+	case parts[0] == "history" && len(parts) == 4 && parts[1] == "batches" && parts[3] == "undo":
+		apiUndoHandler(w, r, func(origin changeOrigin) ([]ReleaseChange, error) { return undoBatch(origin, parts[2]) })
+	case path == "jobs":
+		apiJobsHandler(w, r)
+	case parts[0] == "jobs" && (len(parts) == 2 || (len(parts) == 3 && parts[2] == "cancel")):
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid job ID: "+parts[1])
+			return
+		}
+		action := ""
+		if len(parts) == 3 {
+			action = parts[2]
+		}
+		apiJobHandler(w, r, id, action)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// apiReleasesHandler lists releases, or adds one with POST. Listings accept
+// the same filters as /releases (artist, year, tag, physical, label, wanted)
+// plus need_scraping, status, q, sort, page and page_size.
+func apiReleasesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		apiCreateReleaseHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	filters := make(map[string]string)
+	for _, f := range releaseFilterKeys {
+		if value := r.URL.Query().Get(f.Key); value != "" {
+			filters[f.Key] = value
+		}
+	}
+	query, err := releaseQueryFromFilters(filters)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query.Search = r.URL.Query().Get("q")
+	if status := r.URL.Query().Get("status"); status != "" {
+		if !containsString(releaseStatusFilters, status) {
+			writeAPIError(w, http.StatusBadRequest, "invalid status value: "+status)
+			return
+		}
+		query.Status = status
+	}
+	if needScraping := r.URL.Query().Get("need_scraping"); needScraping != "" {
+		query.NeedScraping, err = strconv.ParseBool(needScraping)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid need_scraping value: "+needScraping)
+			return
+		}
+	}
+
+	query.Sort, err = parseSort(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	releases, pagination, err := listReleasesPage(r, query)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if releases == nil {
+		releases = []Release{}
+	}
+
+	writeJSON(w, http.StatusOK, apiResponse{
+		Data: releases,
+		Meta: &apiMeta{
+			Page:       pagination.Page,
+			PageSize:   pagination.PageSize,
+			Total:      pagination.Total,
+			TotalPages: pagination.TotalPages,
+		},
+	})
+}
+
+// apiCreateReleaseHandler adds a release by hand, with the fields of a
+// Release. The release_id can be left out for releases not on Discogs.
+func apiCreateReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	var draft releaseDraft
+	if err := decodeJSONBody(r, &draft); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	draft, err := checkReleaseDraft(draft)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id, err := addRelease(r.Context(), requestOrigin(r, sourceEdit), draft)
+	if errors.Is(err, errReleaseExists) {
+		writeAPIError(w, http.StatusConflict, fmt.Sprintf("release already in the collection as release %d", id))
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	release, err := store.GetRelease(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/releases/%d", apiBasePath, id))
+	writeAPIData(w, http.StatusCreated, release)
+}
+
+// apiLookupHandler prefills a new release from Discogs or the metadata
+// providers, answering with a body ready for POST /releases.
+func apiLookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	lookup, err := releaseLookupFromQuery(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !lookup.complete() {
+		writeAPIError(w, http.StatusBadRequest, "release_id, barcode, or artist and title are required")
+		return
+	}
+
+	draft, err := prefillRelease(r.Context(), lookup)
+	if errors.Is(err, errNoMetadata) {
+		writeAPIError(w, http.StatusNotFound, "no release found")
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if draft.Tags == nil {
+		draft.Tags = []string{}
+	}
+	if draft.Tracks == nil {
+		draft.Tracks = []Track{}
+	}
+	writeAPIData(w, http.StatusOK, draft)
+}
+
+// apiReleaseHandler gets, updates or deletes a single release.
+func apiReleaseHandler(w http.ResponseWriter, r *http.Request, id int) {
+	switch r.Method {
+	case http.MethodGet:
+		release, err := store.GetRelease(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeAPIData(w, http.StatusOK, release)
+
+	case http.MethodPatch:
+		var patch releasePatch
+		if err := decodeJSONBody(r, &patch); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		release, err := store.GetRelease(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		update := releaseUpdateFrom(*release)
+		changed := patch.apply(&update)
+		update = update.trimmed()
+		if err := validateReleaseUpdate(*release, update); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Both are one change in the history
+		err = auditRelease(requestOrigin(r, sourceEdit), id, func() error {
+			if changed {
+				if err := store.UpdateRelease(id, update); err != nil {
+					return err
+				}
+			}
+			if patch.Wanted != nil {
+				return store.SetWanted(id, *patch.Wanted)
+			}
+			return nil
+		})
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		release, err = store.GetRelease(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeAPIData(w, http.StatusOK, release)
+
+	case http.MethodDelete:
+		if err := deleteRelease(requestOrigin(r, sourceEdit), id); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// apiReleaseTagsHandler adds a tag with POST {"tag": "..."} on
+// /releases/{id}/tags and removes one with DELETE /releases/{id}/tags/{tag}.
+func apiReleaseTagsHandler(w http.ResponseWriter, r *http.Request, id int, tag string) {
+	switch {
+	case r.Method == http.MethodPost && tag == "":
+		var body struct {
+			Tag string `json:"tag"`
+		}
+		if err := decodeJSONBody(r, &body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		tag = strings.TrimSpace(body.Tag)
+		if tag == "" {
+			writeAPIError(w, http.StatusBadRequest, "tag cannot be empty")
+			return
+		}
+		err := auditRelease(requestOrigin(r, sourceEdit), id, func() error { return store.AddTag(id, tag) })
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+	case r.Method == http.MethodDelete && tag != "":
+		err := auditRelease(requestOrigin(r, sourceEdit), id, func() error { return store.RemoveTag(id, tag) })
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+	case tag == "":
+		methodNotAllowed(w, http.MethodPost)
+		return
+	default:
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+
+	release, err := store.GetRelease(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, release)
+}
+
+// apiReleaseWantedHandler sets the wanted flag with PUT {"wanted": true}.
+func apiReleaseWantedHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPut {
+		methodNotAllowed(w, http.MethodPut)
+		return
+	}
+
+	var body struct {
+		Wanted *bool `json:"wanted"`
+	}
+	if err := decodeJSONBody(r, &body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Wanted == nil {
+		writeAPIError(w, http.StatusBadRequest, "wanted is required")
+		return
+	}
+
+	err := auditRelease(requestOrigin(r, sourceEdit), id, func() error { return store.SetWanted(id, *body.Wanted) })
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	release, err := store.GetRelease(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, release)
+}
+
+// apiReleaseTracksHandler replaces the tracklist of a release, which scraping
+// then keeps.
+func apiReleaseTracksHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPut {
+		methodNotAllowed(w, http.MethodPut)
+		return
+	}
+
+	var body struct {
+		Tracks *[]Track `json:"tracks"`
+	}
+	if err := decodeJSONBody(r, &body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Tracks == nil {
+		writeAPIError(w, http.StatusBadRequest, "tracks is required")
+		return
+	}
+	tracks, err := cleanTracks(*body.Tracks)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = auditRelease(requestOrigin(r, sourceEdit), id, func() error { return store.SetTracks(id, tracks, true) })
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	release, err := store.GetRelease(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, release)
+}
+
+// apiReleaseStatusHandler archives or sells a release with PUT
+// {"status": "sold", "date": "2024-05-01", "price": "25", "note": "..."}, and
+// restores it with {"status": ""}.
+func apiReleaseStatusHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPut {
+		methodNotAllowed(w, http.MethodPut)
+		return
+	}
+
+	var body ReleaseStatus
+	if err := decodeJSONBody(r, &body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	release, err := store.GetRelease(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	status, err := checkReleaseStatus(*release, body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = auditRelease(requestOrigin(r, sourceEdit), id, func() error { return store.SetStatus(id, status) })
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	release, err = store.GetRelease(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, release)
+}
+
+// apiReleaseHistoryHandler lists the changes of a release, which may have
+// been deleted since.
+func apiReleaseHistoryHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	changes, err := changeStore.ListChanges(ChangeQuery{ReleaseRef: id, Limit: historyLimit})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if len(changes) == 0 {
+		if _, err := store.GetRelease(id); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		changes = []ReleaseChange{}
+	}
+	writeAPIData(w, http.StatusOK, changes)
+}
+
+// apiHistoryHandler lists the latest changes, or those of one operation with ?batch=.
+func apiHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	changes, err := changeStore.ListChanges(ChangeQuery{Batch: r.URL.Query().Get("batch"), Limit: historyLimit})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if changes == nil {
+		changes = []ReleaseChange{}
+	}
+	writeAPIData(w, http.StatusOK, changes)
+}
+
+// apiUndoHandler undoes a change or an operation with POST, returning the
+// changes made by the undo.
+func apiUndoHandler(w http.ResponseWriter, r *http.Request, undo func(origin changeOrigin) ([]ReleaseChange, error)) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	undone, err := undo(requestOrigin(r, sourceUndo))
+	if err != nil {
+		status := undoErrorStatus(err)
+		message := err.Error()
+		if status == http.StatusInternalServerError {
+			log.Printf("Error undoing changes: %v", err)
+			message = "internal server error"
+		}
+		writeAPIError(w, status, message)
+		return
+	}
+	writeAPIData(w, http.StatusOK, undone)
+}
+
+// apiCountsHandler serves the tag and artist listings with their release counts.
+func apiCountsHandler(w http.ResponseWriter, r *http.Request, counts func() ([]StatItem, error)) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	items, err := counts()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if items == nil {
+		items = []StatItem{}
+	}
+	writeAPIData(w, http.StatusOK, items)
+}
+
+// apiStatsHandler returns the data behind the /stats page.
+func apiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	stats := make(map[string][]StatItem)
+	for name, fetch := range map[string]func() ([]StatItem, error){
+		"decades":     store.StatsByDecade,
+		"formats":     store.StatsByFormat,
+		"top_artists": store.StatsTopArtists,
+	} {
+		items, err := fetch()
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if items == nil {
+			items = []StatItem{}
+		}
+		stats[name] = items
+	}
+	writeAPIData(w, http.StatusOK, stats)
+}
+
+// apiImportHandler starts an import job for a Discogs CSV export sent as the
+// multipart "file" field, into the wanted list when the "wanted" field is
+// true. The "profile" field selects an import profile for other CSV or TSV
+// files.
+func apiImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "missing file")
+		return
+	}
+	defer file.Close()
+
+	wanted := false
+	if value := r.FormValue("wanted"); value != "" {
+		wanted, err = strconv.ParseBool(value)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid wanted value: "+value)
+			return
+		}
+	}
+
+	update := false
+	if value := r.FormValue("update"); value != "" {
+		update, err = strconv.ParseBool(value)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid update value: "+value)
+			return
+		}
+	}
+
+	opts, err := newImportOptions(wanted, update, r.FormValue("profile"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	job, err := startImportJob(file, opts)
+	if err != nil {
+		writeJobStartError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusAccepted, job)
+}
+
+// apiScrapeHandler starts a scrape job using the metadata providers, like the admin button.
+func apiScrapeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	job, err := jobs.start(jobKindScrape, scrapeMetadata)
+	if err != nil {
+		writeJobStartError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusAccepted, job)
+}
+
+// writeJobStartError answers 409 when a job of the same kind is running.
+func writeJobStartError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errJobAlreadyRunning) {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+	log.Printf("Error starting job: %v", err)
+	writeAPIError(w, http.StatusInternalServerError, "internal server error")
+}
+
+// apiJobsHandler lists the most recent jobs.
+func apiJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	history, err := jobs.list(50)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if history == nil {
+		history = []Job{}
+	}
+	writeAPIData(w, http.StatusOK, history)
+}
+
+// apiJobHandler gets a job with GET /jobs/{id} and cancels it with POST /jobs/{id}/cancel.
+func apiJobHandler(w http.ResponseWriter, r *http.Request, id int, action string) {
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+	case action == "cancel" && r.Method == http.MethodPost:
+		if _, err := jobs.get(id); err == nil && !jobs.cancel(id) {
+			writeAPIError(w, http.StatusConflict, "job is not running")
+			return
+		}
+	case action == "":
+		methodNotAllowed(w, http.MethodGet)
+		return
+	default:
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	job, err := jobs.get(id)
+	if err != nil {
+		if errors.Is(err, errJobNotFound) {
+			writeAPIError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	writeAPIData(w, http.StatusOK, job)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// apiCheck is one request made by TestAPIMatchesOpenAPI.
+type apiCheck struct {
+	Method string
+	Path   string // Relative to apiBasePath, {change:R:N} is the ID of the Nth change of release R
+	Body   string
+	Status int
+}
+
+// apiChecks exercises every documented operation against an in-memory store,
+// in order, so later checks see the changes of earlier ones. Add a check here
+// when adding an endpoint.
+var apiChecks = []apiCheck{
+	{"GET", "/releases", "", http.StatusOK},
+	{"GET", "/releases?artist=Beatles&wanted=false&sort=-year,title&page=1&page_size=2", "", http.StatusOK},
+	{"GET", "/releases?need_scraping=true&q=abbey", "", http.StatusOK},
+	{"GET", "/releases?page=9", "", http.StatusOK},
+	{"GET", "/releases?label=Apple", "", http.StatusOK},
+	{"GET", "/releases?year=later", "", http.StatusBadRequest},
+	{"GET", "/releases?page_size=100000", "", http.StatusBadRequest},
+	{"GET", "/releases?sort=price", "", http.StatusBadRequest},
+	{"GET", "/releases/1", "", http.StatusOK},
+	{"GET", "/releases/3", "", http.StatusOK}, // No tags
+	{"GET", "/releases/abc", "", http.StatusBadRequest},
+	{"GET", "/releases/999", "", http.StatusNotFound},
+	{"PATCH", "/releases/1", `{"title": "Abbey Road (Remaster)", "year": 1969}`, http.StatusOK},
+	{"PATCH", "/releases/1", `{"wanted": true}`, http.StatusOK},
+	{"PATCH", "/releases/1", `{"year": "1969"}`, http.StatusBadRequest},
+	{"PATCH", "/releases/1", `{"title": ""}`, http.StatusBadRequest},
+	{"PATCH", "/releases/1", `{"colour": "red"}`, http.StatusBadRequest},
+	{"PATCH", "/releases/1", `{"label": "Apple", "format": "2xLP, Album", "rating": "5", "collection_media_condition": "Very Good Plus (VG+)", "collection_notes": "Gatefold"}`, http.StatusOK},
+	{"PATCH", "/releases/1", `{"rating": "6"}`, http.StatusBadRequest},
+	{"PATCH", "/releases/1", `{"collection_sleeve_condition": "Great"}`, http.StatusBadRequest},
+	{"PATCH", "/releases/1", `{"released": "last year"}`, http.StatusBadRequest},
+	{"PATCH", "/releases/1", ``, http.StatusBadRequest},
+	{"PATCH", "/releases/999", `{"year": 2000}`, http.StatusNotFound},
+	{"POST", "/releases/2/tags", `{"tag": "jazz"}`, http.StatusOK},
+	{"POST", "/releases/2/tags", `{}`, http.StatusBadRequest},
+	{"POST", "/releases/999/tags", `{"tag": "jazz"}`, http.StatusNotFound},
+	{"DELETE", "/releases/2/tags/jazz", "", http.StatusOK},
+	{"DELETE", "/releases/999/tags/jazz", "", http.StatusNotFound},
+	{"PUT", "/releases/2/wanted", `{"wanted": true}`, http.StatusOK},
+	{"PUT", "/releases/2/wanted", `{"wanted": "yes"}`, http.StatusBadRequest},
+	{"PUT", "/releases/999/wanted", `{"wanted": true}`, http.StatusNotFound},
+	{"PUT", "/releases/2/tracks", `{"tracks": [{"position": "A1", "title": "So What", "duration": "9:22", "credits": "Bass: Paul Chambers"}, {"title": "Freddie Freeloader"}]}`, http.StatusOK},
+	{"PUT", "/releases/2/tracks", `{"tracks": [{"title": "So What", "duration": "nine minutes"}]}`, http.StatusBadRequest},
+	{"PUT", "/releases/2/tracks", `{}`, http.StatusBadRequest},
+	{"PUT", "/releases/999/tracks", `{"tracks": []}`, http.StatusNotFound},
+	{"GET", "/releases?q=freeloader", "", http.StatusOK},
+	{"POST", "/releases", `{"artist": "John Coltrane", "title": "Blue Train", "format": "LP, Album, Mono", "year": 1957, "tags": ["jazz"], "tracks": [{"position": "A1", "title": "Blue Train", "duration": "10:43"}]}`, http.StatusCreated},
+	{"POST", "/releases", `{"artist": "John Coltrane", "title": "Blue Train", "format": "LP, Album, Mono"}`, http.StatusConflict}, // Same synthetic release_id
+	{"POST", "/releases", `{"release_id": 101, "artist": "The Beatles", "title": "Abbey Road"}`, http.StatusConflict},
+	{"POST", "/releases", `{"release_id": 104, "artist": "Nina Simone", "title": "Pastel Blues", "wanted": true, "collection_media_condition": "Near Mint (NM or M-)"}`, http.StatusCreated},
+	{"POST", "/releases", `{"title": "Untitled"}`, http.StatusBadRequest},
+	{"POST", "/releases", `{"artist": "Nina Simone", "title": "Wild Is The Wind", "rating": "9"}`, http.StatusBadRequest},
+	{"POST", "/releases", `{"artist": "Nina Simone", "title": "Wild Is The Wind", "date_added": "yesterday"}`, http.StatusBadRequest},
+	{"POST", "/releases", `{"artist": "Nina Simone", "title": "Wild Is The Wind", "cover_url": "file:///etc/passwd"}`, http.StatusBadRequest},
+	{"GET", "/releases/4", "", http.StatusOK},
+	{"PUT", "/releases", "", http.StatusMethodNotAllowed},
+	{"GET", "/lookup", "", http.StatusBadRequest}, // Lookups call Discogs or the metadata providers
+	{"GET", "/lookup?artist=Nina+Simone", "", http.StatusBadRequest},
+	{"GET", "/lookup?release_id=0", "", http.StatusBadRequest},
+	{"PUT", "/releases/4/status", `{"status": "sold", "date": "2024-05-01", "price": "25.50", "note": "Record fair"}`, http.StatusOK},
+	{"GET", "/releases?status=sold", "", http.StatusOK},
+	{"GET", "/releases?status=gone", "", http.StatusBadRequest},
+	{"PUT", "/releases/4/status", `{"status": "archived", "price": "10"}`, http.StatusBadRequest},
+	{"PUT", "/releases/4/status", `{"status": "sold", "date": "May 1st"}`, http.StatusBadRequest},
+	{"PUT", "/releases/4/status", `{}`, http.StatusBadRequest},
+	{"PUT", "/releases/5/status", `{"status": "sold"}`, http.StatusBadRequest}, // Wanted
+	{"PUT", "/releases/999/status", `{"status": "sold"}`, http.StatusNotFound},
+	{"PUT", "/releases/4/status", `{"status": ""}`, http.StatusOK},
+	{"PUT", "/releases/4/status", `{"status": "archived", "note": "Water damage"}`, http.StatusOK}, // Left out of the stats below
+	{"GET", "/tags", "", http.StatusOK},
+	{"GET", "/artists", "", http.StatusOK},
+	{"GET", "/stats", "", http.StatusOK},
+	{"POST", "/imports", "", http.StatusBadRequest}, // Importing itself needs a database
+	{"GET", "/jobs", "", http.StatusOK},
+	{"GET", "/jobs/1", "", http.StatusOK},
+	{"GET", "/jobs/999", "", http.StatusNotFound},
+	{"POST", "/jobs/1/cancel", "", http.StatusConflict},
+	{"POST", "/jobs/999/cancel", "", http.StatusNotFound},
+	{"DELETE", "/releases/3", "", http.StatusNoContent},
+	{"DELETE", "/releases/3", "", http.StatusNotFound},
+	{"GET", "/releases/1/history", "", http.StatusOK},
+	{"GET", "/releases/3/history", "", http.StatusOK}, // Deleted releases keep their history
+	{"GET", "/releases/999/history", "", http.StatusNotFound},
+	{"GET", "/history", "", http.StatusOK},
+	{"GET", "/history?batch=unknown", "", http.StatusOK},
+	{"POST", "/history/{change:3:1}/undo", "", http.StatusOK}, // Brings release 3 back
+	{"POST", "/history/{change:3:1}/undo", "", http.StatusConflict},
+	{"GET", "/releases/3", "", http.StatusOK},
+	{"POST", "/history/{change:1:1}/undo", "", http.StatusOK},       // The title, later edits of other fields are kept
+	{"POST", "/history/{change:4:2}/undo", "", http.StatusConflict}, // Sold, archived since
+	{"POST", "/history/999/undo", "", http.StatusNotFound},
+	{"POST", "/history/abc/undo", "", http.StatusBadRequest},
+	{"POST", "/history/batches/unknown/undo", "", http.StatusNotFound},
+	{"POST", "/stats", "", http.StatusMethodNotAllowed},
+	{"GET", "/unknown", "", http.StatusNotFound},
+}
+
+// apiCheckSkipped lists operations the test cannot call, with the reason.
+var apiCheckSkipped = map[string]string{
+	"scrape": "starts a job calling the external metadata providers",
+}
+
+// apiCheckReleases is the collection the checks start from.
+func apiCheckReleases() []Release {
+	return []Release{
+		{ID: 1, Artist: "The Beatles", Title: "Abbey Road", Format: "LP, Album", Physical: "Vinyl", ReleaseID: 101, Year: 1969, Tags: []string{"rock", "1960s"}, CoverImage: "101.jpg"},
+		{ID: 2, Artist: "Miles Davis", Title: "Kind Of Blue", Format: "CD, Album", Physical: "CD", ReleaseID: 102, Year: 1959, Tags: []string{"1950s"}},
+		{ID: 3, Artist: "Björk", Title: "Début", Format: "Cassette, Album", Physical: "Cassette", ReleaseID: 103},
+	}
+}
+
+// changeRef matches the {change:R:N} placeholders of apiCheck paths.
+var changeRef = regexp.MustCompile(`\{change:(\d+):(\d+)\}`)
+
+// resolveChangeIDs replaces the {change:R:N} placeholders of a path with the
+// ID of the Nth change of release R, oldest first, so checks do not depend on
+// how many changes the checks before them logged.
+func resolveChangeIDs(t *testing.T, path string) string {
+	return changeRef.ReplaceAllStringFunc(path, func(placeholder string) string {
+		m := changeRef.FindStringSubmatch(placeholder)
+		ref, _ := strconv.Atoi(m[1])
+		n, _ := strconv.Atoi(m[2])
+		changes, err := changeStore.ListChanges(ChangeQuery{ReleaseRef: ref})
+		if err != nil || n < 1 || n > len(changes) {
+			t.Fatalf("%s: release %d has %d changes: %v", placeholder, ref, len(changes), err)
+		}
+		return strconv.Itoa(changes[len(changes)-n].ID)
+	})
+}
+
+// TestAPIMatchesOpenAPI runs apiChecks through the API handler and fails when
+// a status code differs or a response no longer matches the OpenAPI document,
+// so the document and the handlers cannot silently drift apart.
+func TestAPIMatchesOpenAPI(t *testing.T) {
+	memory := newMemoryStore(apiCheckReleases()...)
+	store = memory
+	jobStore = memory
+	changeStore = memory
+
+	// A finished job in the history, running ones need the real scraper or database
+	job, _ := jobStore.CreateJob(jobKindImport)
+	job.Status = jobCompleted
+	jobStore.SaveJob(*job)
+
+	covered := make(map[string]bool)
+	for _, check := range apiChecks {
+		check.Path = resolveChangeIDs(t, check.Path)
+		req := httptest.NewRequest(check.Method, apiBasePath+check.Path, strings.NewReader(check.Body))
+		if check.Body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		apiHandler(w, req)
+
+		path := strings.SplitN(check.Path, "?", 2)[0]
+		if op, _, _ := openAPISpec.findOperation(check.Method, path); op != nil {
+			covered[op.OperationID] = true
+		}
+
+		if err := openAPISpec.validateResponse(check.Method, path, w.Code, w.Body.Bytes()); err != nil {
+			t.Errorf("%s %s: %v", check.Method, check.Path, err)
+			continue
+		}
+		if w.Code != check.Status {
+			t.Errorf("%s %s: expected status %d, got %d: %s", check.Method, check.Path, check.Status, w.Code, strings.TrimSpace(w.Body.String()))
+		}
+	}
+
+	for _, item := range openAPISpec.Paths {
+		for _, op := range item {
+			if _, skipped := apiCheckSkipped[op.OperationID]; !skipped && !covered[op.OperationID] {
+				t.Errorf("%s: operation has no check in apiChecks", op.OperationID)
+			}
+		}
+	}
+}
+
+func TestOpenAPIPatterns(t *testing.T) {
+	doc := &OpenAPI{}
+	doc.Components.Schemas = map[string]*Schema{
+		"Release": objectSchema(map[string]*Schema{"rating": {Type: "string", Pattern: `^[0-5]?$`}}),
+	}
+	if err := doc.compilePatterns(); err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.validateJSON(ref("Release"), []byte(`{"rating": "6"}`)); err == nil {
+		t.Error("rating 6 matched ^[0-5]?$")
+	}
+
+	doc.Components.Schemas["Bad"] = &Schema{Type: "string", Pattern: `^(\d+$`}
+	if err := doc.compilePatterns(); err == nil {
+		t.Error("compilePatterns accepted an invalid pattern")
+	}
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every change to a release is recorded in the release_changes table: the
+// values of the changed fields before and after, where the change comes from,
+// who made it and the operation it belongs to. A change, or every change of
+// an operation such as renaming an artist everywhere or an import, can be
+// undone as long as the fields still have the values it left.
+
+// Sources of a change
+const (
+	sourceEdit   = "edit"   // The web interface and the API
+	sourceImport = "import" // CSV imports
+	sourceSync   = "sync"   // Discogs sync
+	sourceScrape = "scrape" // Metadata providers
+	sourceBulk   = "bulk"   // One action changing many releases, i.e. renaming an artist everywhere
+	sourceUndo   = "undo"
+)
+
+// Actions of a change
+const (
+	changeCreate = "create"
+	changeUpdate = "update"
+	changeDelete = "delete"
+)
+
+// auditIgnoredFields are the Release fields left out of the log: the ID is
+// the release of the change and the media follow the format.
+var auditIgnoredFields = []string{"id", "media"}
+
+// auditSetFields are lists of names undone as sets: undoing an update only
+// takes back the names it added or removed, so undoing an older tag or edit
+// keeps the later ones.
+var auditSetFields = []string{"tags", "edited_fields"}
+
+// ReleaseChange is one change to one release. Fields are named and valued as
+// in the JSON of a Release.
+type ReleaseChange struct {
+	ID         int                        `json:"id"`
+	ReleaseRef int                        `json:"release"` // ID of the release, which may have been deleted since
+	Artist     string                     `json:"artist"`
+	Title      string                     `json:"title"`
+	Action     string                     `json:"action"` // changeCreate, changeUpdate or changeDelete
+	Source     string                     `json:"source"`
+	Actor      string                     `json:"actor"`
+	Batch      string                     `json:"batch"`  // Shared by the changes of one operation
+	Before     map[string]json.RawMessage `json:"before"` // Changed fields, or every field of a deleted release
+	After      map[string]json.RawMessage `json:"after"`  // Changed fields, or every field of a created release
+	ChangedAt  time.Time                  `json:"changed_at"`
+	UndoneBy   int                        `json:"undone_by"` // The change undoing it, 0 while not undone
+}
+
+// ChangeQuery describes which changes to list. Zero values mean "no filter".
+type ChangeQuery struct {
+	ReleaseRef int
+	Batch      string
+	Limit      int // 0 means no limit
+}
+
+// ChangeStore keeps the audit log of the releases.
+type ChangeStore interface {
+	AddChange(c ReleaseChange) (int, error)
+	GetChange(id int) (*ReleaseChange, error)
+	ListChanges(q ChangeQuery) ([]ReleaseChange, error) // Newest first
+	Undo(steps []undoStep) ([]int, error)               // Writes and logs every step or none, returning the IDs of the logged changes
+	DeleteAndLog(c ReleaseChange) (int, error)          // Deletes the release of a deletion and logs it in one transaction
+}
+
+// undoStep is the undoing of one change: the release written back, nil when
+// undoing deletes it, and the change logged for it.
+type undoStep struct {
+	Undone  int // ID of the change undone
+	Release *Release
+	Change  ReleaseChange
+}
+
+// changeStore is the ChangeStore used by the application, set up with store.
+var changeStore ChangeStore
+
+// errChangeNotFound is returned by change stores when no change matches an ID.
+var errChangeNotFound = errors.New("change not found")
+
+// errUndoConflict is returned when a change cannot be undone because the
+// release changed again since.
+var errUndoConflict = errors.New("cannot undo")
+
+// changeOrigin is where a change comes from, who made it and the operation it
+// belongs to.
+type changeOrigin struct {
+	Source string
+	Actor  string
+	Batch  string
+}
+
+// newBatch returns an ID for the changes of a new operation.
+func newBatch() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestOrigin attributes the changes of a request to the user named in the
+// AUDIT_USER_HEADER header, set by an authenticating proxy, or to the basic
+// auth user, falling back to the address of the client. No header is trusted
+// unless AUDIT_USER_HEADER names one, any client could send it.
+func requestOrigin(r *http.Request, source string) changeOrigin {
+	actor := ""
+	if header := getEnvWithDefault("AUDIT_USER_HEADER", ""); header != "" {
+		actor = r.Header.Get(header)
+	}
+	if actor == "" {
+		actor, _, _ = r.BasicAuth()
+	}
+	if actor == "" {
+		actor = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			actor = host
+		}
+	}
+	return changeOrigin{Source: source, Actor: actor, Batch: newBatch()}
+}
+
+// jobOrigin attributes the changes of a background job to the job. They share
+// one batch so the whole job can be undone.
+func jobOrigin(j *jobContext, source string) changeOrigin {
+	id := j.ID()
+	return changeOrigin{Source: source, Actor: fmt.Sprintf("job %d", id), Batch: fmt.Sprintf("job-%d", id)}
+}
+
+// withSource returns the origin of another kind of change in the same operation.
+func (o changeOrigin) withSource(source string) changeOrigin {
+	o.Source = source
+	return o
+}
+
+// releaseFields returns the logged fields of a release as JSON values.
+func releaseFields(r Release) map[string]json.RawMessage {
+	fields := make(map[string]json.RawMessage)
+	data, err := json.Marshal(r)
+	if err == nil {
+		err = json.Unmarshal(data, &fields)
+	}
+	if err != nil {
+		log.Printf("Error encoding release %d for the audit log: %v", r.ID, err)
+	}
+	for _, name := range auditIgnoredFields {
+		delete(fields, name)
+	}
+	return fields
+}
+
+// withFields returns a release with some fields set to logged values.
+func withFields(r Release, fields map[string]json.RawMessage) (Release, error) {
+	values := releaseFields(r)
+	for name, value := range fields {
+		values[name] = value
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return r, err
+	}
+	var restored Release
+	if err := json.Unmarshal(data, &restored); err != nil {
+		return r, err
+	}
+	restored.ID = r.ID
+	return restored, nil
+}
+
+// sameValue compares logged values, an empty list being the same as none.
+func sameValue(a, b json.RawMessage) bool {
+	canonical := func(value json.RawMessage) []byte {
+		var buf bytes.Buffer
+		if len(value) == 0 || json.Compact(&buf, value) != nil || buf.String() == "null" {
+			return []byte("[]")
+		}
+		return buf.Bytes()
+	}
+	return bytes.Equal(canonical(a), canonical(b))
+}
+
+// newReleaseChange describes a change from the release before and after it,
+// before being nil for a new release and after for a deleted one. Updates
+// leaving every field as it was are not changes.
+func newReleaseChange(origin changeOrigin, before, after *Release) (ReleaseChange, bool) {
+	c := ReleaseChange{Source: origin.Source, Actor: origin.Actor, Batch: origin.Batch, ChangedAt: time.Now().UTC()}
+	switch {
+	case before == nil:
+		c.Action = changeCreate
+		c.ReleaseRef, c.Artist, c.Title = after.ID, after.Artist, after.Title
+		c.After = releaseFields(*after)
+	case after == nil:
+		c.Action = changeDelete
+		c.ReleaseRef, c.Artist, c.Title = before.ID, before.Artist, before.Title
+		c.Before = releaseFields(*before)
+	default:
+		c.Action = changeUpdate
+		c.ReleaseRef, c.Artist, c.Title = after.ID, after.Artist, after.Title
+		c.Before = make(map[string]json.RawMessage)
+		c.After = make(map[string]json.RawMessage)
+		old := releaseFields(*before)
+		for name, value := range releaseFields(*after) {
+			if !sameValue(old[name], value) {
+				c.Before[name] = old[name]
+				c.After[name] = value
+			}
+		}
+		if len(c.After) == 0 {
+			return c, false
+		}
+	}
+	return c, true
+}
+
+// recordChange logs a change made through store, returning the ID of the
+// logged change, 0 when nothing changed. The change is done by then, so
+// failing to log it is logged and returned for callers that care.
+func recordChange(origin changeOrigin, before, after *Release) (int, error) {
+	c, ok := newReleaseChange(origin, before, after)
+	if !ok {
+		return 0, nil
+	}
+	id, err := changeStore.AddChange(c)
+	if err != nil {
+		log.Printf("Error recording %s of release %d in the audit log: %v", c.Action, c.ReleaseRef, err)
+	}
+	return id, err
+}
+
+// auditWrites serializes the audited writes, so the releases read before and
+// after a change only differ by that change. Imports hold it too, as they
+// write releases in their own transaction.
+var auditWrites sync.Mutex
+
+// auditRelease runs a change of one release and logs it.
+func auditRelease(origin changeOrigin, id int, change func() error) error {
+	return auditReleases(origin, []int{id}, change)
+}
+
+// auditReleases runs a change of several releases and logs what changed on
+// each, even when the change fails halfway. Releases gone afterwards are
+// logged as deleted. The change holds auditWrites, so it must not wait on
+// the network.
+func auditReleases(origin changeOrigin, ids []int, change func() error) error {
+	auditWrites.Lock()
+	defer auditWrites.Unlock()
+
+	befores := make([]*Release, len(ids))
+	for i, id := range ids {
+		before, err := store.GetRelease(id)
+		if err != nil {
+			return err
+		}
+		befores[i] = before
+	}
+
+	changeErr := change()
+	for i, id := range ids {
+		after, err := store.GetRelease(id)
+		if err == errReleaseNotFound {
+			after = nil
+		} else if err != nil {
+			log.Printf("Error fetching release %d for the audit log: %v", id, err)
+			continue
+		}
+		recordChange(origin, befores[i], after)
+	}
+	return changeErr
+}
+
+// undoChanges undoes changes as one operation, newest first, skipping the
+// ones already undone. Every change is checked before anything is written:
+// it must find the values it left once the newer changes are undone. The
+// releases are then written back and the undo logged in one transaction, and
+// the changes made by the undo are returned.
+func undoChanges(origin changeOrigin, changes []ReleaseChange) ([]ReleaseChange, error) {
+	var pending []ReleaseChange
+	for _, c := range changes {
+		if c.UndoneBy == 0 {
+			pending = append(pending, c)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, fmt.Errorf("%w: already undone", errUndoConflict)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID > pending[j].ID })
+
+	auditWrites.Lock()
+	defer auditWrites.Unlock()
+
+	// The releases as they will be after undoing the changes checked so far
+	state := make(map[int]*Release)
+	current := func(id int) (*Release, error) {
+		if r, ok := state[id]; ok {
+			return r, nil
+		}
+		r, err := store.GetRelease(id)
+		if err == errReleaseNotFound {
+			return nil, nil
+		}
+		return r, err
+	}
+	var steps []undoStep
+	var removedCovers []string
+	for _, c := range pending {
+		before, err := current(c.ReleaseRef)
+		if err != nil {
+			return nil, err
+		}
+		restored, err := undoneRelease(c, before)
+		if err != nil {
+			return nil, err
+		}
+		state[c.ReleaseRef] = restored
+
+		// Logged even when nothing changes, as the undone change points to it
+		change, _ := newReleaseChange(origin, before, restored)
+		steps = append(steps, undoStep{Undone: c.ID, Release: restored, Change: change})
+		if restored == nil && before.CoverImage != "" {
+			removedCovers = append(removedCovers, before.CoverImage)
+		}
+	}
+
+	ids, err := changeStore.Undo(steps)
+	if err != nil {
+		return nil, err
+	}
+	for _, coverImage := range removedCovers {
+		removeCoverImage(coverImage)
+	}
+
+	undone := make([]ReleaseChange, len(steps))
+	for i, step := range steps {
+		undone[i] = step.Change
+		undone[i].ID = ids[i]
+	}
+	return undone, nil
+}
+
+// undoneRelease returns the release as it is once a change is undone, nil
+// when undoing deletes it, or an errUndoConflict when the release no longer
+// has the values the change left.
+func undoneRelease(c ReleaseChange, current *Release) (*Release, error) {
+	name := fmt.Sprintf("%s - %s", c.Artist, c.Title)
+	if c.Action == changeDelete {
+		if current != nil {
+			return nil, fmt.Errorf("%w: %s was added again since", errUndoConflict, name)
+		}
+		restored, err := withFields(Release{ID: c.ReleaseRef}, c.Before)
+		if err != nil {
+			return nil, err
+		}
+		// The cover image was deleted with the release
+		if _, err := os.Stat(filepath.Join("web/static/covers", filepath.Base(restored.CoverImage))); restored.CoverImage != "" && err != nil {
+			restored.CoverImage = ""
+		}
+		return &restored, nil
+	}
+
+	if current == nil {
+		return nil, fmt.Errorf("%w: %s was deleted since", errUndoConflict, name)
+	}
+	fields := releaseFields(*current)
+	var changed []string
+	for field, value := range c.After {
+		if c.Action == changeUpdate && containsString(auditSetFields, field) {
+			continue
+		}
+		if !sameValue(fields[field], value) {
+			changed = append(changed, field)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		return nil, fmt.Errorf("%w: %s of %s changed since, undo the later changes first", errUndoConflict, strings.Join(changed, ", "), name)
+	}
+	if c.Action == changeCreate {
+		return nil, nil
+	}
+
+	before := make(map[string]json.RawMessage, len(c.Before))
+	for field, value := range c.Before {
+		before[field] = value
+		if containsString(auditSetFields, field) {
+			before[field] = undoSetField(fields[field], value, c.After[field])
+		}
+	}
+	restored, err := withFields(*current, before)
+	if err != nil {
+		return nil, err
+	}
+	return &restored, nil
+}
+
+// undoSetField takes the names added by a change out of the current list and
+// puts the ones it removed back.
+func undoSetField(current, before, after json.RawMessage) json.RawMessage {
+	var names, old, changed []string
+	json.Unmarshal(current, &names)
+	json.Unmarshal(before, &old)
+	json.Unmarshal(after, &changed)
+
+	restored := []string{}
+	for _, name := range names {
+		if containsString(old, name) || !containsString(changed, name) {
+			restored = append(restored, name)
+		}
+	}
+	for _, name := range old {
+		if !containsString(restored, name) {
+			restored = append(restored, name)
+		}
+	}
+	value, _ := json.Marshal(restored)
+	return value
+}
+
+// insertReleaseChange logs a change within a transaction, for the imports
+// writing releases themselves.
+func insertReleaseChange(q dbExecutor, c ReleaseChange) (int, error) {
+	before, err := json.Marshal(c.Before)
+	if err != nil {
+		return 0, err
+	}
+	after, err := json.Marshal(c.After)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = q.QueryRow(`
+		INSERT INTO release_changes (release_ref, artist, title, action, source, actor, batch, old_values, new_values, changed_at, undone_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id`,
+		c.ReleaseRef, c.Artist, c.Title, c.Action, c.Source, c.Actor, c.Batch, string(before), string(after), c.ChangedAt, c.UndoneBy).Scan(&id)
+	if err != nil {
+		log.Printf("Error recording %s of release %d in the audit log: %v", c.Action, c.ReleaseRef, err)
+	}
+	return id, err
+}
+
+const changeColumns = "id, release_ref, artist, title, action, source, actor, batch, old_values, new_values, changed_at, undone_by"
+
+func scanChange(row rowScanner) (*ReleaseChange, error) {
+	var c ReleaseChange
+	var before, after string
+	err := row.Scan(&c.ID, &c.ReleaseRef, &c.Artist, &c.Title, &c.Action, &c.Source, &c.Actor, &c.Batch, &before, &after, &c.ChangedAt, &c.UndoneBy)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(before), &c.Before); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(after), &c.After); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *sqlStore) AddChange(c ReleaseChange) (int, error) {
+	return insertReleaseChange(s.db, c)
+}
+
+func (s *sqlStore) GetChange(id int) (*ReleaseChange, error) {
+	c, err := scanChange(s.db.QueryRow("SELECT "+changeColumns+" FROM release_changes WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, errChangeNotFound
+	}
+	return c, err
+}
+
+func (s *sqlStore) ListChanges(q ChangeQuery) ([]ReleaseChange, error) {
+	var conditions []string
+	var args []interface{}
+	if q.ReleaseRef != 0 {
+		args = append(args, q.ReleaseRef)
+		conditions = append(conditions, fmt.Sprintf("release_ref = $%d", len(args)))
+	}
+	if q.Batch != "" {
+		args = append(args, q.Batch)
+		conditions = append(conditions, fmt.Sprintf("batch = $%d", len(args)))
+	}
+
+	query := "SELECT " + changeColumns + " FROM release_changes"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying the audit log: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []ReleaseChange
+	for rows.Next() {
+		c, err := scanChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, *c)
+	}
+	return changes, rows.Err()
+}
+
+func (s *sqlStore) DeleteAndLog(c ReleaseChange) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM releases WHERE id = $1", c.ReleaseRef)
+	if err != nil {
+		log.Printf("Error deleting release ID %d: %v", c.ReleaseRef, err)
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return 0, errReleaseNotFound
+	}
+	id, err := insertReleaseChange(tx, c)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (s *sqlStore) Undo(steps []undoStep) ([]int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids := make([]int, len(steps))
+	for i, step := range steps {
+		if step.Release == nil {
+			_, err = tx.Exec("DELETE FROM releases WHERE id = $1", step.Change.ReleaseRef)
+		} else {
+			err = s.saveRelease(tx, *step.Release)
+		}
+		if err != nil {
+			log.Printf("Error undoing change %d: %v", step.Undone, err)
+			return nil, err
+		}
+
+		if ids[i], err = insertReleaseChange(tx, step.Change); err != nil {
+			return nil, err
+		}
+		// Another undo may have taken the change back since it was read
+		res, err := tx.Exec("UPDATE release_changes SET undone_by = $1 WHERE id = $2 AND undone_by = 0", ids[i], step.Undone)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return nil, fmt.Errorf("%w: change %d was already undone", errUndoConflict, step.Undone)
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// saveRelease writes every field of a release back, with its tracklist and
+// media, inserting it again with the same ID when it was deleted.
+func (s *sqlStore) saveRelease(tx dbExecutor, r Release) error {
+	var existing int
+	err := tx.QueryRow("SELECT id FROM releases WHERE release_id = $1 AND id != $2", r.ReleaseID, r.ID).Scan(&existing)
+	if err == nil {
+		return errReleaseExists
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	args := []interface{}{r.CatalogNumber, r.Artist, r.Title, r.Label, r.Format, r.Rating, r.Released, r.ReleaseID,
+		r.CollectionFolder, r.DateAdded, r.CollectionMediaCondition, r.CollectionSleeveCondition, r.CollectionNotes,
+		s.dialect.TagsValue(addFields(r.Tags)), r.Year, r.CoverImage, r.Wanted, r.Physical, s.dialect.TagsValue(addFields(r.EditedFields)),
+		r.Status, r.StatusDate, r.SalePrice, r.StatusNote, r.ID}
+	res, err := tx.Exec(`
+		UPDATE releases SET catalog_number = $1, artist = $2, title = $3, label = $4, format = $5, rating = $6,
+			released = $7, release_id = $8, collection_folder = $9, date_added = $10, collection_media_condition = $11,
+			collection_sleeve_condition = $12, collection_notes = $13, tags = $14, year = $15, cover_image = $16,
+			wanted = $17, physical = $18, edited_fields = $19, status = $20, status_date = $21, sale_price = $22,
+			status_note = $23
+		WHERE id = $24`, args...)
+	if err != nil {
+		log.Printf("Error saving release %d: %v", r.ID, err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		_, err := tx.Exec(`
+			INSERT INTO releases (catalog_number, artist, title, label, format, rating, released, release_id,
+				collection_folder, date_added, collection_media_condition, collection_sleeve_condition, collection_notes,
+				tags, year, cover_image, wanted, physical, edited_fields, status, status_date, sale_price, status_note, id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24)`, args...)
+		if err != nil {
+			log.Printf("Error inserting release %d again: %v", r.ID, err)
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM tracks WHERE release_ref = $1", r.ID); err != nil {
+		return err
+	}
+	if err := insertTracks(tx, r.ID, r.Tracks); err != nil {
+		return err
+	}
+	return replaceReleaseMedia(tx, r.ID, r.Format)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// historyStore keeps both the releases and their history.
+type historyStore interface {
+	ReleaseStore
+	ChangeStore
+}
+
+// checkUndoBatch undoes the changes of an operation on a store, then makes a
+// later undo fail halfway and checks it left nothing behind.
+func checkUndoBatch(t *testing.T, s historyStore) {
+	store, changeStore = s, s
+
+	dummy, err := s.CreateRelease(Release{ReleaseID: 101, Artist: "Portishead", Title: "Dummy", Format: "LP, Album", Tags: []string{"trip hop"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := s.CreateRelease(Release{ReleaseID: 102, Artist: "Portishead", Title: "Third", Format: "CD, Album"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origin := changeOrigin{Source: sourceEdit, Actor: "test", Batch: "edits"}
+	if err := auditRelease(origin, dummy, func() error { return s.AddTag(dummy, "bristol") }); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteRelease(origin, third); err != nil {
+		t.Fatal(err)
+	}
+
+	undo := changeOrigin{Source: sourceUndo, Actor: "test", Batch: "undo"}
+	undone, err := undoBatch(undo, "edits")
+	if err != nil {
+		t.Fatalf("undoBatch: %v", err)
+	}
+	if len(undone) != 2 || undone[0].Action != changeCreate || undone[1].Action != changeUpdate {
+		t.Errorf("undo logged %+v, want the deletion then the tag undone", undone)
+	}
+	if r, err := s.GetRelease(third); err != nil || r.Title != "Third" {
+		t.Errorf("deleted release restored as %+v, %v", r, err)
+	}
+	if r, err := s.GetRelease(dummy); err != nil || !reflect.DeepEqual([]string(r.Tags), []string{"trip hop"}) {
+		t.Errorf("tags after undo = %q, %v, want [trip hop]", r.Tags, err)
+	}
+	changes, err := s.ListChanges(ChangeQuery{Batch: "edits"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		if c.UndoneBy == 0 {
+			t.Errorf("change %d not marked as undone", c.ID)
+		}
+	}
+	if _, err := undoBatch(undo, "edits"); !errors.Is(err, errUndoConflict) {
+		t.Errorf("undoing twice = %v, want %v", err, errUndoConflict)
+	}
+
+	// Restoring the release fails once another one took its release_id, after
+	// the newer wanted flag was already taken back
+	origin.Batch = "conflict"
+	if err := deleteRelease(origin, third); err != nil {
+		t.Fatal(err)
+	}
+	if err := auditRelease(origin, dummy, func() error { return s.SetWanted(dummy, true) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateRelease(Release{ReleaseID: 102, Artist: "Portishead", Title: "Third (Deluxe)", Format: "2xCD, Album"}); err != nil {
+		t.Fatal(err)
+	}
+	logged, err := s.ListChanges(ChangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := undoBatch(undo, "conflict"); !errors.Is(err, errReleaseExists) {
+		t.Fatalf("undoBatch = %v, want %v", err, errReleaseExists)
+	}
+	if r, err := s.GetRelease(dummy); err != nil || !r.Wanted {
+		t.Errorf("wanted flag taken back by a failed undo: %+v, %v", r, err)
+	}
+	after, err := s.ListChanges(ChangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after, logged) {
+		t.Errorf("failed undo changed the history from %+v to %+v", logged, after)
+	}
+}
+
+func TestMemoryStoreUndoBatch(t *testing.T) {
+	checkUndoBatch(t, newMemoryStore())
+}
+
+func TestSQLiteStoreUndoBatch(t *testing.T) {
+	checkUndoBatch(t, newTestSQLiteStore(t))
+}
+
+// changedFields returns the names of the fields a change logged, sorted.
+func changedFields(c ReleaseChange) []string {
+	var names []string
+	for name := range c.After {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestAuditReleasesOneAtATime(t *testing.T) {
+	s := newMemoryStore(Release{ID: 1, ReleaseID: 101, Artist: "Portishead", Title: "Dummy", Format: "LP, Album"})
+	store, changeStore = s, s
+	origin := changeOrigin{Source: sourceEdit, Actor: "test", Batch: "edits"}
+
+	started, proceed := make(chan struct{}), make(chan struct{})
+	tagged := make(chan error)
+	go func() {
+		tagged <- auditRelease(origin, 1, func() error {
+			close(started)
+			<-proceed
+			return s.AddTag(1, "trip hop")
+		})
+	}()
+	<-started
+
+	// The edit waits for the change in progress, instead of ending up in its log
+	wanted := make(chan error)
+	go func() {
+		wanted <- auditRelease(origin, 1, func() error { return s.SetWanted(1, true) })
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(proceed)
+	if err := <-tagged; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-wanted; err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := s.ListChanges(ChangeQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("logged %d changes, want 2", len(changes))
+	}
+	if got := changedFields(changes[1]); !reflect.DeepEqual(got, []string{"tags"}) {
+		t.Errorf("tagging logged %v, want [tags]", got)
+	}
+	if got := changedFields(changes[0]); !reflect.DeepEqual(got, []string{"wanted"}) {
+		t.Errorf("concurrent edit logged %v, want [wanted]", got)
+	}
+}
+
+func TestRequestOrigin(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string // AUDIT_USER_HEADER
+		user   string // X-Forwarded-User
+		basic  string
+		want   string
+	}{
+		{name: "client address", want: "192.0.2.1"},
+		{name: "basic auth", basic: "alice", want: "alice"},
+		{name: "untrusted header", user: "mallory", want: "192.0.2.1"},
+		{name: "untrusted header with basic auth", user: "mallory", basic: "alice", want: "alice"},
+		{name: "proxy header", header: "X-Forwarded-User", user: "bob", basic: "alice", want: "bob"},
+		{name: "proxy header missing", header: "X-Forwarded-User", basic: "alice", want: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AUDIT_USER_HEADER", tt.header)
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/releases/1", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if tt.user != "" {
+				r.Header.Set("X-Forwarded-User", tt.user)
+			}
+			if tt.basic != "" {
+				r.SetBasicAuth(tt.basic, "secret")
+			}
+			if got := requestOrigin(r, sourceEdit).Actor; got != tt.want {
+				t.Errorf("Actor = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDeleteReleaseUnlogged checks a release is only deleted along with its
+// change, here on a database whose history cannot be written.
+func TestDeleteReleaseUnlogged(t *testing.T) {
+	s := newTestSQLiteStore(t)
+	store, changeStore = s, s
+
+	id, err := s.CreateRelease(Release{ReleaseID: 101, Artist: "Portishead", Title: "Dummy", Format: "LP, Album"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("DROP TABLE release_changes"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deleteRelease(changeOrigin{Source: sourceEdit, Actor: "test", Batch: "delete"}, id); err == nil {
+		t.Fatal("deleteRelease succeeded without logging the deletion")
+	}
+	if _, err := s.GetRelease(id); err != nil {
+		t.Errorf("release deleted without its history: %v", err)
+	}
+}
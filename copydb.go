@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// copyTable describes a table copied by the copy-db command. Tables are
+// copied in order, so parents must come before the tables referencing them.
+type copyTable struct {
+	Name         string
+	ArrayColumns []string // Columns holding tags, stored differently per dialect
+}
+
+// copyTables lists every application table, keep it in sync with migrations.
+var copyTables = []copyTable{
+	{Name: "releases", ArrayColumns: []string{"tags", "edited_fields"}},
+	{Name: "release_media"},
+	{Name: "tracks"},
+	{Name: "jobs"},
+	{Name: "import_rows"},
+	{Name: "release_changes"},
+}
+
+// runCopyDBCommand implements `music-collection copy-db <from> <to> [--replace]`,
+// copying every table between PostgreSQL and SQLite, i.e. `copy-db postgres sqlite`.
+func runCopyDBCommand(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: copy-db postgres|sqlite postgres|sqlite [--replace]")
+	}
+	replace := len(args) > 2 && args[2] == "--replace"
+	if args[0] == args[1] {
+		return fmt.Errorf("source and destination must be different databases")
+	}
+
+	src, _, err := openDatabase(args[0])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, dstDialect, err := openDatabase(args[1])
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// Both schemas must match, the destination is migrated, the source is only checked
+	srcVersion, err := currentSchemaVersion(src)
+	if err != nil {
+		return fmt.Errorf("error reading source schema version: %v", err)
+	}
+	if srcVersion != latestMigrationVersion() {
+		return fmt.Errorf("source database is at schema version %d, run `migrate up` on it first (expected %d)", srcVersion, latestMigrationVersion())
+	}
+	if err := migrateUp(dst, dstDialect); err != nil {
+		return err
+	}
+
+	tx, err := dst.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := prepareCopyDestination(tx, replace); err != nil {
+		return err
+	}
+
+	for _, table := range copyTables {
+		count, err := copyTableRows(src, tx, table, dstDialect)
+		if err != nil {
+			return fmt.Errorf("error copying table %s: %v", table.Name, err)
+		}
+		log.Printf("Copied %d rows into %s", count, table.Name)
+
+		if dstDialect.Name() == "postgres" {
+			// Explicit IDs were inserted, move the sequence past them
+			_, err := tx.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), COALESCE(MAX(id), 1)) FROM %[1]s", table.Name))
+			if err != nil {
+				return fmt.Errorf("error resetting sequence for %s: %v", table.Name, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// prepareCopyDestination refuses to copy into tables holding data unless
+// replace is set, in which case they are emptied first.
+func prepareCopyDestination(tx *sql.Tx, replace bool) error {
+	for i := len(copyTables) - 1; i >= 0; i-- {
+		name := copyTables[i].Name
+		if replace {
+			if _, err := tx.Exec("DELETE FROM " + name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM " + name).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("destination table %s is not empty, use --replace to overwrite it", name)
+		}
+	}
+	return nil
+}
+
+func copyTableRows(src *sql.DB, tx *sql.Tx, table copyTable, dstDialect sqlDialect) (int, error) {
+	rows, err := src.Query("SELECT * FROM " + table.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	isArray := make([]bool, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, col := range columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		for _, arrayCol := range table.ArrayColumns {
+			if col == arrayCol {
+				isArray[i] = true
+			}
+		}
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table.Name, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+
+	count := 0
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return count, err
+		}
+
+		for i, value := range values {
+			if isArray[i] && value != nil {
+				var tags pq.StringArray
+				if err := (tagsColumn{&tags}).Scan(value); err != nil {
+					return count, err
+				}
+				values[i] = dstDialect.TagsValue(tags)
+			}
+		}
+
+		if _, err := tx.Exec(insert, values...); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
@@ -2,13 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
-
-	"github.com/lib/pq"
 )
 
 
@@ -46,186 +45,145 @@ func getEnvWithDefault(key, defaultValue string) string {
 
 var db *sql.DB
 
-func searchReleases(query string) ([]Release, error) {
-	query = "%" + query + "%"
-	sqlQuery := `
-		SELECT id, catalog_number, artist, title, label, format, rating, released, release_id, 
-		       collection_folder, date_added, collection_media_condition, collection_sleeve_condition, 
-		       collection_notes, tags, year, cover_image, wanted, physical 
-		FROM releases 
-		WHERE unaccent(title) ILIKE unaccent($1) 
-		   OR unaccent(artist) ILIKE unaccent($1) 
-		   OR year::text ILIKE $1 
-		   OR unaccent(physical) ILIKE unaccent($1)
-		ORDER BY title ASC`
-
-	rows, err := db.Query(sqlQuery, query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var releases []Release
-	for rows.Next() {
-		var r Release
-		var coverImage sql.NullString
-		if err := rows.Scan(&r.ID, &r.CatalogNumber, &r.Artist, &r.Title, &r.Label, &r.Format, &r.Rating, &r.Released, &r.ReleaseID, &r.CollectionFolder, &r.DateAdded, &r.CollectionMediaCondition, &r.CollectionSleeveCondition, &r.CollectionNotes, &r.Tags, &r.Year, &coverImage, &r.Wanted, &r.Physical); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-		r.CoverImage = coverImage.String
-		releases = append(releases, r)
-	}
-	return releases, rows.Err()
-}
-
-func fetchReleaseByID(id string, orderBy string, orderDirection string) (*Release, error) {
-	var release Release
-	var coverImage sql.NullString
-	query := "SELECT id, title, year, artist, tags, release_id, cover_image, wanted, physical FROM releases WHERE id = $1"
+// dbDialect is the SQL dialect of db, selected with DB_DRIVER.
+var dbDialect sqlDialect
 
-	if orderBy != "" {
-		query += " ORDER BY " + orderBy
+// releaseColumns lists every releases column in the order scanRelease expects.
+const releaseColumns = `id, catalog_number, artist, title, label, format, rating, released, release_id,
+	collection_folder, date_added, collection_media_condition, collection_sleeve_condition,
+	collection_notes, tags, year, cover_image, wanted, physical, edited_fields, status, status_date,
+	sale_price, status_note`
 
-		if orderDirection != "" {
-			query += " " + orderDirection
-		}
-	}
+// sqlStore implements ReleaseStore on top of PostgreSQL or SQLite, the
+// differences between both are kept in its dialect.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
 
-	err := db.QueryRow(query, id).Scan(
-		&release.ID,
-		&release.Title,
-		&release.Year,
-		&release.Artist,
-		&release.Tags,
-		&release.ReleaseID,
-		&coverImage,
-		&release.Wanted,
-		&release.Physical,
-	)
-	if err != nil {
-		return nil, err
-	}
+func newSQLStore(db *sql.DB, dialect sqlDialect) *sqlStore {
+	return &sqlStore{db: db, dialect: dialect}
+}
 
-	release.CoverImage = coverImage.String
-	return &release, nil
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
-func fetchReleasesByYear(year string, orderBy string, orderDirection string) ([]Release, error) {
-	query := "SELECT id, catalog_number, artist, title, label, format, rating, released, release_id, collection_folder, date_added, collection_media_condition, collection_sleeve_condition, collection_notes, tags, year, cover_image, wanted, physical FROM releases WHERE year = $1"
+func scanRelease(row rowScanner) (Release, error) {
+	var r Release
+	var coverImage sql.NullString
+	err := row.Scan(&r.ID, &r.CatalogNumber, &r.Artist, &r.Title, &r.Label, &r.Format, &r.Rating, &r.Released, &r.ReleaseID, &r.CollectionFolder, &r.DateAdded, &r.CollectionMediaCondition, &r.CollectionSleeveCondition, &r.CollectionNotes, tagsColumn{&r.Tags}, &r.Year, &coverImage, &r.Wanted, &r.Physical, tagsColumn{&r.EditedFields}, &r.Status, &r.StatusDate, &r.SalePrice, &r.StatusNote)
+	r.CoverImage = coverImage.String
+	return r, err
+}
 
-	if orderBy != "" {
-		query += " ORDER BY " + orderBy
+// buildReleaseWhere turns the filters of a ReleaseQuery into a WHERE clause
+// (without the keyword) and its positional arguments.
+func (s *sqlStore) buildReleaseWhere(q ReleaseQuery) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
 
-		if orderDirection != "" {
-			query += " " + orderDirection
+	if q.Artist != "" {
+		// account for artists with / in the name (i.e. Lennon/Ono)
+		var artistConditions []string
+		for _, a := range strings.Split(q.Artist, "/") {
+			artistConditions = append(artistConditions, "artist LIKE "+arg("%"+a+"%"))
 		}
+		conditions = append(conditions, "("+strings.Join(artistConditions, " OR ")+")")
 	}
-
-	rows, err := db.Query(query, year)
-	if err != nil {
-		return nil, err
+	if q.ExactArtist != "" {
+		conditions = append(conditions, "artist = "+arg(q.ExactArtist))
 	}
-	defer rows.Close()
-
-	var releases []Release
-  for rows.Next() {
-		var r Release
-		var coverImage sql.NullString
-		if err := rows.Scan(&r.ID, &r.CatalogNumber, &r.Artist, &r.Title, &r.Label, &r.Format, &r.Rating, &r.Released, &r.ReleaseID, &r.CollectionFolder, &r.DateAdded, &r.CollectionMediaCondition, &r.CollectionSleeveCondition, &r.CollectionNotes, &r.Tags, &r.Year, &coverImage, &r.Wanted, &r.Physical); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-		r.CoverImage = coverImage.String
-		releases = append(releases, r)
+	if q.Year != 0 {
+		conditions = append(conditions, "year = "+arg(q.Year))
 	}
-	return releases, rows.Err()
-}
-
-func fetchReleasesByTag(tag string, orderBy string, orderDirection string) ([]Release, error) {
-	query := "SELECT id, catalog_number, artist, title, label, format, rating, released, release_id, collection_folder, date_added, collection_media_condition, collection_sleeve_condition, collection_notes, tags, year, cover_image, wanted, physical FROM releases WHERE $1 = ANY(tags)"
-
-	if orderBy != "" {
-		query += " ORDER BY " + orderBy
-
-		if orderDirection != "" {
-			query += " " + orderDirection
-		}
+	if q.Tag != "" {
+		conditions = append(conditions, s.dialect.HasTag(arg(q.Tag)))
 	}
-
-	rows, err := db.Query(query, tag)
-	if err != nil {
-		return nil, err
+	if q.Physical != "" {
+		conditions = append(conditions, "physical = "+arg(q.Physical))
 	}
-	defer rows.Close()
-
-	var releases []Release
-	for rows.Next() {
-		var r Release
-		var coverImage sql.NullString
-		if err := rows.Scan(&r.ID, &r.CatalogNumber, &r.Artist, &r.Title, &r.Label, &r.Format, &r.Rating, &r.Released, &r.ReleaseID, &r.CollectionFolder, &r.DateAdded, &r.CollectionMediaCondition, &r.CollectionSleeveCondition, &r.CollectionNotes, &r.Tags, &r.Year, &coverImage, &r.Wanted, &r.Physical); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-		r.CoverImage = coverImage.String
-		releases = append(releases, r)
+	if q.Label != "" {
+		conditions = append(conditions, "label = "+arg(q.Label))
 	}
-	return releases, rows.Err()
-}
-
-func fetchReleasesByArtist(artist string, orderBy string, orderDirection string) ([]Release, error) {
-	// account for artists with / in the name (i.e. Lennon/Ono)
-	artists := strings.Split(artist, "/")
-	var conditions []string
-	var args []interface{}
-	for i, a := range artists {
-		conditions = append(conditions, fmt.Sprintf("artist LIKE $%d", i+1))
-		args = append(args, "%"+a+"%")
+	if q.Wanted != nil {
+		conditions = append(conditions, "wanted = "+arg(*q.Wanted))
 	}
-	whereClause := strings.Join(conditions, " OR ")
-
-	query := "SELECT id, catalog_number, artist, title, label, format, rating, released, release_id, collection_folder, date_added, collection_media_condition, collection_sleeve_condition, collection_notes, tags, year, cover_image, wanted, physical FROM releases WHERE " + whereClause
-
-	if orderBy != "" {
-		query += " ORDER BY " + orderBy
-
-		if orderDirection != "" {
-			query += " " + orderDirection
-		}
+	if q.ExcludeID != 0 {
+		conditions = append(conditions, "id != "+arg(q.ExcludeID))
 	}
-
-	rows, err := db.Query(query, args...)
-	if err != nil {
-		return nil, err
+	switch q.Status {
+	case "":
+		conditions = append(conditions, "status = ''")
+	case "former":
+		conditions = append(conditions, "status != ''")
+	case "all":
+		// Every release, whatever its status
+	default:
+		conditions = append(conditions, "status = "+arg(q.Status))
+	}
+	if q.NeedScraping {
+		conditions = append(conditions, "(year = 0 OR "+s.dialect.TagsEmpty()+" OR cover_image IS NULL OR cover_image = '')")
+	}
+	if q.Search != "" {
+		p := arg("%" + q.Search + "%")
+		conditions = append(conditions, "("+strings.Join([]string{
+			s.dialect.MatchText("title", p),
+			s.dialect.MatchText("artist", p),
+			s.dialect.MatchText("CAST(year AS TEXT)", p),
+			s.dialect.MatchText("physical", p),
+			"EXISTS (SELECT 1 FROM tracks WHERE tracks.release_ref = releases.id AND "+s.dialect.MatchText("tracks.title", p)+")",
+		}, " OR ")+")")
 	}
-	defer rows.Close()
 
-	var releases []Release
-	for rows.Next() {
-		var r Release
-		var coverImage sql.NullString
-		if err := rows.Scan(&r.ID, &r.CatalogNumber, &r.Artist, &r.Title, &r.Label, &r.Format, &r.Rating, &r.Released, &r.ReleaseID, &r.CollectionFolder, &r.DateAdded, &r.CollectionMediaCondition, &r.CollectionSleeveCondition, &r.CollectionNotes, &r.Tags, &r.Year, &coverImage, &r.Wanted, &r.Physical); err != nil {
-			log.Printf("Error scanning row: %v", err)
+	return strings.Join(conditions, " AND "), args
+}
+
+// orderClause builds the ORDER BY list from whitelisted columns only, with id
+// as the final tiebreaker.
+func orderClause(keys []SortKey) string {
+	var parts []string
+	for _, key := range keys {
+		column, ok := sortableFields[key.Field]
+		if !ok {
 			continue
 		}
-		r.CoverImage = coverImage.String
-		releases = append(releases, r)
+		if key.Desc {
+			parts = append(parts, column+" DESC")
+		} else {
+			parts = append(parts, column+" ASC")
+		}
 	}
-	return releases, rows.Err()
+	return strings.Join(append(parts, "id ASC"), ", ")
 }
 
-func fetchReleasesByPhysical(physical string, orderBy string, orderDirection string) ([]Release, error) {
-	query := "SELECT id, catalog_number, artist, title, label, format, rating, released, release_id, collection_folder, date_added, collection_media_condition, collection_sleeve_condition, collection_notes, tags, year, cover_image, wanted, physical FROM releases WHERE physical = $1"
+func (s *sqlStore) ListReleases(q ReleaseQuery) ([]Release, error) {
+	query := "SELECT " + releaseColumns + " FROM releases"
+	where, args := s.buildReleaseWhere(q)
+	if where != "" {
+		query += " WHERE " + where
+	}
 
-	if orderBy != "" {
-		query += " ORDER BY " + orderBy
+	query += " ORDER BY " + orderClause(q.Sort)
 
-		if orderDirection != "" {
-			query += " " + orderDirection
-		}
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	if q.Offset > 0 {
+		query += fmt.Sprintf(" OFFSET %d", q.Offset)
 	}
 
-	rows, err := db.Query(query, physical)
+	return s.queryReleases(query, args...)
+}
+
+// queryReleases runs a query selecting releaseColumns.
+func (s *sqlStore) queryReleases(query string, args ...interface{}) ([]Release, error) {
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -233,353 +191,297 @@ func fetchReleasesByPhysical(physical string, orderBy string, orderDirection str
 
 	var releases []Release
 	for rows.Next() {
-		var r Release
-		var coverImage sql.NullString
-		if err := rows.Scan(&r.ID, &r.CatalogNumber, &r.Artist, &r.Title, &r.Label, &r.Format, &r.Rating, &r.Released, &r.ReleaseID, &r.CollectionFolder, &r.DateAdded, &r.CollectionMediaCondition, &r.CollectionSleeveCondition, &r.CollectionNotes, &r.Tags, &r.Year, &coverImage, &r.Wanted, &r.Physical); err != nil {
+		r, err := scanRelease(rows)
+		if err != nil {
 			log.Printf("Error scanning row: %v", err)
 			continue
 		}
-		r.CoverImage = coverImage.String
 		releases = append(releases, r)
 	}
-	return releases, rows.Err()
-}
-
-func fetchReleases(orderBy string, orderDirection string) ([]Release, error) {
-	var releases []Release
-	query := "SELECT id, catalog_number, artist, title, label, format, rating, released, release_id, collection_folder, date_added, collection_media_condition, collection_sleeve_condition, collection_notes, tags, year, cover_image, wanted, physical FROM releases"
-
-	if orderBy != "" {
-		query += " ORDER BY " + orderBy
-
-		if orderDirection != "" {
-			query += " " + orderDirection
-		}
-	}
-
-	rows, err := db.Query(query)
-	if err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return releases, s.attachMedia(releases)
+}
 
-	for rows.Next() {
-		var r Release
-		var coverImage sql.NullString
-		if err := rows.Scan(&r.ID, &r.CatalogNumber, &r.Artist, &r.Title, &r.Label, &r.Format, &r.Rating, &r.Released, &r.ReleaseID, &r.CollectionFolder, &r.DateAdded, &r.CollectionMediaCondition, &r.CollectionSleeveCondition, &r.CollectionNotes, &r.Tags, &r.Year, &coverImage, &r.Wanted, &r.Physical); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-		r.CoverImage = coverImage.String
-		releases = append(releases, r)
+func (s *sqlStore) CountReleases(q ReleaseQuery) (int, error) {
+	query := "SELECT COUNT(*) FROM releases"
+	where, args := s.buildReleaseWhere(q)
+	if where != "" {
+		query += " WHERE " + where
 	}
 
-	return releases, rows.Err()
+	var count int
+	err := s.db.QueryRow(query, args...).Scan(&count)
+	return count, err
 }
 
-func fetchWantedReleases(orderBy string, orderDirection string) ([]Release, error) {
-	var releases []Release
-	query := "SELECT id, catalog_number, artist, title, label, format, rating, released, release_id, collection_folder, date_added, collection_media_condition, collection_sleeve_condition, collection_notes, tags, year, cover_image, wanted, physical FROM releases WHERE wanted = TRUE"
-
-	if orderBy != "" {
-		query += " ORDER BY " + orderBy
-
-		if orderDirection != "" {
-			query += " " + orderDirection
-		}
+func (s *sqlStore) GetRelease(id int) (*Release, error) {
+	release, err := scanRelease(s.db.QueryRow("SELECT "+releaseColumns+" FROM releases WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, errReleaseNotFound
 	}
-
-	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var r Release
-		var coverImage sql.NullString
-		if err := rows.Scan(&r.ID, &r.CatalogNumber, &r.Artist, &r.Title, &r.Label, &r.Format, &r.Rating, &r.Released, &r.ReleaseID, &r.CollectionFolder, &r.DateAdded, &r.CollectionMediaCondition, &r.CollectionSleeveCondition, &r.CollectionNotes, &r.Tags, &r.Year, &coverImage, &r.Wanted, &r.Physical); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-		r.CoverImage = coverImage.String
-		releases = append(releases, r)
+	releases := []Release{release}
+	if err := s.attachMedia(releases); err != nil {
+		return nil, err
 	}
-
-	return releases, rows.Err()
+	if err := s.attachTracks(&releases[0]); err != nil {
+		return nil, err
+	}
+	return &releases[0], nil
 }
 
-func fetchNeedScrapingReleases(orderBy string, orderDirection string) ([]Release, error) {
-	var releases []Release
-
-	// Default ordering
-	if orderBy == "" {
-		orderBy = "title"
+func (s *sqlStore) DeleteRelease(id int) error {
+	res, err := s.db.Exec("DELETE FROM releases WHERE id = $1", id)
+	if err != nil {
+		log.Printf("Error deleting release ID %d: %v", id, err)
+		return err
 	}
-	if orderDirection == "" {
-		orderDirection = "asc"
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errReleaseNotFound
 	}
+	return nil
+}
 
-	// Sanitize orderBy and orderDirection
-	switch orderBy {
-	case "title", "artist", "year":
-		// Valid order by values
-	default:
-		orderBy = "title" // Default to title if invalid
+func (s *sqlStore) SetWanted(id int, wanted bool) error {
+	_, err := s.db.Exec("UPDATE releases SET wanted = $1 WHERE id = $2", wanted, id)
+	if err != nil {
+		log.Printf("Error updating wanted status for release ID: %d: %v", id, err)
 	}
+	return err
+}
 
-	switch orderDirection {
-	case "asc", "desc":
-		// Valid order direction values
-	default:
-		orderDirection = "asc" // Default to ascending if invalid
+// SetStatus archives, sells or, with the zero ReleaseStatus, restores a release.
+func (s *sqlStore) SetStatus(id int, status ReleaseStatus) error {
+	res, err := s.db.Exec("UPDATE releases SET status = $1, status_date = $2, sale_price = $3, status_note = $4 WHERE id = $5",
+		status.Status, status.Date, status.Price, status.Note, id)
+	if err != nil {
+		log.Printf("Error updating status of release ID %d: %v", id, err)
+		return err
 	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errReleaseNotFound
+	}
+	return nil
+}
 
-	// Query for releases with year=0 OR empty/null tags OR empty/null cover_image
-	query := fmt.Sprintf(`
-		SELECT id, catalog_number, artist, title, label, format, rating, released, release_id, 
-		       collection_folder, date_added, collection_media_condition, collection_sleeve_condition, 
-		       collection_notes, tags, year, cover_image, wanted, physical
-		FROM releases 
-		WHERE year = 0 OR tags IS NULL OR array_length(tags, 1) IS NULL OR cover_image IS NULL OR cover_image = '' 
-		ORDER BY %s %s
-	`, orderBy, orderDirection)
-
-	rows, err := db.Query(query)
+func (s *sqlStore) SetCoverImage(id int, coverImage string) error {
+	res, err := s.db.Exec("UPDATE releases SET cover_image = $1 WHERE id = $2", coverImage, id)
 	if err != nil {
-		return nil, err
+		log.Printf("Error updating cover image for release ID %d: %v", id, err)
+		return err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var r Release
-		var coverImage sql.NullString
-		if err := rows.Scan(&r.ID, &r.CatalogNumber, &r.Artist, &r.Title, &r.Label, &r.Format, &r.Rating, &r.Released, &r.ReleaseID, &r.CollectionFolder, &r.DateAdded, &r.CollectionMediaCondition, &r.CollectionSleeveCondition, &r.CollectionNotes, &r.Tags, &r.Year, &coverImage, &r.Wanted, &r.Physical); err != nil {
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-		r.CoverImage = coverImage.String
-		releases = append(releases, r)
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errReleaseNotFound
 	}
-
-	return releases, rows.Err()
+	return nil
 }
 
-func setWantedStatus(id string, wanted bool) error {
-	_, err := db.Exec("UPDATE releases SET wanted = $1 WHERE id = $2", wanted, id)
+// UpdateRelease updates the core fields of a release and ensures the decade tag is correct.
+func (s *sqlStore) UpdateRelease(id int, u ReleaseUpdate) error {
+	// Fetch the current release for its tags and to know what is being edited
+	current, err := s.GetRelease(id)
 	if err != nil {
-		log.Printf("Error updating wanted status for release ID: %s: %v", id, err)
+		return err
 	}
-	return err
-}
+	r := applyReleaseUpdate(*current, u)
 
-// fetchTagsForReleaseID retrieves the current tags for a given release ID.
-func fetchTagsForReleaseID(id string) ([]string, error) {
-	var tags pq.StringArray
-	err := db.QueryRow("SELECT tags FROM releases WHERE id = $1", id).Scan(&tags)
+	tx, err := s.db.Begin()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return []string{}, nil // Return empty slice if no tags found or release doesn't exist
-		}
-		log.Printf("Error fetching tags for release ID %s: %v", id, err)
-		return nil, err
+		return err
 	}
-	// Handle potential NULL tags column by returning an empty slice
-	if tags == nil {
-		return []string{}, nil
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE releases SET title = $1, artist = $2, year = $3, tags = $4, catalog_number = $5, label = $6,
+			format = $7, physical = $8, rating = $9, released = $10, collection_folder = $11, date_added = $12,
+			collection_media_condition = $13, collection_sleeve_condition = $14, collection_notes = $15,
+			wanted = $16, cover_image = $17, edited_fields = $18
+		WHERE id = $19
+	`, r.Title, r.Artist, r.Year, s.dialect.TagsValue(r.Tags), r.CatalogNumber, r.Label,
+		r.Format, r.Physical, r.Rating, r.Released, r.CollectionFolder, r.DateAdded,
+		r.CollectionMediaCondition, r.CollectionSleeveCondition, r.CollectionNotes,
+		r.Wanted, r.CoverImage, s.dialect.TagsValue(r.EditedFields), id)
+	if err != nil {
+		log.Printf("Error updating release in database (ID: %d): %v", id, err)
+		return err
 	}
-	return tags, nil
+	if r.Format != current.Format {
+		if err := replaceReleaseMedia(tx, id, r.Format); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-// Helper function to get release_id as string from id
-func fetchReleaseIDByID(id string) (string, error) {
-	var releaseID int
-	err := db.QueryRow("SELECT release_id FROM releases WHERE id = $1", id).Scan(&releaseID)
+func (s *sqlStore) RenameArtist(oldArtist, newArtist string) error {
+	releases, err := s.queryReleases("SELECT "+releaseColumns+" FROM releases WHERE artist = $1", oldArtist)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return strconv.Itoa(releaseID), nil
-}
 
-// updateReleaseInDB updates the core fields of a release and ensures the decade tag is correct.
-func updateReleaseInDB(id, title, artist, yearStr, coverImage string, convertToOwned bool) error {
-	// Fetch current tags
-	currentTags, err := fetchTagsForReleaseID(id)
+	// Renamed rows are marked as edited so re-imports keep the new name
+	tx, err := s.db.Begin()
 	if err != nil {
-		// Log the error but proceed, assuming empty tags if fetch failed
-		log.Printf("Warning: Could not fetch current tags for release ID %s: %v", id, err)
-		currentTags = []string{}
+		return err
 	}
-
-	// Prepare new tags list, filtering out old decade tags
-	newTags := []string{}
-	for _, tag := range currentTags {
-		// Check if the tag matches the decade format "YYYYs"
-		if len(tag) >= 5 && strings.HasSuffix(tag, "s") {
-			if _, err := strconv.Atoi(tag[:len(tag)-1]); err == nil && len(tag[:len(tag)-1]) == 4 {
-				// It's a decade tag, skip it
-				continue
-			}
+	defer tx.Rollback()
+	for _, release := range releases {
+		_, err := tx.Exec("UPDATE releases SET artist = $1, edited_fields = $2 WHERE id = $3",
+			newArtist, s.dialect.TagsValue(addFields(release.EditedFields, "artist")), release.ID)
+		if err != nil {
+			log.Printf("Error updating all artist occurrences from '%s' to '%s': %v", oldArtist, newArtist, err)
+			return err
 		}
-		newTags = append(newTags, tag)
 	}
-
-	// Parse year and add new decade tag
-	yearInt, err := strconv.Atoi(yearStr)
-	if err == nil && yearInt > 0 {
-		decade := (yearInt / 10) * 10
-		decadeTag := fmt.Sprintf("%ds", decade)
-		// Add the new decade tag if it's not already present (shouldn't be after filtering, but check just in case)
-		tagExists := false
-		for _, tag := range newTags {
-			if tag == decadeTag {
-				tagExists = true
-				break
-			}
-		}
-		if !tagExists {
-			newTags = append(newTags, decadeTag)
-		}
-	} else if err != nil {
-		log.Printf("Warning: Invalid year '%s' provided for release ID %s. Cannot determine decade tag.", yearStr, id)
-		// Keep year as 0 or invalid value in DB if conversion fails
-		yearStr = "0"
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error updating all artist occurrences from '%s' to '%s': %v", oldArtist, newArtist, err)
+		return err
 	}
+	log.Printf("Successfully updated all artist occurrences from '%s' to '%s'", oldArtist, newArtist)
+	return nil
+}
 
+func (s *sqlStore) AddTag(id int, tag string) error {
+	_, err := s.db.Exec(s.dialect.AddTagSQL(), tag, id)
+	return err
+}
 
-	// Build the query dynamically
-	query := `UPDATE releases SET title = $1, artist = $2, year = $3, tags = $4`
-	args := []interface{}{title, artist, yearStr, pq.StringArray(newTags)}
-	argCounter := 5 // Start counting args from 5
+func (s *sqlStore) RemoveTag(id int, tag string) error {
+	_, err := s.db.Exec(s.dialect.RemoveTagSQL(), tag, id)
+	return err
+}
 
-	// Only update wanted status if converting from wanted to owned
-	if convertToOwned {
-		query += fmt.Sprintf(", wanted = $%d", argCounter)
-		args = append(args, false)
-		argCounter++
+// SetScrapedData replaces tags and year of the release with the given Discogs release_id.
+func (s *sqlStore) SetScrapedData(releaseID int, tags []string, year int) (bool, error) {
+	res, err := s.db.Exec("UPDATE releases SET tags = $1, year = $2 WHERE release_id = $3", s.dialect.TagsValue(tags), year, releaseID)
+	if err != nil {
+		return false, err
 	}
-
-	if coverImage != "" {
-		query += fmt.Sprintf(", cover_image = $%d", argCounter)
-		args = append(args, coverImage)
-		argCounter++
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("Error getting rows affected: %v", err)
 	}
+	return rowsAffected > 0, nil
+}
 
-	query += fmt.Sprintf(" WHERE id = $%d", argCounter)
-	args = append(args, id)
-
-	_, err = db.Exec(query, args...)
+// SetScrapedDetails sets the release date and label of the release with the
+// given Discogs release_id, empty values keep the current ones.
+func (s *sqlStore) SetScrapedDetails(releaseID int, released, label string) (bool, error) {
+	res, err := s.db.Exec(`UPDATE releases SET released = COALESCE(NULLIF($1, ''), released),
+		label = COALESCE(NULLIF($2, ''), label) WHERE release_id = $3`, released, label, releaseID)
 	if err != nil {
-		log.Printf("Error updating release in database (ID: %s): %v", id, err)
+		return false, err
 	}
-	return err
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("Error getting rows affected: %v", err)
+	}
+	return rowsAffected > 0, nil
 }
 
-
-func updateAllArtistOccurrences(oldArtist, newArtist string) error {
-	_, err := db.Exec("UPDATE releases SET artist = $1 WHERE artist = $2", newArtist, oldArtist)
+// SetPhysical changes the physical format of several releases in one transaction.
+func (s *sqlStore) SetPhysical(physical map[int]string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		log.Printf("Error updating all artist occurrences from '%s' to '%s': %v", oldArtist, newArtist, err)
 		return err
 	}
-	log.Printf("Successfully updated all artist occurrences from '%s' to '%s'", oldArtist, newArtist)
-	return nil
+	defer tx.Rollback()
+
+	for id, value := range physical {
+		if _, err := tx.Exec("UPDATE releases SET physical = $1 WHERE id = $2", value, id); err != nil {
+			log.Printf("Error setting physical format of release %d: %v", id, err)
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 // --- Statistics Functions ---
 
 type StatItem struct {
-	Label string
-	Count int
+	Label string `json:"label"`
+	Count int    `json:"count"`
 }
 
-// fetchStatsByDecade counts owned releases grouped by decade.
-func fetchStatsByDecade() ([]StatItem, error) {
-	query := `
-		SELECT (year / 10) * 10 AS decade, COUNT(*) as count
-		FROM releases
-		WHERE wanted = FALSE AND year > 0  -- Exclude wanted and releases with year 0
-		GROUP BY decade
-		ORDER BY decade ASC;
-	`
-	rows, err := db.Query(query)
+// queryStats runs a two column (label, count) statistics query.
+func (s *sqlStore) queryStats(name string, query string) ([]StatItem, error) {
+	rows, err := s.db.Query(query)
 	if err != nil {
-		log.Printf("Error fetching stats by decade: %v", err)
+		log.Printf("Error fetching %s stats: %v", name, err)
 		return nil, err
 	}
 	defer rows.Close()
 
 	var stats []StatItem
 	for rows.Next() {
-		var decade int
-		var count int
-		if err := rows.Scan(&decade, &count); err != nil {
-			log.Printf("Error scanning decade stat row: %v", err)
+		var item StatItem
+		if err := rows.Scan(&item.Label, &item.Count); err != nil {
+			log.Printf("Error scanning %s stat row: %v", name, err)
 			continue
 		}
-		stats = append(stats, StatItem{Label: fmt.Sprintf("%ds", decade), Count: count})
+		stats = append(stats, item)
 	}
 	return stats, rows.Err()
 }
 
-// fetchStatsByFormat counts owned releases grouped by physical format.
-func fetchStatsByFormat() ([]StatItem, error) {
-	query := `
-		SELECT COALESCE(physical, 'Unknown') as format, COUNT(*) as count
+// TagCounts lists every tag with the number of releases using it, archived
+// and sold releases aside like in the other counts.
+func (s *sqlStore) TagCounts() ([]StatItem, error) {
+	return s.queryStats("tag", s.dialect.TagCountsSQL())
+}
+
+// ArtistCounts lists every artist with their number of releases in the
+// collection or wantlist.
+func (s *sqlStore) ArtistCounts() ([]StatItem, error) {
+	return s.queryStats("artist", `
+		SELECT artist, COUNT(*) as count
 		FROM releases
-		WHERE wanted = FALSE
-		GROUP BY COALESCE(physical, 'Unknown') -- Use the expression instead of the alias
-		ORDER BY count DESC;
-	`
-	rows, err := db.Query(query)
-	if err != nil {
-		log.Printf("Error fetching stats by format: %v", err)
-		return nil, err
-	}
-	defer rows.Close()
+		WHERE artist IS NOT NULL AND artist != '' AND status = ''
+		GROUP BY artist
+		ORDER BY artist ASC;
+	`)
+}
 
-	var stats []StatItem
-	for rows.Next() {
-		var item StatItem
-		if err := rows.Scan(&item.Label, &item.Count); err != nil {
-			log.Printf("Error scanning format stat row: %v", err)
-			continue
-		}
-		stats = append(stats, item)
-	}
-	return stats, rows.Err()
+// StatsByDecade counts owned releases grouped by decade.
+func (s *sqlStore) StatsByDecade() ([]StatItem, error) {
+	return s.queryStats("decade", `
+		SELECT CAST((year / 10) * 10 AS TEXT) || 's' AS decade, COUNT(*) as count
+		FROM releases
+		WHERE wanted = FALSE AND status = '' AND year > 0  -- Exclude wanted, former and releases with year 0
+		GROUP BY (year / 10) * 10
+		ORDER BY (year / 10) * 10 ASC;
+	`)
 }
 
-// fetchStatsTopArtists gets the top 10 artists by owned release count.
-func fetchStatsTopArtists() ([]StatItem, error) {
-	query := `
+// StatsByFormat counts the owned media by type, a 3xLP box counting as 3
+// records. Releases without media are counted once as Unknown.
+func (s *sqlStore) StatsByFormat() ([]StatItem, error) {
+	return s.queryStats("format", `
+		SELECT COALESCE(m.type, 'Unknown') as format, SUM(COALESCE(m.quantity, 1)) as count
+		FROM releases r
+		LEFT JOIN release_media m ON m.release_ref = r.id AND m.type NOT IN ('Box Set', 'All Media')
+		WHERE r.wanted = FALSE AND r.status = ''
+		GROUP BY COALESCE(m.type, 'Unknown') -- Use the expression instead of the alias
+		ORDER BY count DESC;
+	`)
+}
+
+// StatsTopArtists gets the top 20 artists by owned release count.
+func (s *sqlStore) StatsTopArtists() ([]StatItem, error) {
+	return s.queryStats("top artists", `
 		SELECT artist, COUNT(*) as count
 		FROM releases
-		WHERE wanted = FALSE AND artist IS NOT NULL AND artist != ''
+		WHERE wanted = FALSE AND status = '' AND artist IS NOT NULL AND artist != ''
 		GROUP BY artist
 		ORDER BY count DESC
 		LIMIT 20;
-	`
-	rows, err := db.Query(query)
-	if err != nil {
-		log.Printf("Error fetching top artists stats: %v", err)
-		return nil, err
-	}
-	defer rows.Close()
-
-	var stats []StatItem
-	for rows.Next() {
-		var item StatItem
-		if err := rows.Scan(&item.Label, &item.Count); err != nil {
-			log.Printf("Error scanning top artist stat row: %v", err)
-			continue
-		}
-		stats = append(stats, item)
-	}
-	return stats, rows.Err()
+	`)
 }
 
-
 func updateReleaseFromScraping(release Release, tags []string, result *strings.Builder) error {
 	uniqueTags := make(map[string]bool)
 	var dedupedTags []string
@@ -634,21 +536,15 @@ func updateReleaseFromScraping(release Release, tags []string, result *strings.B
 		}
 	}
 
-	finalTagsArray := pq.StringArray(finalTags)
-
 	// Update the release in the database with filtered tags and determined year
-	res, err := db.Exec("UPDATE releases SET tags = $1, year = $2 WHERE release_id = $3", finalTagsArray, year, release.ReleaseID)
+	updated, err := store.SetScrapedData(release.ReleaseID, finalTags, year)
 	if err != nil {
 		log.Printf("Error updating tags/year for release ID: %d, ReleaseID: %d: %v", release.ID, release.ReleaseID, err)
 		result.WriteString(fmt.Sprintf("<br>Error updating tags/year for release ID: %d, ReleaseID: %d: %v\n", release.ID, release.ReleaseID, err))
 		return err
 	}
 
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		log.Printf("Error getting rows affected: %v", err)
-	}
-	if rowsAffected > 0 {
+	if updated {
 		// log.Printf("Successfully updated year for ReleaseID: %d to %d", release.ReleaseID, year)
 		// result.WriteString(fmt.Sprintf("<br>Updated Album %s - year: %d tags: %s\n", release.Title, year, filteredTags))
 	} else {
@@ -658,60 +554,202 @@ func updateReleaseFromScraping(release Release, tags []string, result *strings.B
 	return nil
 }
 
-func addTagToRelease(id string, tag string) error {
-	_, err := db.Exec(`
-		UPDATE releases 
-		SET tags = array_append(COALESCE(tags, ARRAY[]::TEXT[]), $1) 
-		WHERE id = $2 AND (tags IS NULL OR NOT ($1 = ANY(tags)))`,
-		tag, id)
-	return err
+const jobColumns = "id, kind, status, total, processed, failed, message, created_at, started_at, finished_at"
+
+func scanJob(row rowScanner) (*Job, error) {
+	var job Job
+	var startedAt, finishedAt sql.NullTime
+	err := row.Scan(&job.ID, &job.Kind, &job.Status, &job.Total, &job.Processed, &job.Failed, &job.Message, &job.CreatedAt, &startedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return &job, nil
+}
+
+func (s *sqlStore) CreateJob(kind string) (*Job, error) {
+	row := s.db.QueryRow("INSERT INTO jobs (kind, status) VALUES ($1, $2) RETURNING "+jobColumns, kind, jobRunning)
+	job, err := scanJob(row)
+	if err != nil {
+		log.Printf("Error creating %s job: %v", kind, err)
+		return nil, err
+	}
+	return job, nil
 }
 
-func removeTagFromRelease(id string, tag string) error {
-	_, err := db.Exec(`
-		UPDATE releases 
-		SET tags = array_remove(tags, $1) 
-		WHERE id = $2`,
-		tag, id)
+func (s *sqlStore) SaveJob(job Job) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = $1, total = $2, processed = $3, failed = $4, message = $5, started_at = $6, finished_at = $7
+		WHERE id = $8`,
+		job.Status, job.Total, job.Processed, job.Failed, job.Message, job.StartedAt, job.FinishedAt, job.ID)
 	return err
 }
 
-func initDB() {
-	var err error
-	db, err = sql.Open("postgres", getDBConnStr())
+func (s *sqlStore) GetJob(id int) (*Job, error) {
+	job, err := scanJob(s.db.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, errJobNotFound
+	}
+	return job, err
+}
+
+func (s *sqlStore) ListJobs(limit int) ([]Job, error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT %s FROM jobs ORDER BY id DESC LIMIT %d", jobColumns, limit))
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Error querying jobs: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
 	}
+	return jobs, rows.Err()
+}
 
-	// Create unaccent extension if it doesn't exist
-	_, err = db.Exec("CREATE EXTENSION IF NOT EXISTS unaccent")
+func (s *sqlStore) RunningJobs() ([]Job, error) {
+	rows, err := s.db.Query("SELECT "+jobColumns+" FROM jobs WHERE status = $1 ORDER BY id", jobRunning)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Error querying running jobs: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, rows.Err()
+}
+
+// InterruptRunningJobs marks jobs left running by a stopped process, run at startup.
+func (s *sqlStore) InterruptRunningJobs() (int, error) {
+	res, err := s.db.Exec("UPDATE jobs SET status = $1, finished_at = CURRENT_TIMESTAMP WHERE status = $2", jobInterrupted, jobRunning)
+	if err != nil {
+		return 0, err
 	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS releases (
-        id SERIAL PRIMARY KEY,
-        catalog_number TEXT,
-        artist TEXT,
-        title TEXT,
-        label TEXT,
-        format TEXT,
-        rating TEXT,
-        released TEXT,
-        release_id INT UNIQUE,
-        collection_folder TEXT,
-        date_added TEXT,
-        collection_media_condition TEXT,
-        collection_sleeve_condition TEXT,
-        collection_notes TEXT,
-        tags TEXT[],
-        year INT,
-        cover_image TEXT,
-				wanted BOOLEAN DEFAULT FALSE,
-        physical TEXT
-    );`)
+// SaveImportRows stores the report of an import job in one transaction.
+func (s *sqlStore) SaveImportRows(jobID int, rows []importRow) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
+	stmt, err := tx.Prepare(`
+		INSERT INTO import_rows (job_id, line, outcome, release_id, artist, title, reason, changes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		changes, err := json.Marshal(row.Changes)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(jobID, row.Row, row.Outcome, row.ReleaseID, row.Artist, row.Title, row.Reason, string(changes)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) ImportRows(jobID int) ([]importRow, error) {
+	rows, err := s.db.Query(`
+		SELECT line, outcome, release_id, artist, title, reason, changes
+		FROM import_rows WHERE job_id = $1 ORDER BY id`, jobID)
+	if err != nil {
+		log.Printf("Error querying import report of job %d: %v", jobID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var report []importRow
+	for rows.Next() {
+		var row importRow
+		var changes string
+		if err := rows.Scan(&row.Row, &row.Outcome, &row.ReleaseID, &row.Artist, &row.Title, &row.Reason, &changes); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &row.Changes); err != nil {
+			return nil, err
+		}
+		report = append(report, row)
+	}
+	return report, rows.Err()
+}
+
+// openDatabase opens a connection for a DB_DRIVER value ("postgres" or "sqlite").
+func openDatabase(driverName string) (*sql.DB, sqlDialect, error) {
+	dialect, err := dialectFor(driverName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conn *sql.DB
+	if dialect.Name() == "sqlite" {
+		log.Printf("Using SQLite database: %s", getSQLitePath())
+		conn, err = openSQLite(getSQLitePath())
+	} else {
+		conn, err = sql.Open("postgres", getDBConnStr())
+	}
+	return conn, dialect, err
+}
+
+// openDB opens the configured database connection without touching the schema.
+func openDB() {
+	var err error
+	db, dbDialect, err = openDatabase(getEnvWithDefault("DB_DRIVER", "postgres"))
 	if err != nil {
 		log.Fatal(err)
 	}
+	s := newSQLStore(db, dbDialect)
+	store = s
+	jobStore = s
+	changeStore = s
+}
+
+// initDB opens the database and brings the schema up to date. Set
+// DB_AUTO_MIGRATE=false to only verify the schema version at startup and run
+// migrations explicitly with the migrate command.
+func initDB() {
+	openDB()
+
+	if getEnvWithDefault("DB_AUTO_MIGRATE", "true") == "true" {
+		if err := migrateUp(db, dbDialect); err != nil {
+			log.Fatal(err)
+		}
+		if err := backfillReleaseMedia(); err != nil {
+			log.Printf("Error storing release media: %v", err)
+		}
+		return
+	}
+
+	if err := checkSchemaVersion(db); err != nil {
+		log.Fatal(err)
+	}
+	if current, err := currentSchemaVersion(db); err == nil && current < latestMigrationVersion() {
+		log.Printf("Warning: database schema is at version %d, run `migrate up` to reach version %d", current, latestMigrationVersion())
+	}
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// sqlDialect holds the SQL that differs between the supported databases.
+// Everything else in the stores is written in SQL both understand, using
+// $n placeholders which SQLite accepts as well.
+type sqlDialect interface {
+	// Name is the DB_DRIVER value selecting this dialect.
+	Name() string
+	// TagsValue converts tags into the value stored in the tags column.
+	TagsValue(tags []string) driver.Valuer
+	// HasTag returns a condition matching rows whose tags contain param.
+	HasTag(param string) string
+	// TagsEmpty returns a condition matching rows without tags.
+	TagsEmpty() string
+	// MatchText returns an accent and case insensitive LIKE of column against param.
+	MatchText(column, param string) string
+	// AddTagSQL appends $1 to the tags of release $2 unless already present.
+	AddTagSQL() string
+	// RemoveTagSQL removes $1 from the tags of release $2.
+	RemoveTagSQL() string
+	// TagCountsSQL lists (tag, count) pairs over the releases still in the
+	// collection or wantlist.
+	TagCountsSQL() string
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return "postgres" }
+
+func (postgresDialect) TagsValue(tags []string) driver.Valuer {
+	return pq.StringArray(tags)
+}
+
+func (postgresDialect) HasTag(param string) string {
+	return param + " = ANY(tags)"
+}
+
+func (postgresDialect) TagsEmpty() string {
+	return "(tags IS NULL OR array_length(tags, 1) IS NULL)"
+}
+
+func (postgresDialect) MatchText(column, param string) string {
+	return fmt.Sprintf("unaccent(%s) ILIKE unaccent(%s)", column, param)
+}
+
+func (postgresDialect) AddTagSQL() string {
+	return `
+		UPDATE releases
+		SET tags = array_append(COALESCE(tags, ARRAY[]::TEXT[]), $1)
+		WHERE id = $2 AND (tags IS NULL OR NOT ($1 = ANY(tags)))`
+}
+
+func (postgresDialect) RemoveTagSQL() string {
+	return `
+		UPDATE releases
+		SET tags = array_remove(tags, $1)
+		WHERE id = $2`
+}
+
+func (postgresDialect) TagCountsSQL() string {
+	return `
+		SELECT tag, COUNT(*) AS count
+		FROM releases, unnest(tags) AS tag
+		WHERE status = ''
+		GROUP BY tag
+		ORDER BY count DESC, tag ASC`
+}
+
+// sqliteDialect stores tags as a JSON array in a TEXT column and relies on
+// the unaccent function registered in sqlite.go.
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return "sqlite" }
+
+func (sqliteDialect) TagsValue(tags []string) driver.Valuer {
+	return jsonTags(tags)
+}
+
+func (sqliteDialect) HasTag(param string) string {
+	return "EXISTS (SELECT 1 FROM json_each(releases.tags) WHERE json_each.value = " + param + ")"
+}
+
+func (sqliteDialect) TagsEmpty() string {
+	return "(tags IS NULL OR json_array_length(tags) = 0)"
+}
+
+func (sqliteDialect) MatchText(column, param string) string {
+	// LIKE is already case insensitive in SQLite
+	return fmt.Sprintf("unaccent(%s) LIKE unaccent(%s)", column, param)
+}
+
+func (sqliteDialect) AddTagSQL() string {
+	return `
+		UPDATE releases
+		SET tags = json_insert(COALESCE(tags, '[]'), '$[#]', $1)
+		WHERE id = $2 AND NOT EXISTS (SELECT 1 FROM json_each(releases.tags) WHERE json_each.value = $1)`
+}
+
+func (sqliteDialect) RemoveTagSQL() string {
+	return `
+		UPDATE releases
+		SET tags = (SELECT json_group_array(value) FROM json_each(releases.tags) WHERE value != $1)
+		WHERE id = $2`
+}
+
+func (sqliteDialect) TagCountsSQL() string {
+	return `
+		SELECT json_each.value AS tag, COUNT(*) AS count
+		FROM releases, json_each(releases.tags)
+		WHERE releases.status = ''
+		GROUP BY json_each.value
+		ORDER BY count DESC, tag ASC`
+}
+
+// jsonTags is the SQLite representation of a tags column.
+type jsonTags []string
+
+func (t jsonTags) Value() (driver.Value, error) {
+	if t == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]string(t))
+	return string(b), err
+}
+
+// tagsColumn scans a tags column from either database into a pq.StringArray.
+type tagsColumn struct {
+	tags *pq.StringArray
+}
+
+func (c tagsColumn) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		*c.tags = nil
+		return nil
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return fmt.Errorf("unsupported tags value %T", src)
+	}
+
+	if strings.HasPrefix(s, "[") {
+		var tags []string
+		if err := json.Unmarshal([]byte(s), &tags); err != nil {
+			return err
+		}
+		*c.tags = tags
+		return nil
+	}
+	return c.tags.Scan(s)
+}
+
+// dialectFor returns the dialect for a DB_DRIVER value.
+func dialectFor(driverName string) (sqlDialect, error) {
+	switch driverName {
+	case "postgres":
+		return postgresDialect{}, nil
+	case "sqlite":
+		return sqliteDialect{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported DB_DRIVER %q, use postgres or sqlite", driverName)
+	}
+}
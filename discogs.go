@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Discogs counts requests in a moving window of one minute, see
+// https://www.discogs.com/developers#page:home,header:home-rate-limiting
+const (
+	discogsRateLimitWindow = time.Minute
+	discogsMaxAttempts     = 3
+)
+
+// errDiscogsNotFound is returned for 404 answers, i.e. deleted releases.
+var errDiscogsNotFound = errors.New("not found on Discogs")
+
+// discogsClient calls the Discogs API with a personal access token, pausing
+// whenever the rate limit headers say the current window is used up.
+// DISCOGS_BASE_URL points it elsewhere, i.e. to the fixture-server command.
+type discogsClient struct {
+	baseURL   *url.URL
+	token     string
+	userAgent string
+	client    *http.Client
+
+	mu      sync.Mutex
+	resetAt time.Time // No requests before this time
+}
+
+func newDiscogsClient() (*discogsClient, error) {
+	token := getEnvWithDefault("DISCOGS_TOKEN", "")
+	if token == "" {
+		return nil, errors.New("DISCOGS_TOKEN is not set, create a personal access token in the Discogs developer settings")
+	}
+	baseURL, err := url.Parse(strings.TrimRight(getEnvWithDefault("DISCOGS_BASE_URL", "https://api.discogs.com"), "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DISCOGS_BASE_URL: %v", err)
+	}
+	return &discogsClient{
+		baseURL:   baseURL,
+		token:     token,
+		userAgent: getEnvWithDefault("DISCOGS_USER_AGENT", "music-collection/1.0 +https://github.com/zigotica/music-collection-discogs"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// get calls an API path and decodes the JSON answer, retrying when Discogs
+// answers 429 Too Many Requests.
+func (c *discogsClient) get(ctx context.Context, path string, params url.Values, v interface{}) error {
+	requestURL := c.baseURL.String() + path
+	if len(params) > 0 {
+		requestURL += "?" + params.Encode()
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := c.wait(ctx); err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Discogs token="+c.token)
+		req.Header.Set("User-Agent", c.userAgent)
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("error calling Discogs: %v", err)
+		}
+		c.updateRateLimit(resp)
+
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests && attempt < discogsMaxAttempts:
+			resp.Body.Close()
+			log.Printf("Discogs rate limit reached, retrying %s", path)
+			continue
+		case resp.StatusCode == http.StatusNotFound:
+			resp.Body.Close()
+			return errDiscogsNotFound
+		case resp.StatusCode == http.StatusUnauthorized:
+			resp.Body.Close()
+			return errors.New("Discogs rejected the token in DISCOGS_TOKEN")
+		case resp.StatusCode != http.StatusOK:
+			resp.Body.Close()
+			return fmt.Errorf("Discogs returned status %d for %s", resp.StatusCode, path)
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(v)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error decoding Discogs response: %v", err)
+		}
+		return nil
+	}
+}
+
+// wait blocks until the rate limit allows another request.
+func (c *discogsClient) wait(ctx context.Context) error {
+	c.mu.Lock()
+	wait := time.Until(c.resetAt)
+	c.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	log.Printf("Waiting %s for the Discogs rate limit", wait.Round(time.Second))
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// updateRateLimit reads the X-Discogs-Ratelimit-Remaining header, or
+// Retry-After on 429 answers, to know when the next request can be sent.
+func (c *discogsClient) updateRateLimit(resp *http.Response) {
+	var pause time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests {
+		pause = discogsRateLimitWindow
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			pause = time.Duration(seconds) * time.Second
+		}
+	} else if remaining, err := strconv.Atoi(resp.Header.Get("X-Discogs-Ratelimit-Remaining")); err == nil && remaining <= 0 {
+		pause = discogsRateLimitWindow
+	}
+	if pause == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	c.resetAt = time.Now().Add(pause)
+	c.mu.Unlock()
+}
+
+// resolve makes relative URLs absolute, so fixtures can serve images too.
+func (c *discogsClient) resolve(ref string) string {
+	parsedURL, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return c.baseURL.ResolveReference(parsedURL).String()
+}
+
+// discogsProvider looks releases up by the Discogs release_id every imported
+// row already has, so no guessing from artist and title is needed.
+type discogsProvider struct {
+	client *discogsClient
+}
+
+func newDiscogsProvider() (MetadataProvider, error) {
+	client, err := newDiscogsClient()
+	if err != nil {
+		return nil, err
+	}
+	return &discogsProvider{client: client}, nil
+}
+
+func (p *discogsProvider) Name() string { return "discogs" }
+
+// discogsRelease is a full release, with the fields of the basic
+// information embedded in collection items.
+type discogsRelease struct {
+	discogsBasicInformation
+	Released  string   `json:"released"`
+	Genres    []string `json:"genres"`
+	Styles    []string `json:"styles"`
+	Tracklist []struct {
+		Position     string `json:"position"`
+		Type         string `json:"type_"`
+		Title        string `json:"title"`
+		Duration     string `json:"duration"`
+		ExtraArtists []struct {
+			Name string `json:"name"`
+			Role string `json:"role"`
+		} `json:"extraartists"`
+	} `json:"tracklist"`
+	Images []struct {
+		Type string `json:"type"`
+		URI  string `json:"uri"`
+	} `json:"images"`
+}
+
+func (p *discogsProvider) Lookup(ctx context.Context, release Release) (*Metadata, error) {
+	if release.ReleaseID <= 0 {
+		return nil, errNoMetadata
+	}
+
+	dr, err := p.client.release(ctx, release.ReleaseID)
+	if err != nil {
+		return nil, err
+	}
+	return p.client.metadata(dr), nil
+}
+
+// release gets a release by its release_id, errNoMetadata when Discogs does
+// not know it.
+func (c *discogsClient) release(ctx context.Context, releaseID int) (*discogsRelease, error) {
+	var dr discogsRelease
+	err := c.get(ctx, fmt.Sprintf("/releases/%d", releaseID), nil, &dr)
+	if errors.Is(err, errDiscogsNotFound) {
+		return nil, errNoMetadata
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dr, nil
+}
+
+// searchRelease returns the release_id of the first release found by the
+// database search, i.e. for a barcode or an artist and release_title,
+// errNoMetadata when nothing matches.
+func (c *discogsClient) searchRelease(ctx context.Context, params url.Values) (int, error) {
+	params.Set("type", "release")
+	params.Set("per_page", "5")
+	var result struct {
+		Results []struct {
+			ID int `json:"id"`
+		} `json:"results"`
+	}
+	if err := c.get(ctx, "/database/search", params, &result); err != nil {
+		return 0, err
+	}
+	if len(result.Results) == 0 {
+		return 0, errNoMetadata
+	}
+	return result.Results[0].ID, nil
+}
+
+// metadata converts a release to what metadata providers return.
+func (c *discogsClient) metadata(dr *discogsRelease) *Metadata {
+	metadata := &Metadata{
+		Year:     dr.Year,
+		Released: normalizeDiscogsDate(dr.Released),
+	}
+	if len(dr.Labels) > 0 {
+		metadata.Label = dr.Labels[0].Name
+	}
+
+	// Genres are broad ("Electronic"), styles narrow ("Trip Hop"), both make useful tags
+	for _, tag := range append(dr.Genres, dr.Styles...) {
+		metadata.Tags = append(metadata.Tags, strings.ToLower(tag))
+	}
+
+	for _, track := range dr.Tracklist {
+		if track.Type != "" && track.Type != "track" {
+			continue // Headings and index tracks
+		}
+		t := MetadataTrack{Position: track.Position, Title: track.Title, Duration: track.Duration}
+		for _, artist := range track.ExtraArtists {
+			t.Credits = append(t.Credits, artist.Role+": "+artist.Name)
+		}
+		metadata.Tracks = append(metadata.Tracks, t)
+	}
+
+	// The primary image is the front cover, secondary ones are back, labels,
+	// etc. and are only used when there is no primary one
+	for _, image := range dr.Images {
+		if image.Type == "primary" && image.URI != "" {
+			metadata.CoverURLs = append(metadata.CoverURLs, c.resolve(image.URI))
+		}
+	}
+	if len(metadata.CoverURLs) == 0 && len(dr.Images) > 0 && dr.Images[0].URI != "" {
+		metadata.CoverURLs = append(metadata.CoverURLs, c.resolve(dr.Images[0].URI))
+	}
+	return metadata
+}
+
+// normalizeDiscogsDate drops the unknown parts of Discogs dates, which come as
+// "1993-07-05", "1993-00-00" or "1993".
+func normalizeDiscogsDate(date string) string {
+	date = strings.TrimSpace(date)
+	for strings.HasSuffix(date, "-00") {
+		date = strings.TrimSuffix(date, "-00")
+	}
+	return date
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// discogsPerPage is the page size asked for, the largest Discogs allows.
+const discogsPerPage = 100
+
+// Default collection custom fields, used when the fields endpoint does not
+// name them.
+const (
+	discogsFieldMediaCondition  = 1
+	discogsFieldSleeveCondition = 2
+	discogsFieldNotes           = 3
+)
+
+// SyncSummary counts what a Discogs sync did to the collection.
+type SyncSummary struct {
+	Collection int `json:"collection"` // Items in the Discogs collection
+	Wantlist   int `json:"wantlist"`   // Items in the Discogs wantlist
+	Inserted   int `json:"inserted"`
+	Updated    int `json:"updated"`
+	Unchanged  int `json:"unchanged"`
+	Removed    int `json:"removed"` // Local releases no longer on Discogs, reported but kept
+}
+
+// String is the summary shown as the message of a sync job.
+func (s SyncSummary) String() string {
+	return fmt.Sprintf("Collection: %d, wantlist: %d. New records: %d. Updated records: %d. Unchanged records: %d. Removed on Discogs: %d.",
+		s.Collection, s.Wantlist, s.Inserted, s.Updated, s.Unchanged, s.Removed)
+}
+
+type discogsPagination struct {
+	Page  int `json:"page"`
+	Pages int `json:"pages"`
+	Items int `json:"items"`
+}
+
+// discogsBasicInformation is the release data embedded in collection and
+// wantlist items.
+type discogsBasicInformation struct {
+	ID      int    `json:"id"`
+	Title   string `json:"title"`
+	Year    int    `json:"year"`
+	Artists []struct {
+		Name string `json:"name"`
+		Join string `json:"join"`
+	} `json:"artists"`
+	Labels []struct {
+		Name  string `json:"name"`
+		CatNo string `json:"catno"`
+	} `json:"labels"`
+	Formats []struct {
+		Name         string   `json:"name"`
+		Qty          string   `json:"qty"`
+		Descriptions []string `json:"descriptions"`
+	} `json:"formats"`
+}
+
+type discogsCollectionItem struct {
+	ID               int                     `json:"id"`
+	FolderID         int                     `json:"folder_id"`
+	Rating           int                     `json:"rating"`
+	DateAdded        string                  `json:"date_added"`
+	BasicInformation discogsBasicInformation `json:"basic_information"`
+	Notes            []struct {
+		FieldID int    `json:"field_id"`
+		Value   string `json:"value"`
+	} `json:"notes"`
+}
+
+type discogsWant struct {
+	ID               int                     `json:"id"`
+	Rating           int                     `json:"rating"`
+	DateAdded        string                  `json:"date_added"`
+	Notes            string                  `json:"notes"`
+	BasicInformation discogsBasicInformation `json:"basic_information"`
+}
+
+// discogsSyncer copies the collection and wantlist of a Discogs user.
+type discogsSyncer struct {
+	client   *discogsClient
+	username string
+}
+
+func newDiscogsSyncer() (*discogsSyncer, error) {
+	username := getEnvWithDefault("DISCOGS_USERNAME", "")
+	if username == "" {
+		return nil, errors.New("DISCOGS_USERNAME is not set")
+	}
+	client, err := newDiscogsClient()
+	if err != nil {
+		return nil, err
+	}
+	return &discogsSyncer{client: client, username: username}, nil
+}
+
+// syncDiscogs is the work of a sync job. It inserts releases new on Discogs,
+// merges the changed ones following the IMPORT_MERGE_RULES, like re-imports,
+// and reports the ones removed from Discogs, which are kept so nothing is
+// lost by mistake.
+func syncDiscogs(job *jobContext) (string, error) {
+	syncer, err := newDiscogsSyncer()
+	if err != nil {
+		return "", err
+	}
+	rules, err := getMergeRules()
+	if err != nil {
+		return "", err
+	}
+
+	// Discogs has every import field, empty ones have been cleared there
+	present := make(map[string]bool)
+	for _, field := range importFields {
+		present[field.Name] = true
+	}
+
+	items, err := syncer.fetch(job.ctx, job.Logf)
+	if err != nil {
+		return "", err
+	}
+
+	// Sold and archived releases may still be in the Discogs collection
+	existing, err := store.ListReleases(ReleaseQuery{Status: "all"})
+	if err != nil {
+		return "", fmt.Errorf("error fetching releases: %v", err)
+	}
+	byReleaseID := make(map[int]Release)
+	for _, release := range existing {
+		if _, ok := byReleaseID[release.ReleaseID]; !ok {
+			byReleaseID[release.ReleaseID] = release
+		}
+	}
+
+	var summary SyncSummary
+	seen := make(map[int]bool)
+	job.SetTotal(len(items))
+	origin := jobOrigin(job, sourceSync)
+	for _, item := range items {
+		if err := job.Err(); err != nil {
+			return summary.String(), err
+		}
+		if item.Wanted {
+			summary.Wantlist++
+		} else {
+			summary.Collection++
+		}
+
+		name := item.Artist + " - " + item.Title
+		job.Start(name)
+		if seen[item.ReleaseID] {
+			// Several copies of a release, or a wanted release already owned
+			summary.Unchanged++
+			job.Done(name, nil)
+			continue
+		}
+		seen[item.ReleaseID] = true
+
+		current, ok := byReleaseID[item.ReleaseID]
+		switch {
+		case !ok:
+			err = createSyncedRelease(origin, item)
+			if err == nil {
+				summary.Inserted++
+				job.Logf("New: %s", name)
+			}
+		case !current.Wanted && item.Wanted:
+			// Owned here but only wanted on Discogs, reported as removed below
+			seen[item.ReleaseID] = false
+		default:
+			merged, changed := mergeImported(current, item, present, rules)
+			if len(changed) == 0 {
+				summary.Unchanged++
+				break
+			}
+			err = auditRelease(origin, current.ID, func() error {
+				return store.UpdateImportedRelease(merged)
+			})
+			if err == nil {
+				summary.Updated++
+				job.Logf("Updated %s: %s", name, formatChanges(fieldChanges(current, merged, changed)))
+			}
+		}
+		job.Done(name, err)
+	}
+
+	for _, release := range existing {
+		// Archived and sold releases are expected to have left Discogs too
+		if release.ReleaseID > 0 && release.Status == "" && !seen[release.ReleaseID] {
+			summary.Removed++
+			list := "collection"
+			if release.Wanted {
+				list = "wantlist"
+			}
+			job.Logf("Removed from the Discogs %s: %s - %s (release %d)", list, release.Artist, release.Title, release.ReleaseID)
+		}
+	}
+
+	log.Printf("Discogs sync: %s", summary)
+	return summary.String(), nil
+}
+
+// createSyncedRelease adds a release new on Discogs and logs it.
+func createSyncedRelease(origin changeOrigin, r Release) error {
+	auditWrites.Lock()
+	defer auditWrites.Unlock()
+
+	id, err := store.CreateRelease(r)
+	if err != nil {
+		return err
+	}
+	created, err := store.GetRelease(id)
+	if err != nil {
+		return err
+	}
+	_, err = recordChange(origin, nil, created)
+	return err
+}
+
+// fetch pages through the collection, then the wantlist. Collection items
+// come first so releases both owned and wanted count as owned.
+func (s *discogsSyncer) fetch(ctx context.Context, logf func(format string, args ...interface{})) ([]Release, error) {
+	user := "/users/" + url.PathEscape(s.username)
+
+	folders, err := s.folderNames(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := s.fieldIDs(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []Release
+	for page, pages := 1, 1; page <= pages; page++ {
+		var result struct {
+			Pagination discogsPagination       `json:"pagination"`
+			Releases   []discogsCollectionItem `json:"releases"`
+		}
+		if err := s.client.get(ctx, user+"/collection/folders/0/releases", pageParams(page), &result); err != nil {
+			return nil, fmt.Errorf("error fetching collection page %d: %v", page, err)
+		}
+		pages = result.Pagination.Pages
+		logf("Fetched collection page %d of %d", page, pages)
+
+		for _, item := range result.Releases {
+			release := syncedFromBasicInformation(item.BasicInformation)
+			release.Rating = discogsRating(item.Rating)
+			release.DateAdded = discogsDateAdded(item.DateAdded)
+			release.CollectionFolder = folders[item.FolderID]
+			for _, note := range item.Notes {
+				switch note.FieldID {
+				case fields["Media Condition"]:
+					release.CollectionMediaCondition = note.Value
+				case fields["Sleeve Condition"]:
+					release.CollectionSleeveCondition = note.Value
+				case fields["Notes"]:
+					release.CollectionNotes = note.Value
+				}
+			}
+			items = append(items, release)
+		}
+	}
+
+	for page, pages := 1, 1; page <= pages; page++ {
+		var result struct {
+			Pagination discogsPagination `json:"pagination"`
+			Wants      []discogsWant     `json:"wants"`
+		}
+		if err := s.client.get(ctx, user+"/wants", pageParams(page), &result); err != nil {
+			return nil, fmt.Errorf("error fetching wantlist page %d: %v", page, err)
+		}
+		pages = result.Pagination.Pages
+		logf("Fetched wantlist page %d of %d", page, pages)
+
+		for _, want := range result.Wants {
+			release := syncedFromBasicInformation(want.BasicInformation)
+			release.Rating = discogsRating(want.Rating)
+			release.DateAdded = discogsDateAdded(want.DateAdded)
+			release.CollectionNotes = want.Notes
+			release.Wanted = true
+			items = append(items, release)
+		}
+	}
+	return items, nil
+}
+
+// folderNames maps collection folder IDs to their names, as in the CSV export.
+func (s *discogsSyncer) folderNames(ctx context.Context, user string) (map[int]string, error) {
+	var result struct {
+		Folders []struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		} `json:"folders"`
+	}
+	if err := s.client.get(ctx, user+"/collection/folders", nil, &result); err != nil {
+		return nil, fmt.Errorf("error fetching collection folders: %v", err)
+	}
+	names := make(map[int]string)
+	for _, folder := range result.Folders {
+		names[folder.ID] = folder.Name
+	}
+	return names, nil
+}
+
+// fieldIDs maps the names of the collection custom fields to their IDs.
+func (s *discogsSyncer) fieldIDs(ctx context.Context, user string) (map[string]int, error) {
+	ids := map[string]int{
+		"Media Condition":  discogsFieldMediaCondition,
+		"Sleeve Condition": discogsFieldSleeveCondition,
+		"Notes":            discogsFieldNotes,
+	}
+	var result struct {
+		Fields []struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+		} `json:"fields"`
+	}
+	if err := s.client.get(ctx, user+"/collection/fields", nil, &result); err != nil {
+		return nil, fmt.Errorf("error fetching collection fields: %v", err)
+	}
+	for _, field := range result.Fields {
+		if _, ok := ids[field.Name]; ok {
+			ids[field.Name] = field.ID
+		}
+	}
+	return ids, nil
+}
+
+func pageParams(page int) url.Values {
+	return url.Values{"page": {strconv.Itoa(page)}, "per_page": {strconv.Itoa(discogsPerPage)}}
+}
+
+// discogsArtistNumber matches the suffix Discogs adds to tell apart artists
+// with the same name, i.e. "Nirvana (2)".
+var discogsArtistNumber = regexp.MustCompile(`\s\(\d+\)$`)
+
+// syncedFromBasicInformation fills the release fields the CSV export derives
+// from the release itself.
+func syncedFromBasicInformation(info discogsBasicInformation) Release {
+	release := Release{
+		ReleaseID: info.ID,
+		Title:     info.Title,
+		Format:    discogsFormat(info),
+	}
+
+	var artist strings.Builder
+	for i, a := range info.Artists {
+		artist.WriteString(discogsArtistNumber.ReplaceAllString(a.Name, ""))
+		if i < len(info.Artists)-1 {
+			join := strings.TrimSpace(a.Join)
+			if join == "" || join == "," {
+				artist.WriteString(", ")
+			} else {
+				artist.WriteString(" " + join + " ")
+			}
+		}
+	}
+	release.Artist = artist.String()
+
+	if len(info.Labels) > 0 {
+		release.Label = discogsArtistNumber.ReplaceAllString(info.Labels[0].Name, "")
+		release.CatalogNumber = info.Labels[0].CatNo
+	}
+	if info.Year > 0 {
+		release.Released = strconv.Itoa(info.Year)
+	}
+	return release
+}
+
+// discogsFormat writes formats the way the CSV export does, i.e. "2xLP,
+// Album + CD, Album". Vinyl is named by its first description ("LP", "7\"").
+func discogsFormat(info discogsBasicInformation) string {
+	var formats []string
+	for _, f := range info.Formats {
+		name := f.Name
+		descriptions := f.Descriptions
+		if name == "Vinyl" && len(descriptions) > 0 {
+			name, descriptions = descriptions[0], descriptions[1:]
+		}
+		if qty, err := strconv.Atoi(f.Qty); err == nil && qty > 1 {
+			name = fmt.Sprintf("%dx%s", qty, name)
+		}
+		formats = append(formats, strings.Join(append([]string{name}, descriptions...), ", "))
+	}
+	return strings.Join(formats, " + ")
+}
+
+func discogsRating(rating int) string {
+	if rating == 0 {
+		return ""
+	}
+	return strconv.Itoa(rating)
+}
+
+// discogsDateAdded converts "2023-01-02T10:00:00-08:00" to the CSV export format.
+func discogsDateAdded(date string) string {
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return date
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// handleSync starts a Discogs sync job, the admin page follows its progress.
+func handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	job, err := jobs.start(jobKindSync, syncDiscogs)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == errJobAlreadyRunning {
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("Sync failed: %v", err), status)
+		return
+	}
+	renderJob(w, job)
+}
+
+// scheduleDiscogsSync starts a sync job every DISCOGS_SYNC_INTERVAL, i.e.
+// "24h". Scheduling is off when the interval is empty or zero.
+func scheduleDiscogsSync() {
+	setting := getEnvWithDefault("DISCOGS_SYNC_INTERVAL", "")
+	if setting == "" {
+		return
+	}
+	interval, err := time.ParseDuration(setting)
+	if err != nil || interval < 0 {
+		log.Printf("Invalid DISCOGS_SYNC_INTERVAL %q, scheduled syncs are disabled", setting)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	log.Printf("Syncing with Discogs every %s", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := jobs.start(jobKindSync, syncDiscogs); err != nil {
+				log.Printf("Scheduled Discogs sync not started: %v", err)
+			}
+		}
+	}()
+}
+
+// runSyncDiscogsCommand implements `music-collection sync-discogs`, running a
+// sync job in the foreground and printing its log.
+func runSyncDiscogsCommand(args []string) error {
+	initDB()
+
+	// Jobs marked running may be the server's, they are only recovered when it starts
+	job, err := jobs.start(jobKindSync, syncDiscogs)
+	if errors.Is(err, errJobAlreadyRunning) {
+		return fmt.Errorf("%w, try again once it is done", err)
+	}
+	if err != nil {
+		return err
+	}
+	job, err = jobs.wait(job.ID, func(line string) { fmt.Println(line) })
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(job.Message)
+	if job.Status != jobCompleted {
+		return fmt.Errorf("sync %s", job.Status)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSyncDiscogs(t *testing.T) {
+	server := httptest.NewServer(discogsFixtures(t))
+	defer server.Close()
+	t.Setenv("DISCOGS_BASE_URL", server.URL)
+	t.Setenv("DISCOGS_TOKEN", "test-token")
+	t.Setenv("DISCOGS_USERNAME", "demo")
+	t.Setenv("IMPORT_MERGE_RULES", "")
+
+	s := newMemoryStore(
+		// Changed on Discogs, with a condition edited here
+		Release{ID: 1, ReleaseID: 1001, Artist: "Björk", Title: "Début", CatalogNumber: "SRCD 101", Label: "One Little Indian",
+			Format: "CD, Album", Rating: "5", Released: "1993", CollectionFolder: "Uncategorized", DateAdded: "2023-01-02 10:00:00",
+			CollectionMediaCondition: "Mint (M)", CollectionSleeveCondition: "Very Good Plus (VG+)", CollectionNotes: "gift",
+			EditedFields: []string{"collection_media_condition"}, Tags: []string{"pop"}},
+		// As on Discogs
+		Release{ID: 2, ReleaseID: 1002, Artist: "Miles Davis", Title: "Kind Of Blue", CatalogNumber: "CL 1355", Label: "Columbia",
+			Format: "LP, Album, Mono, Repress", Rating: "4", Released: "1959", CollectionFolder: "Jazz", DateAdded: "2023-01-03 10:00:00",
+			CollectionMediaCondition: "Very Good (VG)", CollectionSleeveCondition: "Good (G)"},
+		// No longer on Discogs
+		Release{ID: 3, ReleaseID: 1004, Artist: "Various", Title: "Café del Mar", Format: "2xLP, Compilation"},
+	)
+	store, jobStore, changeStore = s, s, s
+
+	job, err := jobs.start(jobKindSync, syncDiscogs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := jobs.wait(job.ID, func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.Status != jobCompleted {
+		t.Fatalf("sync %s: %s", done.Status, done.Message)
+	}
+
+	// Two collection pages, the wanted Kind Of Blue is already owned
+	want := SyncSummary{Collection: 4, Wantlist: 2, Inserted: 3, Updated: 1, Unchanged: 2, Removed: 1}
+	if done.Message != want.String() {
+		t.Errorf("summary = %q, want %q", done.Message, want.String())
+	}
+
+	debut, err := store.GetRelease(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if debut.Rating != "4" || debut.CollectionFolder != "Electronic" || debut.CollectionNotes != "gift, signed booklet" {
+		t.Errorf("Début not merged: rating %q, folder %q, notes %q", debut.Rating, debut.CollectionFolder, debut.CollectionNotes)
+	}
+	if debut.CollectionMediaCondition != "Mint (M)" {
+		t.Errorf("edited media condition = %q, want it kept as Mint (M)", debut.CollectionMediaCondition)
+	}
+	if len(debut.Tags) != 1 || debut.Tags[0] != "pop" {
+		t.Errorf("tags = %v, want them left alone", debut.Tags)
+	}
+
+	if _, err := store.GetRelease(3); err != nil {
+		t.Errorf("release removed on Discogs was deleted: %v", err)
+	}
+
+	releases, err := store.ListReleases(ReleaseQuery{Status: "all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byReleaseID := make(map[int]Release)
+	for _, r := range releases {
+		byReleaseID[r.ReleaseID] = r
+	}
+	if dummy := byReleaseID[2001]; dummy.Label != "Go! Beat" || dummy.Physical != "Vinyl" || dummy.Wanted {
+		t.Errorf("Dummy inserted as %+v", dummy)
+	}
+	if swa := byReleaseID[3001]; !swa.Wanted || swa.CollectionNotes != "Original Apollo pressing" {
+		t.Errorf("wanted Selected Ambient Works inserted as %+v", swa)
+	}
+	if kob := byReleaseID[1002]; kob.Wanted || kob.CatalogNumber != "CL 1355" {
+		t.Errorf("owned Kind Of Blue changed by the wantlist to %+v", kob)
+	}
+
+	// Every write is in the audit log as one operation
+	changes, err := changeStore.ListChanges(ChangeQuery{Batch: fmt.Sprintf("job-%d", job.ID)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := make(map[string]int)
+	for _, c := range changes {
+		actions[c.Action]++
+	}
+	if actions[changeCreate] != 3 || actions[changeUpdate] != 1 || len(changes) != 4 {
+		t.Errorf("logged changes = %v, want 3 creates and 1 update", actions)
+	}
+
+	// A second sync finds nothing new
+	job, err = jobs.start(jobKindSync, syncDiscogs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done, err = jobs.wait(job.ID, func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	want = SyncSummary{Collection: 4, Wantlist: 2, Unchanged: 6, Removed: 1}
+	if done.Message != want.String() {
+		t.Errorf("second summary = %q, want %q", done.Message, want.String())
+	}
+}
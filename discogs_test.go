@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// discogsFixtures answers requests with the recorded responses in testdata/discogs.
+func discogsFixtures(t *testing.T) http.Handler {
+	t.Helper()
+	dir := "testdata/discogs"
+	fixtures, err := loadFixtures(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fixtureHandler(dir, fixtures)
+}
+
+// newTestDiscogsClient returns a client calling a test server with handler.
+func newTestDiscogsClient(t *testing.T, handler http.Handler) *discogsClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	baseURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &discogsClient{
+		baseURL:   baseURL,
+		token:     "test-token",
+		userAgent: "music-collection-test",
+		client:    server.Client(),
+	}
+}
+
+func TestDiscogsLookup(t *testing.T) {
+	client := newTestDiscogsClient(t, discogsFixtures(t))
+	p := &discogsProvider{client: client}
+
+	metadata, err := p.Lookup(context.Background(), Release{ReleaseID: 1001, Artist: "Björk", Title: "Début"})
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if metadata.Year != 1993 || metadata.Released != "1993-07-05" || metadata.Label != "One Little Indian" {
+		t.Errorf("Lookup = year %d, released %q, label %q, want 1993, 1993-07-05, One Little Indian", metadata.Year, metadata.Released, metadata.Label)
+	}
+	if want := []string{"electronic", "pop", "downtempo", "trip hop", "house"}; !reflect.DeepEqual(metadata.Tags, want) {
+		t.Errorf("Tags = %v, want %v", metadata.Tags, want)
+	}
+	if len(metadata.Tracks) != 11 || metadata.Tracks[0].Title != "Human Behaviour" || len(metadata.Tracks[0].Credits) != 2 {
+		t.Errorf("Tracks = %+v, want 11 tracks starting with Human Behaviour and its two producers", metadata.Tracks)
+	}
+	// The primary image comes before the back cover listed first
+	if want := []string{client.baseURL.String() + "/images/R-1001-primary.jpg"}; !reflect.DeepEqual(metadata.CoverURLs, want) {
+		t.Errorf("CoverURLs = %v, want %v", metadata.CoverURLs, want)
+	}
+}
+
+func TestDiscogsLookupUnknownRelease(t *testing.T) {
+	var requests int32
+	fixtures := discogsFixtures(t)
+	client := newTestDiscogsClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fixtures.ServeHTTP(w, r)
+	}))
+	p := &discogsProvider{client: client}
+
+	// Deleted on Discogs
+	if _, err := p.Lookup(context.Background(), Release{ReleaseID: 1002}); !errors.Is(err, errNoMetadata) {
+		t.Errorf("Lookup of a deleted release = %v, want %v", err, errNoMetadata)
+	}
+
+	// Added by hand, without a release_id, so Discogs is not asked at all
+	before := atomic.LoadInt32(&requests)
+	for _, id := range []int{0, -1} {
+		if _, err := p.Lookup(context.Background(), Release{ReleaseID: id, Artist: "Björk", Title: "Début"}); !errors.Is(err, errNoMetadata) {
+			t.Errorf("Lookup of release_id %d = %v, want %v", id, err, errNoMetadata)
+		}
+	}
+	if n := atomic.LoadInt32(&requests) - before; n != 0 {
+		t.Errorf("Lookups without a release_id made %d requests, want none", n)
+	}
+}
+
+func TestDiscogsRateLimitRetry(t *testing.T) {
+	var requests int32
+	fixtures := discogsFixtures(t)
+	client := newTestDiscogsClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		fixtures.ServeHTTP(w, r)
+	}))
+
+	dr, err := client.release(context.Background(), 1001)
+	if err != nil {
+		t.Fatalf("release after a 429: %v", err)
+	}
+	if dr.Title != "Début" {
+		t.Errorf("Title = %q, want Début", dr.Title)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("made %d requests, want 2", n)
+	}
+}
+
+func TestDiscogsRateLimitGiveUp(t *testing.T) {
+	var requests int32
+	client := newTestDiscogsClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "0")
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	}))
+
+	if _, err := client.release(context.Background(), 1001); err == nil {
+		t.Error("release kept answering 429 but got no error")
+	}
+	if n := atomic.LoadInt32(&requests); n != discogsMaxAttempts {
+		t.Errorf("made %d requests, want %d", n, discogsMaxAttempts)
+	}
+}
+
+func TestDiscogsRateLimitPause(t *testing.T) {
+	client := newTestDiscogsClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Discogs-Ratelimit-Remaining", "0")
+		w.Write([]byte(`{"id": 1001}`))
+	}))
+
+	if _, err := client.release(context.Background(), 1001); err != nil {
+		t.Fatal(err)
+	}
+	if wait := time.Until(client.resetAt); wait <= 0 || wait > discogsRateLimitWindow {
+		t.Errorf("next request allowed in %s, want within %s", wait, discogsRateLimitWindow)
+	}
+
+	// The next request waits for the window, or until it is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := client.release(ctx, 1001); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("release during the pause = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDiscogsSearchRelease(t *testing.T) {
+	client := newTestDiscogsClient(t, discogsFixtures(t))
+
+	tests := []struct {
+		name   string
+		params url.Values
+		want   int
+		err    error
+	}{
+		{"barcode", url.Values{"barcode": {"5016958020424"}}, 1001, nil},
+		{"artist and title", url.Values{"artist": {"Björk"}, "release_title": {"Début"}}, 1001, nil},
+		{"not found", url.Values{"barcode": {"000"}}, 0, errNoMetadata},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := client.searchRelease(context.Background(), tt.params)
+			if got != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("searchRelease = %d, %v, want %d, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
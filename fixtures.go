@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// fixture is one recorded response served by the fixture-server command.
+type fixture struct {
+	Method      string            `json:"method"` // Defaults to GET
+	Path        string            `json:"path"`
+	Query       map[string]string `json:"query"` // Parameters that must match, others are ignored
+	Status      int               `json:"status"`
+	ContentType string            `json:"content_type"`
+	Headers     map[string]string `json:"headers"`
+	File        string            `json:"file"` // Body, relative to the fixtures directory
+}
+
+func (f fixture) matches(r *http.Request) bool {
+	method := f.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	if r.Method != method || r.URL.Path != f.Path {
+		return false
+	}
+	for key, value := range f.Query {
+		if r.URL.Query().Get(key) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// loadFixtures reads the fixtures.json manifest of a fixtures directory.
+func loadFixtures(dir string) ([]fixture, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "fixtures.json"))
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []fixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("error parsing %s/fixtures.json: %v", dir, err)
+	}
+
+	// The most specific fixture wins when several match a request
+	sort.SliceStable(fixtures, func(i, j int) bool {
+		return len(fixtures[i].Query) > len(fixtures[j].Query)
+	})
+	return fixtures, nil
+}
+
+// fixtureHandler answers requests with the first matching fixture and 404
+// otherwise, logging unmatched requests so missing fixtures are easy to add.
+func fixtureHandler(dir string, fixtures []fixture) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, f := range fixtures {
+			if !f.matches(r) {
+				continue
+			}
+
+			body, err := os.ReadFile(filepath.Join(dir, f.File))
+			if err != nil {
+				log.Printf("Error reading fixture %s: %v", f.File, err)
+				http.Error(w, "Fixture not found", http.StatusInternalServerError)
+				return
+			}
+			for key, value := range f.Headers {
+				w.Header().Set(key, value)
+			}
+			if f.ContentType != "" {
+				w.Header().Set("Content-Type", f.ContentType)
+			}
+			status := f.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			w.WriteHeader(status)
+			w.Write(body)
+			log.Printf("%s %s -> %s (%d)", r.Method, r.URL.RequestURI(), f.File, status)
+			return
+		}
+
+		log.Printf("%s %s -> no fixture", r.Method, r.URL.RequestURI())
+		http.NotFound(w, r)
+	}
+}
+
+// runFixtureServerCommand implements `music-collection fixture-server <dir> [addr]`,
+// a stand-in for the external services the metadata providers call. Point
+// the provider base URLs at it to try them offline, i.e.
+//
+//	music-collection fixture-server testdata/musicbrainz :8090
+//	MUSICBRAINZ_BASE_URL=http://localhost:8090 COVERARTARCHIVE_BASE_URL=http://localhost:8090 ...
+func runFixtureServerCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: fixture-server <fixtures dir> [listen address]")
+	}
+	dir := args[0]
+	addr := ":8090"
+	if len(args) > 1 {
+		addr = args[1]
+	}
+
+	fixtures, err := loadFixtures(dir)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Serving %d fixtures from %s on %s", len(fixtures), dir, addr)
+	return http.ListenAndServe(addr, fixtureHandler(dir, fixtures))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// formatMedium is one medium of a Discogs format string. "2xLP, Album, RE +
+// CD, Comp" has two: 2 LP with the descriptions Album and RE, and a CD.
+type formatMedium struct {
+	Quantity     int
+	Name         string
+	Descriptions []string
+}
+
+// formatQuantity matches the "2x" prefix of media sold in multiples.
+var formatQuantity = regexp.MustCompile(`^(\d+)\s*[x×]\s*(.+)$`)
+
+// formatNames are the Discogs format names that start a medium of their own
+// even without a "+", i.e. the CD of "2xLP, CD". LP and sizes are left out,
+// they are descriptions of "Vinyl" and "Shellac" in "Vinyl, LP" or
+// `Shellac, 10"`.
+var formatNames = []string{
+	"Vinyl", "Shellac", "Acetate", "Flexi-disc", "Lathe Cut",
+	"CD", "CDr", "CDV", "SACD", "Minidisc", "DVD", "DVDr", "HD DVD", "Blu-ray", "Blu-ray-R",
+	"Cassette", "Cass", "Microcassette", "DAT", "DCC", "8-Track Cartridge", "8-Trk", "Reel-To-Reel",
+	"VHS", "Laserdisc", "File", "Box Set", "Box", "All Media",
+}
+
+// parseDiscogsFormat splits a format string as written in the Discogs CSV
+// export into its media. Media are separated by "+", their descriptions by
+// commas, and the first token is the name of the medium with its quantity.
+// Another format name, or a token with a quantity, starts a new medium.
+func parseDiscogsFormat(format string) []formatMedium {
+	var media []formatMedium
+	for _, part := range strings.Split(format, "+") {
+		first := len(media)
+		for _, token := range strings.Split(part, ",") {
+			if token = strings.TrimSpace(token); token == "" {
+				continue
+			}
+
+			name, quantity := token, 1
+			m := formatQuantity.FindStringSubmatch(token)
+			if m != nil {
+				quantity, _ = strconv.Atoi(m[1])
+				name = strings.TrimSpace(m[2])
+			}
+			if len(media) == first || m != nil || isFormatName(name) {
+				media = append(media, formatMedium{Quantity: quantity, Name: name})
+				continue
+			}
+			last := &media[len(media)-1]
+			last.Descriptions = append(last.Descriptions, token)
+		}
+	}
+	return media
+}
+
+func isFormatName(name string) bool {
+	for _, formatName := range formatNames {
+		if strings.EqualFold(name, formatName) {
+			return true
+		}
+	}
+	return false
+}
+
+// has reports whether the name or a description of the medium is one of tokens.
+func (m formatMedium) has(tokens []string) bool {
+	for _, token := range tokens {
+		if strings.EqualFold(m.Name, token) {
+			return true
+		}
+		for _, description := range m.Descriptions {
+			if strings.EqualFold(description, token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// formatRule classifies media carrying one of its tokens as its physical
+// format. Tokens are whole names or descriptions, so "EP" no longer matches
+// "Repress" or "Stereo".
+type formatRule struct {
+	Physical string   `json:"physical"`
+	Tokens   []string `json:"tokens"`
+	// AnyMedium rules look at every medium of the release, i.e. box sets
+	// listing the box after the discs. Other rules classify the first medium
+	// they match, so "2xLP + 7\"" is vinyl with a bonus single.
+	AnyMedium bool `json:"any_medium,omitempty"`
+}
+
+// defaultFormatRules are used unless FORMAT_RULES_FILE is set. Order matters:
+// the first matching rule wins.
+var defaultFormatRules = []formatRule{
+	{Physical: "Box Set", Tokens: []string{"Box Set", "Box"}, AnyMedium: true},
+	{Physical: "EP - Single", Tokens: []string{`7"`, "EP", "Single", "Maxi", "Maxi-Single", "Mini-Album"}},
+	{Physical: "SACD", Tokens: []string{"SACD", "Hybrid SACD"}},
+	{Physical: "Vinyl", Tokens: []string{"LP", "Vinyl", `12"`, `10"`, `16"`, "Shellac", "Flexi-disc", "Lathe Cut"}},
+	{Physical: "CD", Tokens: []string{"CD", "CDr", "CD-ROM", "HDCD", "Minimax CD", "CDV"}},
+	{Physical: "DVD", Tokens: []string{"DVD", "DVDr", "DVD-V", "DVD-A"}},
+	{Physical: "Blu-ray", Tokens: []string{"Blu-ray", "Blu-ray-R", "Blu-ray Audio"}},
+	{Physical: "MiniDisc", Tokens: []string{"MiniDisc", "MD"}},
+	{Physical: "8-Track", Tokens: []string{"8-Track Cartridge", "8-Trk", "Cartridge"}},
+	{Physical: "Tape", Tokens: []string{"Cass", "Cassette", "Microcassette", "Reel-To-Reel", "DAT", "DCC"}},
+	{Physical: "Digital", Tokens: []string{"File", "FLAC", "MP3", "WAV", "AAC", "ALAC"}},
+}
+
+// loadFormatRules reads the rule table from FORMAT_RULES_FILE, a JSON array
+// of rules replacing the default ones.
+func loadFormatRules() ([]formatRule, error) {
+	path := getEnvWithDefault("FORMAT_RULES_FILE", "")
+	if path == "" {
+		return defaultFormatRules, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading format rules: %v", err)
+	}
+	var rules []formatRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%s has no format rules", path)
+	}
+	for i, rule := range rules {
+		if rule.Physical == "" || len(rule.Tokens) == 0 {
+			return nil, fmt.Errorf("%s: rule %d needs a physical format and tokens", path, i+1)
+		}
+	}
+	return rules, nil
+}
+
+// formatRules caches the rule table, reloaded by the reclassify preview so
+// edits to the rules file are picked up without a restart.
+var formatRules struct {
+	sync.Mutex
+	rules []formatRule
+}
+
+func currentFormatRules() []formatRule {
+	formatRules.Lock()
+	defer formatRules.Unlock()
+	if formatRules.rules == nil {
+		rules, err := loadFormatRules()
+		if err != nil {
+			log.Printf("Error loading format rules, using the default ones: %v", err)
+			rules = defaultFormatRules
+		}
+		formatRules.rules = rules
+	}
+	return formatRules.rules
+}
+
+// reloadFormatRules reads the rule table again, keeping the current one on errors.
+func reloadFormatRules() ([]formatRule, error) {
+	rules, err := loadFormatRules()
+	if err != nil {
+		return nil, err
+	}
+	formatRules.Lock()
+	formatRules.rules = rules
+	formatRules.Unlock()
+	return rules, nil
+}
+
+// determinePhysicalFormat classifies a Discogs format string with the
+// current rule table, "" when no rule matches.
+func determinePhysicalFormat(format string) string {
+	return classifyFormat(format, currentFormatRules())
+}
+
+func classifyFormat(format string, rules []formatRule) string {
+	media := parseDiscogsFormat(format)
+	for _, rule := range rules {
+		if !rule.AnyMedium {
+			continue
+		}
+		for _, medium := range media {
+			if medium.has(rule.Tokens) {
+				return rule.Physical
+			}
+		}
+	}
+	for _, medium := range media {
+		for _, rule := range rules {
+			if !rule.AnyMedium && medium.has(rule.Tokens) {
+				return rule.Physical
+			}
+		}
+	}
+	return ""
+}
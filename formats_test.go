@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestFormatCorpus classifies every format string of testdata/formats/corpus.tsv,
+// one tab separated format and expected physical format per line, with the
+// default rules.
+func TestFormatCorpus(t *testing.T) {
+	t.Setenv("FORMAT_RULES_FILE", "")
+	if _, err := reloadFormatRules(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile("testdata/formats/corpus.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checked := 0
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		format, expected, ok := strings.Cut(line, "\t")
+		if !ok {
+			t.Fatalf("corpus.tsv:%d: expected a format and a physical format separated by a tab", i+1)
+		}
+		checked++
+		t.Run(format, func(t *testing.T) {
+			if got := determinePhysicalFormat(format); got != expected {
+				t.Errorf("determinePhysicalFormat(%q) = %q, want %q", format, got, expected)
+			}
+		})
+	}
+	if checked == 0 {
+		t.Fatal("no format strings to check")
+	}
+}
@@ -1,19 +1,34 @@
 package main
 
 import (
-	"io"
 	"log"
 	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"strconv"
 	"strings"
-	"encoding/csv"
 )
 
+// parseSort reads the sort parameter (i.e. "artist,-year,title"), falling back
+// to the older order_by/order_direction pair so existing links keep working.
+func parseSort(r *http.Request) ([]SortKey, error) {
+	spec := r.URL.Query().Get("sort")
+	if spec == "" {
+		if orderBy := r.URL.Query().Get("order_by"); orderBy != "" {
+			spec = orderBy
+			if strings.EqualFold(r.URL.Query().Get("order_direction"), "desc") {
+				spec = "-" + orderBy
+			}
+		}
+	}
+	return parseSortSpec(spec)
+}
+
+// maxSortKeys limits how many previous sort keys the sorting buttons keep as tiebreakers.
+const maxSortKeys = 3
+
 func getSortingData(r *http.Request) map[string]interface{} {
-	orderBy := r.URL.Query().Get("order_by")
-	orderDirection := r.URL.Query().Get("order_direction")
+	sortKeys, _ := parseSort(r)
 	artist := r.URL.Query().Get("artist")
 	year := r.URL.Query().Get("year")
 
@@ -34,19 +49,141 @@ func getSortingData(r *http.Request) map[string]interface{} {
 		sortingFields = append(sortingFields, map[string]string{"Field": "year", "Label": "Year", "IconUp": "bi-sort-numeric-up", "IconDown": "bi-sort-numeric-down"})
 	}
 
+	sortingFields = append(sortingFields, map[string]string{"Field": "date_added", "Label": "Added", "IconUp": "bi-sort-numeric-up", "IconDown": "bi-sort-numeric-down"})
+
+	// Clicking a field makes it the primary key, toggling its direction when it
+	// already was, and keeps the previous keys as tiebreakers.
+	for _, field := range sortingFields {
+		key := SortKey{Field: field["Field"]}
+		field["Active"] = ""
+		if len(sortKeys) > 0 && sortKeys[0].Field == key.Field {
+			key.Desc = !sortKeys[0].Desc
+			field["Active"] = "true"
+		}
+
+		next := []SortKey{key}
+		for _, previous := range sortKeys {
+			if previous.Field != key.Field && len(next) < maxSortKeys {
+				next = append(next, previous)
+			}
+		}
+		field["Sort"] = formatSortSpec(next)
+
+		field["Icon"] = field["IconUp"]
+		if key.Desc {
+			field["Icon"] = field["IconDown"]
+		}
+	}
+
 	return map[string]interface{}{
-		"OrderBy":        orderBy,
-		"OrderDirection": orderDirection,
-		"SortingFields":  sortingFields,
+		"Sort":          formatSortSpec(sortKeys),
+		"SortingFields": sortingFields,
 		"Filters": map[string]string{
-			"year":     year,
-			"artist":   artist,
-			"tag":      r.URL.Query().Get("tag"),
-			"physical": r.URL.Query().Get("physical"),
+			"year":      year,
+			"artist":    artist,
+			"tag":       r.URL.Query().Get("tag"),
+			"physical":  r.URL.Query().Get("physical"),
+			"label":     r.URL.Query().Get("label"),
+			"wanted":    r.URL.Query().Get("wanted"),
+			"query":     r.URL.Query().Get("query"),
+			"page_size": r.URL.Query().Get("page_size"),
 		},
 	}
 }
 
+const (
+	defaultPageSize = 48
+	maxPageSize     = 500
+)
+
+// PageLink is a numbered link in the pagination controls.
+type PageLink struct {
+	Number  int
+	URL     string
+	Current bool
+}
+
+// Pagination holds the paging state of a listing and the links to render.
+type Pagination struct {
+	Page       int
+	PageSize   int
+	Total      int
+	TotalPages int
+	PrevURL    string
+	NextURL    string
+	Pages      []PageLink
+}
+
+// parsePage reads the page and page_size query parameters, falling back to
+// the first page and the default page size on invalid values.
+func parsePage(r *http.Request) (page int, pageSize int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err = strconv.Atoi(r.URL.Query().Get("page_size"))
+	if err != nil || pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	return page, pageSize
+}
+
+// paginate applies the requested page to query and returns a function that
+// builds the Pagination once the total count is known.
+func paginate(r *http.Request, query *ReleaseQuery) func(total int) Pagination {
+	page, pageSize := parsePage(r)
+	query.Limit = pageSize
+	query.Offset = (page - 1) * pageSize
+
+	return func(total int) Pagination {
+		return newPagination(r, page, pageSize, total)
+	}
+}
+
+func newPagination(r *http.Request, page, pageSize, total int) Pagination {
+	totalPages := (total + pageSize - 1) / pageSize
+	p := Pagination{Page: page, PageSize: pageSize, Total: total, TotalPages: totalPages}
+
+	pageURL := func(n int) string {
+		params := r.URL.Query()
+		params.Set("page", strconv.Itoa(n))
+		return r.URL.Path + "?" + params.Encode()
+	}
+
+	if page > 1 {
+		p.PrevURL = pageURL(page - 1)
+	}
+	if page < totalPages {
+		p.NextURL = pageURL(page + 1)
+	}
+
+	// Show the first and last pages and a window around the current one
+	for n := 1; n <= totalPages; n++ {
+		if n == 1 || n == totalPages || (n >= page-2 && n <= page+2) {
+			p.Pages = append(p.Pages, PageLink{Number: n, URL: pageURL(n), Current: n == page})
+		}
+	}
+	return p
+}
+
+// listReleasesPage fetches one page of releases for query and the total count.
+func listReleasesPage(r *http.Request, query ReleaseQuery) ([]Release, Pagination, error) {
+	pagination := paginate(r, &query)
+
+	total, err := store.CountReleases(query)
+	if err != nil {
+		return nil, Pagination{}, err
+	}
+	releases, err := store.ListReleases(query)
+	if err != nil {
+		return nil, Pagination{}, err
+	}
+	return releases, pagination(total), nil
+}
+
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	sortingData := getSortingData(r)
 
@@ -58,16 +195,19 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Handling index request from %s", r.RemoteAddr)
 
-	orderBy := r.URL.Query().Get("order_by")
-	orderDirection := r.URL.Query().Get("order_direction")
+	sortKeys, err := parseSort(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	releases, err := fetchReleases(orderBy, orderDirection)
+	releases, pagination, err := listReleasesPage(r, ReleaseQuery{Sort: sortKeys})
 	if err != nil {
 		log.Printf("Error fetching releases: %v", err)
 		http.Error(w, "Database query error", http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Fetched %d releases", len(releases))
+	log.Printf("Fetched %d of %d releases", len(releases), pagination.Total)
 
 	
 	data := struct {
@@ -77,16 +217,17 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 		Artist        string
 		Title         string
 		Template      string
-		OrderBy       string
-		OrderDirection string
+		Sort           string
 		SortingFields  []map[string]string
 		Filters        map[string]string
+		FilterChips    []FilterChip
+		Pagination     Pagination
 	}{
 		Releases:      releases,
-		Title:         constructTitle("Music Collection", len(releases)),
+		Title:         constructTitle("Music Collection", pagination.Total),
+		Pagination:    pagination,
 		Template:      "index",
-		OrderBy:       sortingData["OrderBy"].(string),
-		OrderDirection: sortingData["OrderDirection"].(string),
+		Sort:           sortingData["Sort"].(string),
 		SortingFields: sortingData["SortingFields"].([]map[string]string),
 		Filters:       sortingData["Filters"].(map[string]string),
 	}
@@ -110,7 +251,16 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	releases, err := searchReleases(query)
+	sortKeys, err := parseSort(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(sortKeys) == 0 {
+		sortKeys = []SortKey{{Field: "title"}}
+	}
+
+	releases, pagination, err := listReleasesPage(r, ReleaseQuery{Search: query, Sort: sortKeys})
 	if err != nil {
 		log.Printf("Error searching releases: %v", err)
 		http.Error(w, "Database query error", http.StatusInternalServerError)
@@ -123,8 +273,7 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		Template      string
 		Wanted        bool
 		NeedScrape    bool
-		OrderBy       string
-		OrderDirection string
+		Sort           string
 		Year          string
 		Tag           string
 		Artist        string
@@ -132,14 +281,16 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 		IsSearch      bool
 		SortingFields  []map[string]string
 		Filters        map[string]string
+		FilterChips    []FilterChip
+		Pagination     Pagination
 	}{
 		Releases:      releases,
-		Title:         fmt.Sprintf("Search results for '%s'", query),
+		Title:         constructTitle(fmt.Sprintf("Search results for '%s'", query), pagination.Total),
+		Pagination:    pagination,
 		Template:      "releases",
 		Wanted:        false,
 		NeedScrape:    false,
-		OrderBy:       "",
-		OrderDirection: "",
+		Sort:          sortingData["Sort"].(string),
 		Year:          "",
 		Tag:           "",
 		Artist:        "",
@@ -158,45 +309,36 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 
 func releaseHandler(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path[len("/release/"):], "/")
-if len(parts) < 2 {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+	if len(parts) < 2 {
+		parts = append(parts, "") // /release/{id} shows the release
 	}
 
 	id := parts[0]
 	action := parts[1]
 
+	releaseID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "Invalid release ID", http.StatusBadRequest)
+		return
+	}
+
 	switch action {
 
+	case "":
+		releaseDetailHandler(w, r, releaseID)
 	case "edit":
-		release, err := fetchReleaseByID(id, "", "")
+		release, err := store.GetRelease(releaseID)
 		if err != nil {
 			http.Error(w, "Release not found", http.StatusNotFound)
 			return
 		}
-		data := struct {
-			*Release
-			Title    string
-			Template string
-		}{
-			Release:  release,
-			Title:    release.Title,
-			Template: "edit",
-		}
-		if err := Templates.ExecuteTemplate(w, "base.html", data); err != nil {
-			log.Printf("Error rendering edit template: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		}
+		renderEditPage(w, release, nil, http.StatusOK)
 	case "update":
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		if err := updateReleaseHandler(id, r); err != nil {
-			http.Error(w, "Error updating release", http.StatusInternalServerError)
-			return
-		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		updateReleaseHandler(w, r, releaseID)
 	case "add-tag":
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -208,7 +350,8 @@ if len(parts) < 2 {
 			return
 		}
 		log.Printf("Adding tag '%s' to release ID: %s", tag, id)
-		if err := addTagToRelease(id, tag); err != nil {
+		err := auditRelease(requestOrigin(r, sourceEdit), releaseID, func() error { return store.AddTag(releaseID, tag) })
+		if err != nil {
 			http.Error(w, "Error adding tag", http.StatusInternalServerError)
 			return
 		}
@@ -219,11 +362,26 @@ if len(parts) < 2 {
 			return
 		}
 		tag := r.FormValue("tag")
-		if err := removeTagFromRelease(id, tag); err != nil {
+		err := auditRelease(requestOrigin(r, sourceEdit), releaseID, func() error { return store.RemoveTag(releaseID, tag) })
+		if err != nil {
 			http.Error(w, "Error removing tag", http.StatusInternalServerError)
 			return
 		}
 		http.Redirect(w, r, "/release/"+id+"/edit", http.StatusSeeOther)
+	case "tracks":
+		releaseTracksHandler(w, r, releaseID)
+	case "fetch-tracks":
+		fetchTracksHandler(w, r, releaseID)
+	case "history":
+		releaseHistoryHandler(w, r, releaseID)
+	case "remove":
+		removeReleaseHandler(w, r, releaseID)
+	case "archive":
+		archiveReleaseHandler(w, r, releaseID)
+	case "restore":
+		restoreReleaseHandler(w, r, releaseID)
+	case "delete":
+		deleteReleaseHandler(w, r, releaseID)
 	default:
 		http.Error(w, "Invalid action", http.StatusBadRequest)
 	}
@@ -232,17 +390,20 @@ if len(parts) < 2 {
 func wantedReleasesHandler(w http.ResponseWriter, r *http.Request) {
 	sortingData := getSortingData(r)
 
-	orderBy := r.URL.Query().Get("order_by")
-	orderDirection := r.URL.Query().Get("order_direction")
+	sortKeys, err := parseSort(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	releases, err := fetchWantedReleases(orderBy, orderDirection)
+	releases, pagination, err := listReleasesPage(r, ReleaseQuery{Wanted: boolPtr(true), Sort: sortKeys})
 	if err != nil {
 		log.Printf("Error fetching wanted releases: %v", err)
 		http.Error(w, "Database query error", http.StatusInternalServerError)
 		return
 	}
 
-	title := fmt.Sprintf("Wanted Releases (%d)", len(releases))
+	title := constructTitle("Wanted Releases", pagination.Total)
 
 	data := struct {
 		Year          string
@@ -254,19 +415,20 @@ func wantedReleasesHandler(w http.ResponseWriter, r *http.Request) {
 		NeedScrape    bool
 		Wanted        bool
 		Physical      string
-		OrderBy       string
-		OrderDirection string
+		Sort           string
 		SortingFields  []map[string]string
 		Filters        map[string]string
+		FilterChips    []FilterChip
+		Pagination     Pagination
 	}{
 		Releases:      releases,
+		Pagination:    pagination,
 		Template:      "releases",
 		Title:         title,
 		NeedScrape:    false,
 		Wanted:        true,
 		Physical:      "",
-		OrderBy:       sortingData["OrderBy"].(string),
-		OrderDirection: sortingData["OrderDirection"].(string),
+		Sort:           sortingData["Sort"].(string),
 		SortingFields: sortingData["SortingFields"].([]map[string]string),
 		Filters:       sortingData["Filters"].(map[string]string),
 	}
@@ -281,19 +443,19 @@ func wantedReleasesHandler(w http.ResponseWriter, r *http.Request) {
 func statsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Handling stats request from %s", r.RemoteAddr)
 
-	decadeStats, err := fetchStatsByDecade()
+	decadeStats, err := store.StatsByDecade()
 	if err != nil {
 		http.Error(w, "Error fetching decade statistics", http.StatusInternalServerError)
 		return
 	}
 
-	formatStats, err := fetchStatsByFormat()
+	formatStats, err := store.StatsByFormat()
 	if err != nil {
 		http.Error(w, "Error fetching format statistics", http.StatusInternalServerError)
 		return
 	}
 
-	artistStats, err := fetchStatsTopArtists()
+	artistStats, err := store.StatsTopArtists()
 	if err != nil {
 		http.Error(w, "Error fetching artist statistics", http.StatusInternalServerError)
 		return
@@ -323,17 +485,24 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 func needScrapingReleasesHandler(w http.ResponseWriter, r *http.Request) {
 	sortingData := getSortingData(r) // Get sorting data
 
-	orderBy := r.URL.Query().Get("order_by")
-	orderDirection := r.URL.Query().Get("order_direction")
+	sortKeys, err := parseSort(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Default ordering
+	if len(sortKeys) == 0 {
+		sortKeys = []SortKey{{Field: "title"}}
+	}
 
-	releases, err := fetchNeedScrapingReleases(orderBy, orderDirection)
+	releases, pagination, err := listReleasesPage(r, ReleaseQuery{NeedScraping: true, Sort: sortKeys})
 	if err != nil {
 		log.Printf("Error fetching releases that need scraping: %v", err)
 		http.Error(w, "Database query error", http.StatusInternalServerError)
 		return
 	}
 
-	title := fmt.Sprintf("Need scraping (%d)", len(releases))
+	title := constructTitle("Need scraping", pagination.Total)
 
 	// Update the data struct to include SortingFields and Filters
 	data := struct {
@@ -345,19 +514,20 @@ func needScrapingReleasesHandler(w http.ResponseWriter, r *http.Request) {
 		Title          string
 		NeedScrape     bool
 		Wanted         bool
-		OrderBy        string
-		OrderDirection string
+		Sort           string
 		Physical       string
 		SortingFields  []map[string]string // Added
 		Filters        map[string]string   // Added
+		FilterChips    []FilterChip
+		Pagination     Pagination
 	}{
 		Releases:       releases,
+		Pagination:     pagination,
 		Template:       "releases",
 		Title:          title,
 		NeedScrape:     true,
 		Wanted:         false,
-		OrderBy:        sortingData["OrderBy"].(string),       // Use sortingData
-		OrderDirection: sortingData["OrderDirection"].(string), // Use sortingData
+		Sort:           sortingData["Sort"].(string),
 		Physical:       "",
 		SortingFields:  sortingData["SortingFields"].([]map[string]string), // Populate
 		Filters:        sortingData["Filters"].(map[string]string),         // Populate
@@ -383,60 +553,161 @@ func constructTitle(title string, count int) string {
 	return fmt.Sprintf("%s (%d)", title, count)
 }
 
-func releasesHandler(w http.ResponseWriter, r *http.Request) {
-	sortingData := getSortingData(r)
+// FilterChip is an active listing filter, RemoveURL lists the same releases without it.
+type FilterChip struct {
+	Label     string
+	Value     string
+	RemoveURL string
+}
+
+// releaseFilterKeys are the query parameters that can be combined on /releases.
+var releaseFilterKeys = []struct {
+	Key   string
+	Label string
+}{
+	{"artist", "Artist"},
+	{"tag", "Tag"},
+	{"physical", "Format"},
+	{"label", "Label"},
+	{"year", "Year"},
+	{"wanted", "Wanted"},
+}
+
+// parseReleaseFilters merges the filter from a shortcut route (/year/, /tag/,
+// /artist/ or /format/) with the filters given as query parameters.
+func parseReleaseFilters(r *http.Request) map[string]string {
+	filters := make(map[string]string)
+	for _, f := range releaseFilterKeys {
+		if value := r.URL.Query().Get(f.Key); value != "" {
+			filters[f.Key] = value
+		}
+	}
 
-	path := r.URL.Path
-	var releases []Release
-	var err error
-	var year, tag, artist, physical string
-
-	orderBy := r.URL.Query().Get("order_by")
-	orderDirection := r.URL.Query().Get("order_direction")
-
-	// log.Printf("Handling releases request for path: %s", path)
-
-	// Parse the URL path to determine the filter
-	parts := strings.Split(path, "/")
-	if len(parts) >= 3 {
-		filterType := parts[1]
-		filterValue := parts[2]
-
-		switch filterType {
-		case "year":
-			year = filterValue
-			releases, err = fetchReleasesByYear(filterValue, orderBy, orderDirection)
-		case "tag":
-			tag = filterValue
-			releases, err = fetchReleasesByTag(filterValue, orderBy, orderDirection)
-		case "artist":
-			artist = filterValue
-			releases, err = fetchReleasesByArtist(filterValue, orderBy, orderDirection)
+	// Everything after the prefix is the value, artists may contain a / (i.e. Lennon/Ono)
+	parts := strings.SplitN(r.URL.Path, "/", 3)
+	if len(parts) == 3 && parts[2] != "" {
+		switch parts[1] {
+		case "year", "tag", "artist":
+			filters[parts[1]] = parts[2]
 		case "format":
-			physical = filterValue
-			releases, err = fetchReleasesByPhysical(filterValue, orderBy, orderDirection)
-		default:
-			releases, err = fetchReleases(orderBy, orderDirection)
+			filters["physical"] = parts[2]
+		}
+	}
+	return filters
+}
+
+// releaseQueryFromFilters converts parsed filters into a ReleaseQuery.
+func releaseQueryFromFilters(filters map[string]string) (ReleaseQuery, error) {
+	query := ReleaseQuery{
+		Artist:   filters["artist"],
+		Tag:      filters["tag"],
+		Physical: filters["physical"],
+		Label:    filters["label"],
+	}
+
+	if year := filters["year"]; year != "" {
+		y, err := strconv.Atoi(year)
+		if err != nil {
+			return query, fmt.Errorf("invalid year: %s", year)
+		}
+		query.Year = y
+	}
+
+	if wanted := filters["wanted"]; wanted != "" {
+		w, err := strconv.ParseBool(wanted)
+		if err != nil {
+			return query, fmt.Errorf("invalid wanted value: %s", wanted)
+		}
+		query.Wanted = &w
+	}
+
+	return query, nil
+}
+
+// filterChips builds one removable chip per active filter. Removing a chip
+// always goes through /releases so the remaining filters are kept.
+func filterChips(filters map[string]string, r *http.Request) []FilterChip {
+	var chips []FilterChip
+	for _, f := range releaseFilterKeys {
+		value, ok := filters[f.Key]
+		if !ok {
+			continue
 		}
-	} else {
-		releases, err = fetchReleases(orderBy, orderDirection)
+
+		params := url.Values{}
+		for key, v := range filters {
+			if key != f.Key {
+				params.Set(key, v)
+			}
+		}
+		for _, key := range []string{"sort", "page_size"} {
+			if v := r.URL.Query().Get(key); v != "" {
+				params.Set(key, v)
+			}
+		}
+
+		removeURL := "/releases"
+		if len(params) > 0 {
+			removeURL += "?" + params.Encode()
+		}
+		chips = append(chips, FilterChip{Label: f.Label, Value: value, RemoveURL: removeURL})
 	}
+	return chips
+}
+
+// releasesTitle describes the combined filters, i.e. "Albums by Miles Davis tagged jazz".
+func releasesTitle(filters map[string]string) string {
+	var parts []string
+	if artist := filters["artist"]; artist != "" {
+		parts = append(parts, "by "+artist)
+	}
+	if tag := filters["tag"]; tag != "" {
+		parts = append(parts, "tagged "+tag)
+	}
+	if physical := filters["physical"]; physical != "" {
+		parts = append(parts, "in "+physical)
+	}
+	if label := filters["label"]; label != "" {
+		parts = append(parts, "on "+label)
+	}
+	if year := filters["year"]; year != "" {
+		parts = append(parts, "from "+year)
+	}
+
+	noun := "Albums"
+	switch filters["wanted"] {
+	case "true":
+		noun = "Wanted albums"
+	case "false":
+		noun = "Owned albums"
+	default:
+		if len(parts) == 0 {
+			return "All Releases"
+		}
+	}
+	return strings.TrimSpace(noun + " " + strings.Join(parts, " "))
+}
 
+func releasesHandler(w http.ResponseWriter, r *http.Request) {
+	sortingData := getSortingData(r)
+
+	filters := parseReleaseFilters(r)
+	query, err := releaseQueryFromFilters(filters)
 	if err != nil {
-		log.Printf("Error fetching releases: %v", err)
-		http.Error(w, "Database query error", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Sort, err = parseSort(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	title := "All Releases"
-	if year != "" {
-		title = "Albums from " + year
-	} else if tag != "" {
-		title = "Albums tagged " + tag
-	} else if artist != "" {
-		title = "Albums by " + artist
-	} else if physical != "" {
-		title = "Albums in " + physical
+	releases, pagination, err := listReleasesPage(r, query)
+	if err != nil {
+		log.Printf("Error fetching releases: %v", err)
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
 	}
 
 	data := struct {
@@ -449,24 +720,27 @@ func releasesHandler(w http.ResponseWriter, r *http.Request) {
 		Title         string
 		Wanted        bool
 		NeedScrape    bool
-		OrderBy        string
-		OrderDirection string
+		IsSearch      bool
+		Sort           string
 		SortingFields  []map[string]string
 		Filters        map[string]string
+		FilterChips    []FilterChip
+		Pagination     Pagination
 	}{
-		Year:          year,
-		Tag:           tag,
-		Artist:        artist,
-		Physical:      physical,
+		Year:          filters["year"],
+		Tag:           filters["tag"],
+		Artist:        filters["artist"],
+		Physical:      filters["physical"],
 		Releases:      releases,
 		Template:      "releases",
-		Title:         constructTitle(title, len(releases)),
-		Wanted:        false,
+		Title:         constructTitle(releasesTitle(filters), pagination.Total),
+		Pagination:    pagination,
+		Wanted:        filters["wanted"] == "true",
 		NeedScrape:    false,
-		OrderBy:       sortingData["OrderBy"].(string),
-		OrderDirection: sortingData["OrderDirection"].(string),
+		Sort:           sortingData["Sort"].(string),
 		SortingFields: sortingData["SortingFields"].([]map[string]string),
 		Filters:       sortingData["Filters"].(map[string]string),
+		FilterChips:   filterChips(filters, r),
 	}
 
 	if err := Templates.ExecuteTemplate(w, "base.html", data); err != nil {
@@ -475,81 +749,6 @@ func releasesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func updateReleaseHandler(id string, r *http.Request) error {
-	// Parse the multipart form data
-	if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB max
-		log.Printf("Error parsing multipart form: %v", err)
-		return err
-	}
-
-	// Get the file from the form
-	file, header, err := r.FormFile("cover")
-	if err != nil && err != http.ErrMissingFile {
-		log.Printf("Error getting form file: %v", err)
-		return err
-	}
-
-	var coverImage string
-	if file != nil {
-		defer file.Close()
-
-		// Create the covers directory if it doesn't exist
-		coverDir := "web/static/covers"
-		if err := os.MkdirAll(coverDir, 0755); err != nil {
-			log.Printf("Error creating covers directory: %v", err)
-			return err
-		}
-
-		// First get the release_id from the database
-		releaseID, err := fetchReleaseIDByID(id)
-		if err != nil {
-			log.Printf("Error getting release_id: %v", err)
-			return err
-		}
-
-		// Get the file extension from the original filename
-		ext := filepath.Ext(header.Filename)
-		// Create the new filename using the release_id
-		coverImage = releaseID + ext
-		filePath := filepath.Join(coverDir, coverImage)
-
-		// Create the destination file
-		dst, err := os.Create(filePath)
-		if err != nil {
-			log.Printf("Error creating destination file: %v", err)
-			return err
-		}
-		defer dst.Close()
-
-		// Copy the uploaded file to the destination
-		if _, err := io.Copy(dst, file); err != nil {
-			log.Printf("Error copying file: %v", err)
-			return err
-		}
-	}
-
-	artist := r.FormValue("artist")
-	oldArtist := r.FormValue("old_artist")
-	updateAll := r.FormValue("update_all_artist_occurrencies") == "on"
-	convertToOwned := r.FormValue("convert_to_owned") == "on"
-
-	// Update the database with the new information including the cover image
-	err = updateReleaseInDB(id, r.FormValue("title"), artist, r.FormValue("year"), coverImage, convertToOwned)
-	if err != nil {
-		return err
-	}
-
-	if updateAll && artist != oldArtist {
-		err = updateAllArtistOccurrences(oldArtist, artist)
-		if err != nil {
-			log.Printf("Error updating all artist occurrences: %v", err)
-			return err
-		}
-	}
-
-	return nil
-}
-
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the multipart form data with a maximum size of 32MB
 	err := r.ParseMultipartForm(32 << 20)
@@ -568,20 +767,23 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Create a CSV reader from the file
-	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = -1 // Allow variable number of fields
-
-	var logMessages strings.Builder
-
-	// Process the CSV data
-	if err := processCSVData(reader, &logMessages, false); err != nil {
-		http.Error(w, "Error importing CSV data: "+err.Error(), http.StatusInternalServerError)
+	opts, err := newImportOptions(false, r.FormValue("update") != "", r.FormValue("profile"))
+	if err != nil {
+		http.Error(w, "Error importing CSV data: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Return log messages and success message
-	w.Write([]byte(logMessages.String() + "CSV data imported successfully!"))
+	// Import in the background, the admin page follows the job progress
+	job, err := startImportJob(file, opts)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == errJobAlreadyRunning {
+			status = http.StatusConflict
+		}
+		http.Error(w, "Error importing CSV data: "+err.Error(), status)
+		return
+	}
+	renderJob(w, job)
 }
 
 func uploadWantedHandler(w http.ResponseWriter, r *http.Request) {
@@ -602,29 +804,61 @@ func uploadWantedHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Create a CSV reader from the file
-	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = -1 // Allow variable number of fields
-
-	var logMessages strings.Builder
-
-	// Process the CSV data
-	if err := processCSVData(reader, &logMessages, true); err != nil {
-		http.Error(w, "Error importing CSV data: "+err.Error(), http.StatusInternalServerError)
+	opts, err := newImportOptions(true, r.FormValue("update") != "", r.FormValue("profile"))
+	if err != nil {
+		http.Error(w, "Error importing CSV data: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Return log messages and success message
-	w.Write([]byte(logMessages.String() + "CSV data imported successfully!"))
+	// Import in the background, the admin page follows the job progress
+	job, err := startImportJob(file, opts)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == errJobAlreadyRunning {
+			status = http.StatusConflict
+		}
+		http.Error(w, "Error importing CSV data: "+err.Error(), status)
+		return
+	}
+	renderJob(w, job)
 }
 
 func adminHandler(w http.ResponseWriter, r *http.Request) {
+	history, err := jobs.list(20)
+	if err != nil {
+		http.Error(w, "Error fetching job history", http.StatusInternalServerError)
+		return
+	}
+	var running []Job
+	for _, job := range history {
+		if !job.Finished() {
+			running = append(running, job)
+		}
+	}
+
+	// A broken profiles file should not hide the admin page, only the profiles
+	profiles, err := loadImportProfiles()
+	profilesError := ""
+	if err != nil {
+		log.Printf("Error loading import profiles: %v", err)
+		profiles = []importProfile{discogsProfile()}
+		profilesError = err.Error()
+	}
+
 	data := struct {
-		Template string
-		Title    string
+		Template      string
+		Title         string
+		RunningJobs   []Job
+		Jobs          []Job
+		Profiles      []importProfile
+		ProfilesError string
 	}{
-		Template: "admin",
-		Title:    "Admin Panel",
+		Template:      "admin",
+		Title:         "Admin Panel",
+		RunningJobs:   running,
+		Jobs:          history,
+		Profiles:      profiles,
+		ProfilesError: profilesError,
 	}
 
 	if err := Templates.ExecuteTemplate(w, "base.html", data); err != nil {
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// releaseLink matches the title link of a release card.
+var releaseLink = regexp.MustCompile(`<a href="/release/(\d+)">`)
+
+// listedReleaseIDs returns the IDs of the release cards of a page, in order.
+func listedReleaseIDs(body string) []int {
+	var ids []int
+	for _, m := range releaseLink.FindAllStringSubmatch(body, -1) {
+		id, _ := strconv.Atoi(m[1])
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestReleasesHandler(t *testing.T) {
+	store = newMemoryStore(listingReleases()...)
+
+	tests := []struct {
+		name  string
+		url   string
+		want  []int
+		title string
+	}{
+		{"every release", "/releases", []int{1, 2, 3, 4, 5}, "(5)"},
+		{"combined filters", "/releases?tag=trip+hop&physical=Vinyl", []int{1, 3}, "tagged trip hop in Vinyl (2)"},
+		{"wanted", "/releases?wanted=true", []int{3}, "(1)"},
+		{"artist page", "/artist/Portishead?sort=-year", []int{2, 1}, "by Portishead (2)"},
+		{"alternative artists", "/artist/Lennon/Ono", []int{4, 5}, "by Lennon/Ono (2)"},
+		{"year page", "/year/1994", []int{1}, "from 1994 (1)"},
+		{"format page", "/format/CD", []int{2}, "in CD (1)"},
+		{"label", "/releases?label=Island", []int{2}, "on Island (1)"},
+		{"sort keys", "/releases?sort=artist,-year", []int{4, 3, 2, 1, 5}, "(5)"},
+		{"legacy sort", "/releases?order_by=title&order_direction=desc", []int{2, 3, 5, 1, 4}, "(5)"},
+		{"first page", "/releases?sort=title&page_size=2", []int{4, 1}, "(5)"},
+		{"second page", "/releases?sort=title&page_size=2&page=2", []int{5, 3}, "(5)"},
+		{"last page", "/releases?sort=title&page_size=2&page=3", []int{2}, "(5)"},
+		{"past the last page", "/releases?page=9", nil, "(5)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			releasesHandler(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			body := w.Body.String()
+			if got := listedReleaseIDs(body); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("releases = %v, want %v", got, tt.want)
+			}
+			if !strings.Contains(body, tt.title) {
+				t.Errorf("page does not show the title %q", tt.title)
+			}
+		})
+	}
+}
+
+func TestReleasesHandlerPagination(t *testing.T) {
+	store = newMemoryStore(listingReleases()...)
+
+	w := httptest.NewRecorder()
+	releasesHandler(w, httptest.NewRequest(http.MethodGet, "/releases?tag=trip+hop&sort=title&page_size=1&page=2", nil))
+	body := w.Body.String()
+
+	// Page links keep the filters and the sort
+	for _, link := range []string{
+		`href="/releases?page=1&amp;page_size=1&amp;sort=title&amp;tag=trip&#43;hop" class="page-link" rel="prev"`,
+		`href="/releases?page=3&amp;page_size=1&amp;sort=title&amp;tag=trip&#43;hop" class="page-link" rel="next"`,
+		`<span class="page-link current" aria-current="page">2</span>`,
+	} {
+		if !strings.Contains(body, link) {
+			t.Errorf("page does not link %s", link)
+		}
+	}
+}
+
+func TestReleasesHandlerInvalidQuery(t *testing.T) {
+	store = newMemoryStore(listingReleases()...)
+
+	for _, url := range []string{"/releases?year=1990s", "/releases?wanted=maybe", "/releases?sort=price"} {
+		w := httptest.NewRecorder()
+		releasesHandler(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", url, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// historyLimit is the number of changes shown by the history pages.
+const historyLimit = 200
+
+// changeField is a field of a change as shown in the history.
+type changeField struct {
+	Name   string
+	Before string
+	After  string
+}
+
+// Fields lists the fields of a change by name with readable values. Created
+// and deleted releases only show the fields they had a value for.
+func (c ReleaseChange) Fields() []changeField {
+	names := make(map[string]bool)
+	for name := range c.Before {
+		names[name] = true
+	}
+	for name := range c.After {
+		names[name] = true
+	}
+
+	var fields []changeField
+	for name := range names {
+		field := changeField{Name: name, Before: displayValue(c.Before[name]), After: displayValue(c.After[name])}
+		if c.Action != changeUpdate && field.Before == "" && field.After == "" {
+			continue
+		}
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+// displayValue turns a logged value into text: lists are joined, tracks shown
+// as their position and title, and false, zero and empty values are blank.
+func displayValue(value json.RawMessage) string {
+	var v interface{}
+	if len(value) == 0 || json.Unmarshal(value, &v) != nil {
+		return ""
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		if v == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "yes"
+		}
+		return ""
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			if track, ok := item.(map[string]interface{}); ok {
+				items = append(items, strings.TrimSpace(fmt.Sprintf("%v %v", track["position"], track["title"])))
+				continue
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ", ")
+	}
+	return ""
+}
+
+// undoChange undoes one change, found by ID.
+func undoChange(origin changeOrigin, id int) ([]ReleaseChange, error) {
+	c, err := changeStore.GetChange(id)
+	if err != nil {
+		return nil, err
+	}
+	return undoChanges(origin, []ReleaseChange{*c})
+}
+
+// undoBatch undoes every change of an operation.
+func undoBatch(origin changeOrigin, batch string) ([]ReleaseChange, error) {
+	changes, err := changeStore.ListChanges(ChangeQuery{Batch: batch})
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return nil, errChangeNotFound
+	}
+	return undoChanges(origin, changes)
+}
+
+// undoErrorStatus is the HTTP status of an error undoing changes.
+func undoErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errChangeNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errUndoConflict), errors.Is(err, errReleaseExists):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// renderHistoryPage shows a list of changes, with a message explaining why
+// an undo failed.
+func renderHistoryPage(w http.ResponseWriter, title string, releaseID int, batch string, changes []ReleaseChange, message string, status int) {
+	data := struct {
+		Title     string
+		Template  string
+		ReleaseID int // When showing the history of one release
+		Batch     string
+		Changes   []ReleaseChange
+		Message   string
+	}{
+		Title:     title,
+		Template:  "history",
+		ReleaseID: releaseID,
+		Batch:     batch,
+		Changes:   changes,
+		Message:   message,
+	}
+	w.WriteHeader(status)
+	if err := Templates.ExecuteTemplate(w, "base.html", data); err != nil {
+		log.Printf("Error rendering history template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// releaseHistoryHandler shows the changes of a release at
+// /release/{id}/history. Deleted releases keep their history, so they can be
+// brought back from it.
+func releaseHistoryHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	showReleaseHistory(w, id, "", http.StatusOK)
+}
+
+func showReleaseHistory(w http.ResponseWriter, id int, message string, status int) {
+	changes, err := changeStore.ListChanges(ChangeQuery{ReleaseRef: id, Limit: historyLimit})
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+
+	title := fmt.Sprintf("History of release %d", id)
+	if release, err := store.GetRelease(id); err == nil {
+		title = "History of " + release.Artist + " - " + release.Title
+	} else if len(changes) > 0 {
+		title = "History of " + changes[0].Artist + " - " + changes[0].Title
+	} else {
+		http.Error(w, "Release not found", http.StatusNotFound)
+		return
+	}
+	renderHistoryPage(w, title, id, "", changes, message, status)
+}
+
+// historyHandler shows the latest changes to the collection at /history, or
+// the changes of one operation with ?batch=. Changes are undone with a POST
+// to /history/{id}/undo, operations with one to /history/batches/{batch}/undo.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/history"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		showHistory(w, r.URL.Query().Get("batch"), "", http.StatusOK)
+
+	case len(parts) == 2 && parts[1] == "undo":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid change ID", http.StatusBadRequest)
+			return
+		}
+		c, err := changeStore.GetChange(id)
+		if err != nil {
+			http.Error(w, "Change not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Undoing change %d of release %d", id, c.ReleaseRef)
+		if _, err := undoChange(requestOrigin(r, sourceUndo), id); err != nil {
+			log.Printf("Error undoing change %d: %v", id, err)
+			showReleaseHistory(w, c.ReleaseRef, err.Error(), undoErrorStatus(err))
+			return
+		}
+		http.Redirect(w, r, "/release/"+strconv.Itoa(c.ReleaseRef)+"/history", http.StatusSeeOther)
+
+	case len(parts) == 3 && parts[0] == "batches" && parts[2] == "undo":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		batch := parts[1]
+		log.Printf("Undoing the changes of operation %s", batch)
+		if _, err := undoBatch(requestOrigin(r, sourceUndo), batch); err != nil {
+			log.Printf("Error undoing operation %s: %v", batch, err)
+			showHistory(w, batch, err.Error(), undoErrorStatus(err))
+			return
+		}
+		http.Redirect(w, r, "/history?batch="+url.QueryEscape(batch), http.StatusSeeOther)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func showHistory(w http.ResponseWriter, batch, message string, status int) {
+	changes, err := changeStore.ListChanges(ChangeQuery{Batch: batch, Limit: historyLimit})
+	if err != nil {
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+	title := "History"
+	if batch != "" {
+		if len(changes) == 0 {
+			http.Error(w, "Operation not found", http.StatusNotFound)
+			return
+		}
+		title = fmt.Sprintf("Operation of %s (%d changes)", changes[0].ChangedAt.Format("2006-01-02 15:04"), len(changes))
+	}
+	renderHistoryPage(w, title, 0, batch, changes, message, status)
+}
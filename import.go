@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,173 +12,427 @@ import (
 	"strings"
 )
 
-func processCSVData(reader *csv.Reader, logMessages *strings.Builder, wanted bool) error {
-	logMessages.WriteString("<br>Starting CSV processing...<br>\n")
+// ImportSummary counts what happened to the records of an imported CSV file.
+type ImportSummary struct {
+	Total    int `json:"total"`
+	Inserted int `json:"inserted"`
+	Updated  int `json:"updated"`
+	Skipped  int `json:"skipped"` // Duplicates
+	Invalid  int `json:"invalid"`
+}
+
+// importOptions tell an import how to read the file and what to do with
+// releases already in the collection.
+type importOptions struct {
+	Wanted  bool // Import into the wanted list
+	Update  bool // Merge existing releases instead of skipping them
+	Rules   map[string]mergeRule
+	Profile *importProfile
+}
+
+// Outcomes of importing one record
+const (
+	importInserted  = "inserted"
+	importUpdated   = "updated"
+	importDuplicate = "duplicate" // Already in the collection or earlier in the file
+	importInvalid   = "invalid"   // Unreadable, missing or bad required fields
+	importError     = "error"     // Database error, the import was rolled back
+)
+
+// fieldChange is a field an import changes on a release already in the collection.
+type fieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// importRow is what an import does, or would do in a preview, with one record.
+type importRow struct {
+	Row       int           `json:"row"` // Line in the file, the header is line 1
+	Outcome   string        `json:"outcome"`
+	ReleaseID int           `json:"release_id,omitempty"`
+	Artist    string        `json:"artist"`
+	Title     string        `json:"title"`
+	Reason    string        `json:"reason,omitempty"` // Why a row is a duplicate or invalid
+	Changes   []fieldChange `json:"changes,omitempty"`
+
+	release Release  // The release to insert, or the merged one to update
+	current *Release // The release before the update
+}
+
+// csvRecord is a record of an import file with its line number, or the
+// error reading it.
+type csvRecord struct {
+	Line   int
+	Fields []string
+	Err    error
+}
+
+// dbExecutor is satisfied by both *sql.DB and *sql.Tx.
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
 
+// readCSVRecords reads the header, mapping field names to column indices with
+// the profile, and every record. Unreadable records are kept with their
+// error, to be reported as invalid.
+func readCSVRecords(reader *csv.Reader, profile *importProfile) (map[string]int, []csvRecord, error) {
 	header, err := reader.Read()
 	if err != nil {
-		return fmt.Errorf("error reading CSV header: %v", err)
+		return nil, nil, fmt.Errorf("error reading CSV header: %v", err)
 	}
-
-	// Map column names to indices
-	colMap := make(map[string]int)
-	for i, col := range header {
-		colMap[col] = i
+	colMap, err := profile.columns(header)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	var totalRecords, validRecords, skippedRecords int
-
+	var records []csvRecord
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
 			break
 		}
-		if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
 			log.Printf("Error reading record: %v", err)
+			records = append(records, csvRecord{Line: parseErr.StartLine, Err: parseErr.Err})
 			continue
 		}
-		totalRecords++
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading CSV: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+		records = append(records, csvRecord{Line: line, Fields: record})
+	}
+	return colMap, records, nil
+}
 
-		// log.Printf("\n--- Processing Record %d ---", totalRecords)
-		// log.Printf("Raw record data: %v", record)
+// processCSVData is the work of an import job. Records are read first so the
+// job knows its total, then imported one by one reporting progress. The
+// outcome of every row is saved as the import report of the job, even when
+// the import fails.
+func processCSVData(reader *csv.Reader, opts importOptions, job *jobContext) (ImportSummary, error) {
+	colMap, records, err := readCSVRecords(reader, opts.Profile)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+	job.SetTotal(len(records))
 
-		// Get required fields
-		artist := getField(record, colMap, "Artist")
-		title := getField(record, colMap, "Title")
-		releaseID := getField(record, colMap, "release_id")
+	summary, rows, err := importRecords(colMap, records, opts, job)
+	if saveErr := jobStore.SaveImportRows(job.ID(), rows); saveErr != nil {
+		log.Printf("Error saving import report: %v", saveErr)
+		job.Logf("Error saving import report: %v", saveErr)
+	}
+	return summary, err
+}
 
-		if artist == "" || title == "" || releaseID == "" {
-			skippedRecords++
-			// log.Printf("SKIPPED: Missing required data (Artist: '%s', Title: '%s', Release ID: '%s')", artist, title, releaseID)
-			continue
+// importRecords imports the records in a single transaction, so a failed or
+// cancelled import leaves the collection untouched. Audited writes wait for
+// it, so no edit lands between what it reads and what it writes.
+func importRecords(colMap map[string]int, records []csvRecord, opts importOptions, job *jobContext) (ImportSummary, []importRow, error) {
+	var rows []importRow
+	auditWrites.Lock()
+	defer auditWrites.Unlock()
+	tx, err := db.Begin()
+	if err != nil {
+		return ImportSummary{}, nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	// SQLite has a single writer, progress saves would wait for the transaction
+	job.SaveOnlyWhenFinished()
+
+	var summary ImportSummary
+	origin := jobOrigin(job, sourceImport)
+	planner := newImportPlanner(tx, colMap, opts)
+	for _, record := range records {
+		if err := job.Err(); err != nil {
+			return ImportSummary{Total: len(records)}, rows, err
 		}
 
-		// Convert release_id to integer once
-		releaseIDInt, err := strconv.Atoi(releaseID)
+		item := getField(record.Fields, colMap, "artist") + " - " + getField(record.Fields, colMap, "title")
+		job.Start(item)
+		row, err := planner.plan(record)
+		if err == nil {
+			err = applyImportRow(tx, row, origin)
+		}
 		if err != nil {
-			log.Printf("Error converting release_id '%s' to int: %v", releaseID, err)
-			skippedRecords++
-			continue
+			row.Outcome = importError
+			row.Reason = err.Error()
+			rows = append(rows, row)
+			return ImportSummary{Total: len(records)}, rows, fmt.Errorf("error importing line %d, nothing was imported: %v", record.Line, err)
 		}
 
-		// Debug: Show the actual query we're about to run
-		// log.Printf("Checking if release_id %d exists in database", releaseIDInt)
-
-		// Check if release_id exists in database
-		var exists bool
-		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM releases WHERE release_id = $1)", releaseIDInt).Scan(&exists)
-		if err != nil {
-			log.Printf("Error checking if release exists: %v", err)
-			skippedRecords++
-			continue
+		rows = append(rows, row)
+		summary.add(row)
+		var rowErr error
+		switch row.Outcome {
+		case importUpdated:
+			job.Logf("Updated %s: %s", item, formatChanges(row.Changes))
+		case importInvalid:
+			rowErr = fmt.Errorf("line %d: %s", row.Row, row.Reason)
 		}
+		job.Done(item, rowErr)
+	}
 
-		// Debug: Show all release_ids in database
-		// rows, err := db.Query("SELECT release_id FROM releases ORDER BY release_id")
-		// if err != nil {
-		// 	log.Printf("Error querying all release_ids: %v", err)
-		// } else {
-
-		// 	var ids []int
-		// 	for rows.Next() {
-		// 		var id int
-		// 		if err := rows.Scan(&id); err != nil {
-		// 			log.Printf("Error scanning release_id: %v", err)
-		// 			continue
-		// 		}
-		// 		ids = append(ids, id)
-		// 	}
-		// 	rows.Close()
-		// }
-
-		if exists {
-			// log.Printf("SKIPPED: Release ID %d already exists in database", releaseIDInt)
-			skippedRecords++
-			continue
+	if err := tx.Commit(); err != nil {
+		return ImportSummary{Total: len(records)}, rows, fmt.Errorf("error saving import, nothing was imported: %v", err)
+	}
+
+	log.Printf("\n=== Import Summary ===")
+	log.Printf("Total records processed: %d", summary.Total)
+	log.Printf("Valid records: %d", summary.Inserted)
+	log.Printf("Updated records: %d", summary.Updated)
+	log.Printf("Skipped records: %d", summary.Skipped)
+	log.Printf("Invalid records: %d", summary.Invalid)
+
+	return summary, rows, nil
+}
+
+// add counts the outcome of a row.
+func (s *ImportSummary) add(row importRow) {
+	s.Total++
+	switch row.Outcome {
+	case importInserted:
+		s.Inserted++
+	case importUpdated:
+		s.Updated++
+	case importDuplicate:
+		s.Skipped++
+	case importInvalid:
+		s.Invalid++
+	}
+}
+
+// String is the summary shown as the message of an import job.
+func (s ImportSummary) String() string {
+	return fmt.Sprintf("Total records processed: %d. New records: %d. Updated records: %d. Already added records: %d. Invalid records: %d.", s.Total, s.Inserted, s.Updated, s.Skipped, s.Invalid)
+}
+
+// importPlanner decides what to do with each record of a file, remembering
+// the release_ids seen on earlier lines. colMap maps field names to columns.
+type importPlanner struct {
+	q      dbExecutor
+	colMap map[string]int
+	opts   importOptions
+	seen   map[int]int // release_id -> line
+}
+
+func newImportPlanner(q dbExecutor, colMap map[string]int, opts importOptions) *importPlanner {
+	return &importPlanner{q: q, colMap: colMap, opts: opts, seen: make(map[int]int)}
+}
+
+// plan classifies one record as new, an update (with the field changes), a
+// duplicate or invalid, without writing anything. Errors are database errors.
+func (p *importPlanner) plan(record csvRecord) (importRow, error) {
+	// Get required fields
+	artist := getField(record.Fields, p.colMap, "artist")
+	title := getField(record.Fields, p.colMap, "title")
+	releaseID := getField(record.Fields, p.colMap, "release_id")
+	row := importRow{Row: record.Line, Artist: artist, Title: title}
+	if record.Err != nil {
+		row.Outcome = importInvalid
+		row.Reason = "unreadable: " + record.Err.Error()
+		return row, nil
+	}
+
+	// Files without Discogs release_ids get a synthetic one
+	if _, ok := p.colMap["release_id"]; !ok && artist != "" && title != "" {
+		releaseID = strconv.Itoa(syntheticReleaseID(artist, title, getField(record.Fields, p.colMap, "catalog_number"), getField(record.Fields, p.colMap, "format")))
+	}
+
+	var missing []string
+	for _, field := range []struct{ name, value string }{{"artist", artist}, {"title", title}, {"release_id", releaseID}} {
+		if _, mapped := p.colMap[field.name]; field.value == "" && (mapped || field.name != "release_id") {
+			missing = append(missing, field.name)
 		}
+	}
+	if len(missing) > 0 {
+		row.Outcome = importInvalid
+		row.Reason = "missing " + strings.Join(missing, ", ")
+		return row, nil
+	}
 
-		// Get optional fields
-		catalogNum := getField(record, colMap, "Catalog#")
-		label := getField(record, colMap, "Label")
-		format := getField(record, colMap, "Format")
-		rating := getField(record, colMap, "Rating")
-		released := getField(record, colMap, "Released")
-		collectionFolder := getField(record, colMap, "CollectionFolder")
-		dateAdded := getField(record, colMap, "Date Added")
-		mediaCondition := getField(record, colMap, "Collection Media Condition")
-		sleeveCondition := getField(record, colMap, "Collection Sleeve Condition")
-		notes := getField(record, colMap, "Collection Notes")
-
-		// Determine physical format
-		physical := determinePhysicalFormat(format)
-
-		// Insert the new release into the database
-		_, err = db.Exec(`
-                       INSERT INTO releases (artist, title, release_id, catalog_number, label, format, rating, released, collection_folder, date_added, collection_media_condition, collection_sleeve_condition, collection_notes, year, wanted, physical)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
-		`, artist, title, releaseIDInt, catalogNum, label, format, rating, released, collectionFolder, dateAdded, mediaCondition, sleeveCondition, notes, 0, wanted, physical)
+	releaseIDInt, err := strconv.Atoi(releaseID)
+	if err != nil {
+		row.Outcome = importInvalid
+		row.Reason = fmt.Sprintf("invalid release_id %q", releaseID)
+		return row, nil
+	}
+	row.ReleaseID = releaseIDInt
 
-		if err != nil {
-			log.Printf("Error inserting release into database: %v", err)
-			skippedRecords++
-			continue
+	if line, ok := p.seen[releaseIDInt]; ok {
+		row.Outcome = importDuplicate
+		row.Reason = fmt.Sprintf("same release_id as line %d", line)
+		return row, nil
+	}
+	p.seen[releaseIDInt] = record.Line
+
+	imported, present := releaseFromRecord(record.Fields, p.colMap)
+	imported.ReleaseID = releaseIDInt
+	imported.Wanted = p.opts.Wanted
+	imported.Physical = p.opts.Profile.physicalFormat(imported.Format)
+	imported.Tags = p.opts.Profile.tags(getField(record.Fields, p.colMap, "tags"))
+	if err := p.opts.Profile.convertDates(&imported); err != nil {
+		row.Outcome = importInvalid
+		row.Reason = err.Error()
+		return row, nil
+	}
+	if imported.Year, err = p.opts.Profile.year(getField(record.Fields, p.colMap, "year")); err != nil {
+		row.Outcome = importInvalid
+		row.Reason = err.Error()
+		return row, nil
+	}
+
+	// Check if release_id exists in database
+	current, err := scanRelease(p.q.QueryRow("SELECT "+releaseColumns+" FROM releases WHERE release_id = $1", releaseIDInt))
+	if err == sql.ErrNoRows {
+		row.Outcome = importInserted
+		row.release = imported
+		return row, nil
+	}
+	if err != nil {
+		log.Printf("Error checking if release exists: %v", err)
+		return row, err
+	}
+
+	row.Outcome = importDuplicate
+	row.Reason = "already in the collection"
+	if !p.opts.Update {
+		return row, nil
+	}
+	merged, changed := mergeImported(current, imported, present, p.opts.Rules)
+	if len(changed) == 0 {
+		row.Reason = "already in the collection, nothing to update"
+		return row, nil
+	}
+	row.Outcome = importUpdated
+	row.Reason = ""
+	row.Changes = fieldChanges(current, merged, changed)
+	row.release = merged
+	row.current = &current
+	return row, nil
+}
+
+// applyImportRow writes a planned row.
+func applyImportRow(q dbExecutor, row importRow, origin changeOrigin) error {
+	switch row.Outcome {
+	case importInserted:
+		return writeImportedRelease(q, origin, nil, row.release)
+	case importUpdated:
+		return writeImportedRelease(q, origin, row.current, row.release)
+	}
+	return nil
+}
+
+// writeImportedRelease inserts a release read from an import file,
+// or updates the current one with the merged release, and logs the change
+// with the same executor so it is part of the import transaction.
+func writeImportedRelease(q dbExecutor, origin changeOrigin, current *Release, r Release) error {
+	if current != nil {
+		if err := updateImportedRelease(q, r); err != nil {
+			return err
 		}
+		if c, ok := newReleaseChange(origin, current, &r); ok {
+			_, err := insertReleaseChange(q, c)
+			return err
+		}
+		return nil
+	}
 
-		// This releaseIDInt conversion is redundant since we already did it above
-		validRecords++
+	id, err := insertRelease(q, r)
+	if err != nil {
+		return err
 	}
+	// Read back for the fields set on insert, i.e. the physical format
+	inserted, err := scanRelease(q.QueryRow("SELECT "+releaseColumns+" FROM releases WHERE id = $1", id))
+	if err != nil {
+		return err
+	}
+	c, _ := newReleaseChange(origin, nil, &inserted)
+	_, err = insertReleaseChange(q, c)
+	return err
+}
 
-	log.Printf("\n=== Import Summary ===")
-	log.Printf("Total records processed: %d", totalRecords)
-	log.Printf("Valid records: %d", validRecords)
-	log.Printf("Skipped records: %d", skippedRecords)
-	logMessages.WriteString("<br>Import Summary<br>\n")
-	logMessages.WriteString(fmt.Sprintf("Total records processed: %d<br>\n", totalRecords))
-	logMessages.WriteString(fmt.Sprintf("New records: %d<br>\n", validRecords))
-	logMessages.WriteString(fmt.Sprintf("Already added records: %d<br><br>\n", skippedRecords))
-
-	// Diagnostic query to check actual database content
-	var totalInDB int
-	err = db.QueryRow("SELECT COUNT(*) FROM releases").Scan(&totalInDB)
+// insertRelease inserts a release read from an import file, Discogs or the
+// add release form, returning its ID. The physical format is classified from
+// the format unless already set.
+func insertRelease(q dbExecutor, r Release) (int, error) {
+	if r.Physical == "" {
+		r.Physical = determinePhysicalFormat(r.Format)
+	}
+	var tags interface{}
+	if len(r.Tags) > 0 {
+		tags = dbDialect.TagsValue(r.Tags)
+	}
+	var id int
+	err := q.QueryRow(`
+		INSERT INTO releases (artist, title, release_id, catalog_number, label, format, rating, released, collection_folder, date_added, collection_media_condition, collection_sleeve_condition, collection_notes, year, wanted, physical, tags)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		RETURNING id
+	`, r.Artist, r.Title, r.ReleaseID, r.CatalogNumber, r.Label, r.Format, r.Rating, r.Released, r.CollectionFolder, r.DateAdded, r.CollectionMediaCondition, r.CollectionSleeveCondition, r.CollectionNotes, r.Year, r.Wanted, r.Physical, tags).Scan(&id)
 	if err != nil {
-		log.Printf("Error counting records in database: %v", err)
-	} else {
-		log.Printf("\n=== Database Status ===")
-		log.Printf("Total records in database: %d", totalInDB)
+		log.Printf("Error inserting release into database: %v", err)
+		return 0, err
+	}
+	return id, replaceReleaseMedia(q, id, r.Format)
+}
 
-		// Get a sample of records to verify data
-		rows, err := db.Query("SELECT release_id, artist, title FROM releases ORDER BY release_id LIMIT 5")
-		if err != nil {
-			log.Printf("Error querying sample records: %v", err)
-		} else {
-			rows.Close()
+// releaseFromRecord reads the import fields of a CSV record, along with the
+// names of the fields the file has a column for.
+func releaseFromRecord(record []string, colMap map[string]int) (Release, map[string]bool) {
+	var release Release
+	present := make(map[string]bool)
+	for _, field := range importFields {
+		if _, ok := colMap[field.Name]; ok {
+			present[field.Name] = true
+			*field.get(&release) = getField(record, colMap, field.Name)
 		}
 	}
+	return release, present
+}
 
-	return nil
+// startImportJob reads an uploaded file and imports it in the background.
+func startImportJob(file io.Reader, opts importOptions) (*Job, error) {
+	// The upload is gone once the request ends, keep it in memory for the job
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+	return startImportData(data, opts)
 }
 
-func determinePhysicalFormat(format string) string {
-	formatLower := strings.ToLower(format)
-	if strings.Contains(formatLower, "7\"") ||
-		strings.Contains(formatLower, "ep") ||
-		strings.Contains(formatLower, "maxi") ||
-		strings.Contains(formatLower, "single") {
-		return "EP - Single"
-	} else if strings.Contains(formatLower, "lp") ||
-		strings.Contains(formatLower, "7\"") ||
-		strings.Contains(formatLower, "12\"") {
-		return "Vinyl"
-	} else if strings.Contains(formatLower, "cd") {
-		return "CD"
-	} else if strings.Contains(formatLower, "dvd") {
-		return "DVD"
-	} else if strings.Contains(formatLower, "ray") {
-		return "Blu-ray"
-	} else if strings.Contains(formatLower, "cass") {
-		return "Tape"
+// newImportOptions reads the merge rules and the import profile. With update
+// set, releases already in the collection are merged following the
+// IMPORT_MERGE_RULES instead of being skipped.
+func newImportOptions(wanted, update bool, profileName string) (importOptions, error) {
+	rules, err := getMergeRules()
+	if err != nil {
+		return importOptions{}, err
 	}
-	return ""
+	profile, err := getImportProfile(profileName)
+	if err != nil {
+		return importOptions{}, err
+	}
+	return importOptions{Wanted: wanted, Update: update, Rules: rules, Profile: profile}, nil
+}
+
+// startImportData imports a file already read into memory in the background.
+func startImportData(data []byte, opts importOptions) (*Job, error) {
+	return jobs.start(jobKindImport, func(j *jobContext) (string, error) {
+		summary, err := processCSVData(newCSVReader(data, opts.Profile), opts, j)
+		if err != nil {
+			return "Nothing was imported.", err
+		}
+		return summary.String(), nil
+	})
+}
+
+func newCSVReader(data []byte, profile *importProfile) *csv.Reader {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = profile.delimiter()
+	reader.FieldsPerRecord = -1 // Allow variable number of fields
+	return reader
 }
 
 // Helper function to safely get field value from CSV record
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Previews are kept in memory until confirmed or cancelled, abandoned ones
+// expire after importPreviewTTL.
+const importPreviewTTL = 30 * time.Minute
+
+// importPreview is a dry run of an uploaded file, waiting for the user to
+// confirm or cancel the import.
+type importPreview struct {
+	Token   string
+	Wanted  bool
+	Update  bool
+	Rows    []importRow
+	Summary ImportSummary
+
+	data    []byte
+	opts    importOptions
+	created time.Time
+}
+
+var importPreviews = struct {
+	sync.Mutex
+	m map[string]*importPreview
+}{m: make(map[string]*importPreview)}
+
+// previewImport plans every record of a file against the collection
+// without writing anything.
+func previewImport(data []byte, opts importOptions) (*importPreview, error) {
+	colMap, records, err := readCSVRecords(newCSVReader(data, opts.Profile), opts.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &importPreview{Wanted: opts.Wanted, Update: opts.Update, data: data, opts: opts, created: time.Now()}
+	planner := newImportPlanner(db, colMap, opts)
+	for _, record := range records {
+		row, err := planner.plan(record)
+		if err != nil {
+			return nil, fmt.Errorf("error checking line %d: %v", record.Line, err)
+		}
+		preview.Rows = append(preview.Rows, row)
+		preview.Summary.add(row)
+	}
+	return preview, nil
+}
+
+// storeImportPreview keeps a preview under a random token, dropping expired ones.
+func storeImportPreview(preview *importPreview) error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	preview.Token = hex.EncodeToString(token)
+
+	importPreviews.Lock()
+	defer importPreviews.Unlock()
+	for key, p := range importPreviews.m {
+		if time.Since(p.created) > importPreviewTTL {
+			delete(importPreviews.m, key)
+		}
+	}
+	importPreviews.m[preview.Token] = preview
+	return nil
+}
+
+// takeImportPreview removes a preview and returns it, nil if it is unknown or expired.
+func takeImportPreview(token string) *importPreview {
+	importPreviews.Lock()
+	defer importPreviews.Unlock()
+	preview := importPreviews.m[token]
+	delete(importPreviews.m, token)
+	if preview == nil || time.Since(preview.created) > importPreviewTTL {
+		return nil
+	}
+	return preview
+}
+
+// importPreviewHandler shows what importing an uploaded file would do, row by
+// row, with confirm and cancel buttons. The "wanted" form value previews an
+// import into the wanted list.
+func importPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse the multipart form data with a maximum size of 32MB
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	opts, err := newImportOptions(r.FormValue("wanted") == "true", r.FormValue("update") != "", r.FormValue("profile"))
+	if err != nil {
+		http.Error(w, "Error previewing CSV data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Error reading file", http.StatusBadRequest)
+		return
+	}
+
+	preview, err := previewImport(data, opts)
+	if err != nil {
+		log.Printf("Error previewing import: %v", err)
+		http.Error(w, "Error previewing CSV data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := storeImportPreview(preview); err != nil {
+		log.Printf("Error storing import preview: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := Templates.ExecuteTemplate(w, "import-preview", preview); err != nil {
+		log.Printf("Error rendering import preview template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// importPreviewActionHandler handles /import-preview/{token}/confirm, which
+// runs the previewed import as a job, and /import-preview/{token}/cancel.
+func importPreviewActionHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/import-preview/"), "/"), "/")
+	if len(parts) != 2 || (parts[1] != "confirm" && parts[1] != "cancel") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	preview := takeImportPreview(parts[0])
+	if preview == nil {
+		http.Error(w, "Preview not found or expired, upload the file again", http.StatusNotFound)
+		return
+	}
+	if parts[1] == "cancel" {
+		w.Write([]byte("Import cancelled."))
+		return
+	}
+
+	// The collection may have changed since the preview, the job plans every row again
+	job, err := startImportData(preview.data, preview.opts)
+	if err != nil {
+		// Keep the preview, the user can confirm again once the running job is done
+		importPreviews.Lock()
+		importPreviews.m[preview.Token] = preview
+		importPreviews.Unlock()
+
+		status := http.StatusInternalServerError
+		if err == errJobAlreadyRunning {
+			status = http.StatusConflict
+		}
+		http.Error(w, "Error importing CSV data: "+err.Error(), status)
+		return
+	}
+	renderJob(w, job)
+}
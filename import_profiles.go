@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Layouts of the date fields in the Discogs CSV export, which every profile
+// converts its dates to.
+const (
+	discogsDateAddedLayout = "2006-01-02 15:04:05"
+	discogsReleasedLayout  = "2006-01-02"
+)
+
+// importProfile maps the columns of a CSV or TSV file onto release fields,
+// so collections kept in spreadsheets or other apps can be imported.
+type importProfile struct {
+	Name         string            `json:"name"`
+	Description  string            `json:"description,omitempty"`
+	Delimiter    string            `json:"delimiter,omitempty"`     // "," by default, "\t" for TSV files
+	Columns      map[string]string `json:"columns"`                 // Field name -> column header
+	DateFormat   string            `json:"date_format,omitempty"`   // Go layout of released and date_added, i.e. "02/01/2006"
+	Physical     map[string]string `json:"physical,omitempty"`      // Format value -> physical format, before the built-in rules
+	TagSeparator string            `json:"tag_separator,omitempty"` // Splits the tags column, "," by default
+}
+
+// profileFields are the fields a profile can map, besides the importFields.
+// Tags and year are only set on new releases, scraping owns them afterwards.
+var profileFields = []string{"release_id", "tags", "year"}
+
+// discogsProfile reads the CSV export of a Discogs collection or wantlist.
+func discogsProfile() importProfile {
+	profile := importProfile{
+		Name:        "discogs",
+		Description: "Discogs collection or wantlist CSV export",
+		Columns:     map[string]string{"release_id": "release_id"},
+	}
+	for _, field := range importFields {
+		profile.Columns[field.Name] = field.Column
+	}
+	return profile
+}
+
+// loadImportProfiles returns the built-in discogs profile followed by the
+// profiles in IMPORT_PROFILES_FILE, a JSON array. The default file,
+// import_profiles.json, is optional.
+func loadImportProfiles() ([]importProfile, error) {
+	profiles := []importProfile{discogsProfile()}
+
+	path := getEnvWithDefault("IMPORT_PROFILES_FILE", "import_profiles.json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && os.Getenv("IMPORT_PROFILES_FILE") == "" {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading import profiles: %v", err)
+	}
+
+	var custom []importProfile
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	for _, profile := range custom {
+		if err := profile.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for _, existing := range profiles {
+			if existing.Name == profile.Name {
+				return nil, fmt.Errorf("%s: duplicate import profile %q", path, profile.Name)
+			}
+		}
+		profiles = append(profiles, profile.normalized())
+	}
+	return profiles, nil
+}
+
+// getImportProfile finds a profile by name, the discogs one when name is empty.
+func getImportProfile(name string) (*importProfile, error) {
+	if name == "" {
+		name = "discogs"
+	}
+	profiles, err := loadImportProfiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return &profile, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown import profile %q", name)
+}
+
+func (p importProfile) validate() error {
+	if p.Name == "" {
+		return errors.New("import profile without a name")
+	}
+	if p.Delimiter != "" && utf8.RuneCountInString(p.Delimiter) != 1 {
+		return fmt.Errorf("import profile %q: the delimiter must be a single character", p.Name)
+	}
+	for field := range p.Columns {
+		if !isProfileField(field) {
+			return fmt.Errorf("import profile %q: unknown field %q", p.Name, field)
+		}
+	}
+	for _, required := range []string{"artist", "title"} {
+		if p.Columns[required] == "" {
+			return fmt.Errorf("import profile %q: no column for %s", p.Name, required)
+		}
+	}
+	return nil
+}
+
+func isProfileField(name string) bool {
+	for _, field := range importFields {
+		if field.Name == name {
+			return true
+		}
+	}
+	return containsString(profileFields, name)
+}
+
+// normalized lowercases the keys of the physical mapping, which are matched
+// ignoring case.
+func (p importProfile) normalized() importProfile {
+	physical := make(map[string]string, len(p.Physical))
+	for format, value := range p.Physical {
+		physical[strings.ToLower(strings.TrimSpace(format))] = value
+	}
+	p.Physical = physical
+	return p
+}
+
+// delimiter is the field separator of the files read with the profile.
+func (p *importProfile) delimiter() rune {
+	if p.Delimiter == "" {
+		return ','
+	}
+	r, _ := utf8.DecodeRuneInString(p.Delimiter)
+	return r
+}
+
+// columns maps field names to column indices of a file header. Headers are
+// matched ignoring case and surrounding spaces.
+func (p *importProfile) columns(header []string) (map[string]int, error) {
+	if len(header) > 0 {
+		// Spreadsheets like to start UTF-8 files with a byte order mark
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	colMap := make(map[string]int)
+	for field, column := range p.Columns {
+		for i, name := range header {
+			if strings.EqualFold(strings.TrimSpace(name), strings.TrimSpace(column)) {
+				colMap[field] = i
+				break
+			}
+		}
+	}
+
+	for _, required := range []string{"artist", "title", "release_id"} {
+		column, mapped := p.Columns[required]
+		if _, found := colMap[required]; mapped && !found {
+			return nil, fmt.Errorf("the file has no %q column, needed for %s by the %s profile", column, required, p.Name)
+		}
+	}
+	return colMap, nil
+}
+
+// physicalFormat classifies a format value, using the mapping of the profile
+// before the built-in rules.
+func (p *importProfile) physicalFormat(format string) string {
+	if physical, ok := p.Physical[strings.ToLower(strings.TrimSpace(format))]; ok {
+		return physical
+	}
+	return determinePhysicalFormat(format)
+}
+
+// convertDates rewrites released and date_added from the date format of the
+// profile into the one of the Discogs export.
+func (p *importProfile) convertDates(r *Release) error {
+	if p.DateFormat == "" {
+		return nil
+	}
+	for _, field := range []struct {
+		name   string
+		value  *string
+		layout string
+	}{{"released", &r.Released, discogsReleasedLayout}, {"date_added", &r.DateAdded, discogsDateAddedLayout}} {
+		value := strings.TrimSpace(*field.value)
+		if value == "" || (field.name == "released" && isYear(value)) {
+			continue // Release dates are often just a year
+		}
+		date, err := time.Parse(p.DateFormat, value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q, expected a date like %q", field.name, value, p.DateFormat)
+		}
+		*field.value = date.Format(field.layout)
+	}
+	return nil
+}
+
+func isYear(value string) bool {
+	_, err := strconv.Atoi(value)
+	return err == nil && len(value) == 4
+}
+
+// tags splits the tags column, lowercased like scraped tags.
+func (p *importProfile) tags(value string) []string {
+	separator := p.TagSeparator
+	if separator == "" {
+		separator = ","
+	}
+	var tags []string
+	for _, tag := range strings.Split(value, separator) {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// year reads the year column, empty meaning unknown.
+func (p *importProfile) year(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	year, err := strconv.Atoi(value)
+	if err != nil || year < 0 {
+		return 0, fmt.Errorf("invalid year %q", value)
+	}
+	return year, nil
+}
+
+// syntheticReleaseID identifies rows of files without Discogs release_ids.
+// It is a negative hash of artist, title, catalog number and format, so it
+// never matches a Discogs release and stays the same when the file is imported
+// again, finding the releases to update or skip. The format tells apart the
+// LP and CD of an album without catalog numbers.
+func syntheticReleaseID(artist, title, catalogNumber, format string) int {
+	h := fnv.New32a()
+	for _, part := range []string{artist, title, catalogNumber, format} {
+		h.Write([]byte(strings.ToLower(strings.TrimSpace(part))))
+		h.Write([]byte{0})
+	}
+	id := int(h.Sum32() & 0x7fffffff)
+	if id == 0 {
+		id = 1
+	}
+	return -id
+}
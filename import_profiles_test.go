@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestSyntheticReleaseID(t *testing.T) {
+	lp := syntheticReleaseID("Portishead", "Dummy", "", "Vinyl")
+	if lp >= 0 {
+		t.Errorf("synthetic release_id %d is not negative", lp)
+	}
+	if again := syntheticReleaseID(" portishead", "DUMMY ", "", "vinyl"); again != lp {
+		t.Errorf("release_id changes with case and spaces: %d, then %d", lp, again)
+	}
+	if cd := syntheticReleaseID("Portishead", "Dummy", "", "CD"); cd == lp {
+		t.Errorf("LP and CD of the same album share the release_id %d", lp)
+	}
+	if other := syntheticReleaseID("Portishead", "Dummy", "828 553-1", "Vinyl"); other == lp {
+		t.Errorf("pressings with different catalog numbers share the release_id %d", lp)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// importReportHandler shows the outcome of every row of an import job at
+// /jobs/{id}/report, or downloads it with ?format=csv or ?format=json.
+func importReportHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job, err := jobs.get(id)
+	if err == errJobNotFound || (err == nil && job.Kind != jobKindImport) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error fetching job", http.StatusInternalServerError)
+		return
+	}
+	rows, err := jobStore.ImportRows(id)
+	if err != nil {
+		http.Error(w, "Error fetching import report", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("import-%d", id)
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		writeImportReportCSV(w, rows)
+		return
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		if rows == nil {
+			rows = []importRow{}
+		}
+		json.NewEncoder(w).Encode(struct {
+			Job  *Job        `json:"job"`
+			Rows []importRow `json:"rows"`
+		}{job, rows})
+		return
+	}
+
+	var summary ImportSummary
+	for _, row := range rows {
+		summary.add(row)
+	}
+	data := struct {
+		Template string
+		Title    string
+		Job      *Job
+		Rows     []importRow
+		Summary  ImportSummary
+	}{
+		Template: "import-report",
+		Title:    fmt.Sprintf("Import #%d", id),
+		Job:      job,
+		Rows:     rows,
+		Summary:  summary,
+	}
+
+	if err := Templates.ExecuteTemplate(w, "base.html", data); err != nil {
+		log.Printf("Error rendering template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// writeImportReportCSV writes one line per row, changes as in the job log.
+func writeImportReportCSV(w http.ResponseWriter, rows []importRow) {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"line", "outcome", "release_id", "artist", "title", "reason", "changes"})
+	for _, row := range rows {
+		releaseID := ""
+		if row.ReleaseID != 0 {
+			releaseID = strconv.Itoa(row.ReleaseID)
+		}
+		writer.Write([]string{strconv.Itoa(row.Row), row.Outcome, releaseID, row.Artist, row.Title, row.Reason, formatChanges(row.Changes)})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Error writing import report: %v", err)
+	}
+}
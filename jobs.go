@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job statuses. Jobs start as running and end in one of the other statuses;
+// jobs still running when the application stopped are marked interrupted.
+const (
+	jobRunning     = "running"
+	jobCompleted   = "completed"
+	jobFailed      = "failed"
+	jobCancelled   = "cancelled"
+	jobInterrupted = "interrupted"
+)
+
+// Job kinds
+const (
+	jobKindScrape = "scrape"
+	jobKindImport = "import"
+	jobKindSync   = "sync"
+)
+
+// jobLogLines is how many log lines of a running job are kept for clients
+// connecting to its event stream late.
+const jobLogLines = 200
+
+// jobSaveInterval throttles how often progress is written to the jobs table.
+const jobSaveInterval = time.Second
+
+var errJobNotFound = errors.New("job not found")
+var errJobAlreadyRunning = errors.New("another job changing the collection is already running")
+
+// Job is a background scrape or import, persisted in the jobs table.
+type Job struct {
+	ID         int        `json:"id"`
+	Kind       string     `json:"kind"`
+	Status     string     `json:"status"`
+	Total      int        `json:"total"`
+	Processed  int        `json:"processed"`
+	Failed     int        `json:"failed"`
+	Current    string     `json:"current"` // Item being processed, not persisted
+	Message    string     `json:"message"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+// Finished reports whether the job has stopped, for whatever reason.
+func (j Job) Finished() bool {
+	return j.Status != jobRunning
+}
+
+// Percent is the share of processed items, used by the progress bars.
+func (j Job) Percent() int {
+	if j.Total == 0 {
+		return 0
+	}
+	return j.Processed * 100 / j.Total
+}
+
+// JobStore persists the job history.
+type JobStore interface {
+	CreateJob(kind string) (*Job, error)
+	SaveJob(job Job) error
+	GetJob(id int) (*Job, error)
+	ListJobs(limit int) ([]Job, error)
+	RunningJobs() ([]Job, error) // Also the ones of other processes, i.e. a sync-discogs command
+	InterruptRunningJobs() (int, error)
+
+	// Import reports, the outcome of every row of an import job
+	SaveImportRows(jobID int, rows []importRow) error
+	ImportRows(jobID int) ([]importRow, error)
+}
+
+// jobStore is the JobStore used by the application, set up with store.
+var jobStore JobStore
+
+// jobEvent is sent to event stream subscribers on every change of a job.
+type jobEvent struct {
+	Job  Job    `json:"job"`
+	Line string `json:"line,omitempty"`
+}
+
+// jobContext is handed to the work function of a running job to report
+// progress and check for cancellation.
+type jobContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	job         Job
+	lines       []string
+	subscribers map[chan jobEvent]bool
+	lastSaved   time.Time
+	finalSave   bool // Only save the finished job
+}
+
+// ID is the ID of the job in the jobs table.
+func (j *jobContext) ID() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.job.ID
+}
+
+// Err returns context.Canceled once the job has been cancelled. Work
+// functions check it between items and return it to stop.
+func (j *jobContext) Err() error {
+	return j.ctx.Err()
+}
+
+// SetTotal sets the number of items the job is going to process.
+func (j *jobContext) SetTotal(total int) {
+	j.update(func(job *Job) { job.Total = total }, "")
+}
+
+// Start marks an item as being processed.
+func (j *jobContext) Start(item string) {
+	j.update(func(job *Job) { job.Current = item }, "")
+}
+
+// Done marks an item as processed, counting it as failed when err is set.
+func (j *jobContext) Done(item string, err error) {
+	line := ""
+	if err != nil {
+		line = fmt.Sprintf("%s: %v", item, err)
+	}
+	j.update(func(job *Job) {
+		job.Processed++
+		if err != nil {
+			job.Failed++
+		}
+	}, line)
+}
+
+// SaveOnlyWhenFinished stops saving progress to the jobs table until the job
+// finishes, for jobs holding a write transaction. Progress is still streamed.
+func (j *jobContext) SaveOnlyWhenFinished() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finalSave = true
+}
+
+// Logf adds a line to the job log streamed to the admin page.
+func (j *jobContext) Logf(format string, args ...interface{}) {
+	j.update(func(job *Job) {}, fmt.Sprintf(format, args...))
+}
+
+// snapshot returns a copy of the job along with the log so far.
+func (j *jobContext) snapshot() (Job, []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.job, append([]string(nil), j.lines...)
+}
+
+func (j *jobContext) update(change func(job *Job), line string) {
+	j.mu.Lock()
+	change(&j.job)
+	if line != "" {
+		j.lines = append(j.lines, line)
+		if len(j.lines) > jobLogLines {
+			j.lines = j.lines[len(j.lines)-jobLogLines:]
+		}
+	}
+	job := j.job
+	save := job.Finished() || (!j.finalSave && time.Since(j.lastSaved) >= jobSaveInterval)
+	if save {
+		j.lastSaved = time.Now()
+	}
+	for ch := range j.subscribers {
+		select {
+		case ch <- jobEvent{Job: job, Line: line}:
+		default:
+			// Slow subscriber, drop its oldest event so the latest state gets through
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- jobEvent{Job: job, Line: line}
+		}
+	}
+	if job.Finished() {
+		for ch := range j.subscribers {
+			close(ch)
+		}
+		j.subscribers = nil
+	}
+	j.mu.Unlock()
+
+	if save {
+		if err := jobStore.SaveJob(job); err != nil {
+			log.Printf("Error saving job %d: %v", job.ID, err)
+		}
+	}
+}
+
+// subscribe returns a channel receiving the job events, closed when the job
+// finishes, along with the current state to render first.
+func (j *jobContext) subscribe() (chan jobEvent, Job, []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ch := make(chan jobEvent, 64)
+	if j.job.Finished() {
+		close(ch)
+	} else {
+		j.subscribers[ch] = true
+	}
+	return ch, j.job, append([]string(nil), j.lines...)
+}
+
+func (j *jobContext) unsubscribe(ch chan jobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.subscribers[ch]; ok {
+		delete(j.subscribers, ch)
+		close(ch)
+	}
+}
+
+// releaseJobKinds are the kinds of jobs writing releases. Only one of them
+// runs at a time, a scrape and an import or sync would otherwise fight over
+// the same rows.
+var releaseJobKinds = []string{jobKindScrape, jobKindImport, jobKindSync}
+
+// jobsConflict reports whether jobs of two kinds cannot run at the same time.
+func jobsConflict(a, b string) bool {
+	return a == b || (containsString(releaseJobKinds, a) && containsString(releaseJobKinds, b))
+}
+
+// jobRunner keeps track of the running jobs, starting a job only when no
+// conflicting one runs.
+type jobRunner struct {
+	mu   sync.Mutex
+	jobs map[int]*jobContext
+}
+
+var jobs = &jobRunner{jobs: make(map[int]*jobContext)}
+
+// start creates a job and runs work in the background. The string returned by
+// work becomes the job message.
+func (r *jobRunner) start(kind string, work func(j *jobContext) (string, error)) (*Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, running := range r.jobs {
+		if jobsConflict(running.job.Kind, kind) {
+			return nil, errJobAlreadyRunning
+		}
+	}
+	// The server and the sync-discogs command share the jobs table
+	running, err := jobStore.RunningJobs()
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range running {
+		if jobsConflict(job.Kind, kind) {
+			return nil, errJobAlreadyRunning
+		}
+	}
+
+	job, err := jobStore.CreateJob(kind)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	job.StartedAt = &now
+	if err := jobStore.SaveJob(*job); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &jobContext{ctx: ctx, cancel: cancel, job: *job, subscribers: make(map[chan jobEvent]bool), lastSaved: now}
+	r.jobs[job.ID] = j
+	log.Printf("Started %s job %d", kind, job.ID)
+
+	go func() {
+		defer cancel()
+		message, err := work(j)
+
+		status := jobCompleted
+		switch {
+		case errors.Is(err, context.Canceled):
+			status = jobCancelled
+			message = "Cancelled. " + message
+		case err != nil:
+			status = jobFailed
+			message = err.Error()
+		}
+
+		// Saved before leaving the running jobs so readers never see a stale row
+		finished := time.Now().UTC()
+		j.update(func(job *Job) {
+			job.Status = status
+			job.Message = strings.TrimSpace(message)
+			job.Current = ""
+			job.FinishedAt = &finished
+		}, "")
+
+		r.mu.Lock()
+		delete(r.jobs, job.ID)
+		r.mu.Unlock()
+		log.Printf("Job %d (%s) %s: %s", job.ID, kind, status, message)
+	}()
+
+	return job, nil
+}
+
+// running returns the context of a running job, or nil.
+func (r *jobRunner) running(id int) *jobContext {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.jobs[id]
+}
+
+// get returns the live state of a running job, or the stored one.
+func (r *jobRunner) get(id int) (*Job, error) {
+	if j := r.running(id); j != nil {
+		job, _ := j.snapshot()
+		return &job, nil
+	}
+	return jobStore.GetJob(id)
+}
+
+// list returns the most recent jobs, with live progress for running ones.
+func (r *jobRunner) list(limit int) ([]Job, error) {
+	history, err := jobStore.ListJobs(limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range history {
+		if j := r.running(history[i].ID); j != nil {
+			history[i], _ = j.snapshot()
+		}
+	}
+	return history, nil
+}
+
+// cancel asks a running job to stop. It returns false when the job is not running.
+func (r *jobRunner) cancel(id int) bool {
+	j := r.running(id)
+	if j == nil {
+		return false
+	}
+	j.cancel()
+	j.Logf("Cancelling...")
+	return true
+}
+
+// wait blocks until a job finishes, passing its log lines to onLine, and
+// returns the finished job. Used by commands running jobs in the foreground.
+func (r *jobRunner) wait(id int, onLine func(line string)) (*Job, error) {
+	if j := r.running(id); j != nil {
+		events, _, lines := j.subscribe()
+		for _, line := range lines {
+			onLine(line)
+		}
+		for event := range events {
+			if event.Line != "" {
+				onLine(event.Line)
+			}
+		}
+	}
+
+	// The job is saved before it leaves the running jobs, so this is final
+	for r.running(id) != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return jobStore.GetJob(id)
+}
+
+// recoverInterruptedJobs marks jobs left running by a previous process.
+func recoverInterruptedJobs() {
+	n, err := jobStore.InterruptRunningJobs()
+	if err != nil {
+		log.Printf("Error marking interrupted jobs: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Marked %d unfinished jobs as interrupted", n)
+	}
+}
+
+// jobsHandler serves /jobs/{id}/events, a Server-Sent Events stream of the
+// job progress, and POST /jobs/{id}/cancel.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	switch parts[1] {
+	case "events":
+		jobEventsHandler(w, r, id)
+	case "report":
+		importReportHandler(w, r, id)
+	case "cancel":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !jobs.cancel(id) {
+			http.Error(w, "Job is not running", http.StatusConflict)
+			return
+		}
+		w.Write([]byte("Cancelling..."))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJobEvent(w http.ResponseWriter, name string, event jobEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding job event: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// jobEventsHandler streams "progress" events until the job finishes, then
+// sends a final "done" event. Finished jobs get the "done" event right away.
+func jobEventsHandler(w http.ResponseWriter, r *http.Request, id int) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	j := jobs.running(id)
+	if j == nil {
+		job, err := jobStore.GetJob(id)
+		if err != nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		writeJobEvent(w, "done", jobEvent{Job: *job})
+		return
+	}
+
+	events, job, lines := j.subscribe()
+	defer j.unsubscribe(events)
+
+	// Replay the log so far so late subscribers see the whole picture
+	writeJobEvent(w, "progress", jobEvent{Job: job})
+	for _, line := range lines {
+		writeJobEvent(w, "progress", jobEvent{Job: job, Line: line})
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				writeJobEvent(w, "done", jobEvent{Job: job})
+				return
+			}
+			job = event.Job
+			writeJobEvent(w, "progress", event)
+		}
+	}
+}
+
+// renderJob writes the job partial the admin page swaps in after starting a job.
+func renderJob(w http.ResponseWriter, job *Job) {
+	if err := Templates.ExecuteTemplate(w, "job", job); err != nil {
+		log.Printf("Error rendering job template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
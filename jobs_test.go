@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReleaseJobsRunOneAtATime(t *testing.T) {
+	s := newMemoryStore()
+	store, jobStore, changeStore = s, s, s
+
+	release := make(chan struct{})
+	scrape, err := jobs.start(jobKindScrape, func(j *jobContext) (string, error) {
+		<-release
+		return "done", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kind := range releaseJobKinds {
+		if _, err := jobs.start(kind, func(j *jobContext) (string, error) { return "", nil }); !errors.Is(err, errJobAlreadyRunning) {
+			t.Errorf("starting a %s job during a scrape = %v, want %v", kind, err, errJobAlreadyRunning)
+		}
+	}
+
+	close(release)
+	if _, err := jobs.wait(scrape.ID, func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	sync, err := jobs.start(jobKindSync, func(j *jobContext) (string, error) { return "done", nil })
+	if err != nil {
+		t.Fatalf("starting a sync once the scrape is done: %v", err)
+	}
+	if _, err := jobs.wait(sync.ID, func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReleaseJobsOfOtherProcesses starts a sync while the jobs table has an
+// import running elsewhere, as when sync-discogs runs next to the server.
+func TestReleaseJobsOfOtherProcesses(t *testing.T) {
+	s := newMemoryStore()
+	store, jobStore, changeStore = s, s, s
+
+	other, err := s.CreateJob(jobKindImport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.start(jobKindSync, func(j *jobContext) (string, error) { return "", nil }); !errors.Is(err, errJobAlreadyRunning) {
+		t.Errorf("starting a sync during another process' import = %v, want %v", err, errJobAlreadyRunning)
+	}
+
+	other.Status = jobCompleted
+	if err := s.SaveJob(*other); err != nil {
+		t.Fatal(err)
+	}
+	sync, err := jobs.start(jobKindSync, func(j *jobContext) (string, error) { return "done", nil })
+	if err != nil {
+		t.Fatalf("starting a sync once the import is done: %v", err)
+	}
+	if _, err := jobs.wait(sync.ID, func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gocolly/colly"
+)
+
+// lastFMProvider scrapes the album pages of Last.fm for the release date,
+// tags and cover. LASTFM_BASE_URL points it elsewhere, i.e. to a mirror or a
+// local copy of the pages.
+type lastFMProvider struct {
+	baseURL *url.URL
+}
+
+func newLastFMProvider() (MetadataProvider, error) {
+	baseURL, err := url.Parse(getEnvWithDefault("LASTFM_BASE_URL", "https://www.last.fm"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LASTFM_BASE_URL: %v", err)
+	}
+	return &lastFMProvider{baseURL: baseURL}, nil
+}
+
+func (p *lastFMProvider) Name() string { return "lastfm" }
+
+func (p *lastFMProvider) createCollector() *colly.Collector {
+	return colly.NewCollector(
+		colly.AllowedDomains(p.baseURL.Host),
+	)
+}
+
+// Lookup visits the album page of the release, Last.fm only knows releases by
+// artist and title.
+func (p *lastFMProvider) Lookup(ctx context.Context, release Release) (*Metadata, error) {
+	metadata := &Metadata{}
+	var visitErr error
+
+	c := p.createCollector()
+
+	c.OnHTML("a.cover-art img", func(e *colly.HTMLElement) {
+		if src := e.Attr("src"); src != "" {
+			if coverURL, err := p.resolve(src); err == nil {
+				metadata.CoverURLs = append(metadata.CoverURLs, coverURL)
+			}
+		}
+	})
+
+	c.OnHTML(".catalogue-metadata-description", func(e *colly.HTMLElement) {
+		if year := parseLastFMYear(e.Text); year > 0 && metadata.Year == 0 {
+			metadata.Year = year
+		}
+	})
+
+	c.OnHTML("a[href*='/tag/']", func(e *colly.HTMLElement) {
+		if tag := strings.TrimSpace(e.Text); tag != "" {
+			metadata.Tags = append(metadata.Tags, tag)
+		}
+	})
+
+	c.OnError(func(r *colly.Response, err error) {
+		if r.StatusCode == 404 {
+			visitErr = errNoMetadata
+			return
+		}
+		visitErr = fmt.Errorf("error fetching %s: %v", r.Request.URL, err)
+	})
+
+	albumURL := p.buildURL(release)
+	if err := c.Visit(albumURL); err != nil && visitErr == nil {
+		return nil, fmt.Errorf("error visiting %s: %v", albumURL, err)
+	}
+	if visitErr != nil {
+		return nil, visitErr
+	}
+
+	if metadata.Year == 0 && len(metadata.Tags) == 0 && len(metadata.CoverURLs) == 0 {
+		return nil, errNoMetadata
+	}
+	return metadata, nil
+}
+
+// buildURL returns the album page, i.e. https://www.last.fm/music/Björk/Début
+func (p *lastFMProvider) buildURL(release Release) string {
+	artist := strings.TrimSpace(release.Artist)
+	artist = strings.ReplaceAll(artist, " ", "+")
+	title := strings.TrimSpace(release.Title)
+	title = strings.ReplaceAll(title, " ", "+")
+	artist = strings.TrimRight(artist, "+")
+	title = strings.TrimRight(title, "+")
+	return fmt.Sprintf("%s/music/%s/%s", strings.TrimRight(p.baseURL.String(), "/"), artist, title)
+}
+
+// resolve makes relative image sources absolute.
+func (p *lastFMProvider) resolve(src string) (string, error) {
+	parsedURL, err := url.Parse(src)
+	if err != nil {
+		return "", err
+	}
+	return p.baseURL.ResolveReference(parsedURL).String(), nil
+}
+
+// parseLastFMYear reads the year of release dates such as "12 June 1993" or "1993".
+func parseLastFMYear(dateStr string) int {
+	dateStr = strings.TrimSpace(dateStr)
+	if dateStr == "" {
+		return 0
+	}
+	parts := strings.Split(dateStr, " ")
+	year, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return 0
+	}
+	return year
+}
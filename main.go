@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
 )
 
 // Helper functions
@@ -37,6 +39,10 @@ func init() {
 		"slice": func(values ...interface{}) []interface{} {
 			return values
 		},
+		"add": func(a, b int) int {
+			return a + b
+		},
+		"contains": containsString,
 	})
 
 	// Enable more detailed error reporting for templates
@@ -51,6 +57,17 @@ func init() {
 		"web/templates/edit.html",
 		"web/templates/admin.html",
 		"web/templates/sorting.html",
+		"web/templates/pagination.html",
+		"web/templates/job.html",
+		"web/templates/import_preview.html",
+		"web/templates/import_report.html",
+		"web/templates/reclassify.html",
+		"web/templates/tracks.html",
+		"web/templates/release_detail.html",
+		"web/templates/new_release.html",
+		"web/templates/remove_release.html",
+		"web/templates/former.html",
+		"web/templates/history.html",
 		"web/templates/stats.html", // Add the new stats template
 	}
 
@@ -62,8 +79,35 @@ func init() {
 	log.Printf("Templates loaded successfully")
 }
 
+// runCommand dispatches command line subcommands.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "migrate":
+		openDB()
+		return runMigrateCommand(args)
+	case "copy-db":
+		return runCopyDBCommand(args)
+	case "fixture-server":
+		return runFixtureServerCommand(args)
+	case "sync-discogs":
+		return runSyncDiscogsCommand(args)
+	default:
+		return fmt.Errorf("unknown command: %s", name)
+	}
+}
+
 func main() {
+	// Subcommands run against the database and exit without starting the server
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	initDB()
+	recoverInterruptedJobs()
+	scheduleDiscogsSync()
 
 	// Serve static files
 	fs := http.FileServer(http.Dir("web/static"))
@@ -73,17 +117,30 @@ func main() {
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/admin", adminHandler)
 	http.HandleFunc("/scrape", handleScrape)
+	http.HandleFunc("/sync", handleSync)
+	http.HandleFunc("/reclassify/preview", reclassifyPreviewHandler)
+	http.HandleFunc("/reclassify", reclassifyHandler)
+	http.HandleFunc("/jobs/", jobsHandler)
 	http.HandleFunc("/releases/wanted", wantedReleasesHandler)
 	http.HandleFunc("/releases/need-scraping", needScrapingReleasesHandler)
+	http.HandleFunc("/releases/former", formerReleasesHandler)
+	http.HandleFunc("/releases", releasesHandler)
 	http.HandleFunc("/format/", releasesHandler)
+	http.HandleFunc("/release/new", newReleaseHandler)
 	http.HandleFunc("/release/", releaseHandler)
 	http.HandleFunc("/artist/", releasesHandler)
 	http.HandleFunc("/year/", releasesHandler)
 	http.HandleFunc("/tag/", releasesHandler)
 	http.HandleFunc("/upload", uploadHandler)
 	http.HandleFunc("/upload-wanted", uploadWantedHandler)
+	http.HandleFunc("/import-preview", importPreviewHandler)
+	http.HandleFunc("/import-preview/", importPreviewActionHandler)
 	http.HandleFunc("/search", searchHandler)
 	http.HandleFunc("/stats", statsHandler) // Add the new stats route
+	http.HandleFunc("/history", historyHandler)
+	http.HandleFunc("/history/", historyHandler)
+	http.HandleFunc("/api/v1/", apiHandler)
+	http.HandleFunc("/api/openapi.json", openAPIHandler)
 
 	log.Println("Server started on :8080")
 	if err := http.ListenAndServe(":8080", nil); err != nil {
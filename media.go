@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// ReleaseMedium is one medium of a release, i.e. "2xLP, Album + CD, Album"
+// has a medium with two 12" vinyl records and one with a CD. Media are parsed
+// from the Discogs format string and stored in the release_media table.
+type ReleaseMedium struct {
+	Position     int    `json:"position"` // Order in the format string, from 1
+	Quantity     int    `json:"quantity"`
+	Type         string `json:"type"`         // Vinyl, CD, Cassette, Box Set...
+	Size         string `json:"size"`         // 7", 10", 12" for records
+	Speed        string `json:"speed"`        // 33 ⅓ RPM, 45 RPM, 7 ½ ips
+	Descriptions string `json:"descriptions"` // The other descriptions, i.e. "LP, Album, RE"
+}
+
+// Label describes the medium on release cards, i.e. `2 × Vinyl 12", 45 RPM`.
+func (m ReleaseMedium) Label() string {
+	label := m.Type
+	if m.Quantity > 1 {
+		label = fmt.Sprintf("%d × %s", m.Quantity, label)
+	}
+	if m.Size != "" {
+		label += " " + m.Size
+	}
+	if m.Speed != "" {
+		label += ", " + m.Speed
+	}
+	return label
+}
+
+// containerMediaTypes hold other media and are not counted in the stats,
+// keep them in sync with sqlStore.StatsByFormat.
+var containerMediaTypes = []string{"Box Set", "All Media"}
+
+// Container reports whether the medium holds other media, i.e. a box.
+func (m ReleaseMedium) Container() bool {
+	return containsString(containerMediaTypes, m.Type)
+}
+
+// mediaTypes maps the names used in format strings to the Discogs format names.
+var mediaTypes = map[string]string{
+	"lp": "Vinyl", `7"`: "Vinyl", `10"`: "Vinyl", `12"`: "Vinyl", `16"`: "Vinyl",
+	"cass": "Cassette", "8-trk": "8-Track Cartridge", "box": "Box Set",
+	"minidisc": "Minidisc", "md": "Minidisc",
+}
+
+var (
+	mediaSize  = regexp.MustCompile(`^\d+(\.\d+)?"$`)
+	mediaSpeed = regexp.MustCompile(`(?i)\b(rpm|ips)$`)
+)
+
+// parseReleaseMedia turns a Discogs format string into media.
+func parseReleaseMedia(format string) []ReleaseMedium {
+	var media []ReleaseMedium
+	for i, parsed := range parseDiscogsFormat(format) {
+		medium := ReleaseMedium{Position: i + 1, Quantity: parsed.Quantity, Type: parsed.Name}
+		if mediaType, ok := mediaTypes[strings.ToLower(parsed.Name)]; ok {
+			medium.Type = mediaType
+		}
+
+		var descriptions []string
+		switch {
+		case mediaSize.MatchString(parsed.Name):
+			medium.Size = parsed.Name
+		case strings.EqualFold(parsed.Name, "LP"):
+			descriptions = append(descriptions, "LP")
+		}
+		for _, token := range parsed.Descriptions {
+			switch {
+			case mediaSize.MatchString(token) && medium.Size == "":
+				medium.Size = token
+			case mediaSpeed.MatchString(token) && medium.Speed == "":
+				medium.Speed = token
+			default:
+				descriptions = append(descriptions, token)
+			}
+		}
+		// LPs are 12" unless the format says otherwise
+		if medium.Size == "" && containsString(descriptions, "LP") {
+			medium.Size = `12"`
+		}
+		medium.Descriptions = strings.Join(descriptions, ", ")
+		media = append(media, medium)
+	}
+	return media
+}
+
+// replaceReleaseMedia stores the media of the release with the given id,
+// parsed from its format.
+func replaceReleaseMedia(q dbExecutor, id int, format string) error {
+	if _, err := q.Exec("DELETE FROM release_media WHERE release_ref = $1", id); err != nil {
+		return err
+	}
+	for _, m := range parseReleaseMedia(format) {
+		_, err := q.Exec(`
+			INSERT INTO release_media (release_ref, position, quantity, type, size, speed, descriptions)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			id, m.Position, m.Quantity, m.Type, m.Size, m.Speed, m.Descriptions)
+		if err != nil {
+			log.Printf("Error storing media of release %d: %v", id, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillReleaseMedia parses the media of releases imported before the
+// release_media table existed, run at startup.
+func backfillReleaseMedia() error {
+	rows, err := db.Query(`
+		SELECT id, format FROM releases
+		WHERE format <> '' AND NOT EXISTS (SELECT 1 FROM release_media WHERE release_ref = releases.id)`)
+	if err != nil {
+		return err
+	}
+	formats := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var format string
+		if err := rows.Scan(&id, &format); err != nil {
+			rows.Close()
+			return err
+		}
+		formats[id] = format
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(formats) == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, format := range formats {
+		if err := replaceReleaseMedia(tx, id, format); err != nil {
+			return err
+		}
+	}
+	log.Printf("Stored the media of %d releases", len(formats))
+	return tx.Commit()
+}
+
+// mediaBatchSize keeps the IN lists of attachMedia below the parameter
+// limits of both databases.
+const mediaBatchSize = 500
+
+// attachMedia loads the media of releases from the release_media table.
+func (s *sqlStore) attachMedia(releases []Release) error {
+	index := make(map[int]int, len(releases))
+	for i, r := range releases {
+		index[r.ID] = i
+	}
+
+	for start := 0; start < len(releases); start += mediaBatchSize {
+		batch := releases[start:min(start+mediaBatchSize, len(releases))]
+		placeholders := make([]string, len(batch))
+		args := make([]interface{}, len(batch))
+		for i, r := range batch {
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+			args[i] = r.ID
+		}
+
+		rows, err := s.db.Query(`
+			SELECT release_ref, position, quantity, type, size, speed, descriptions
+			FROM release_media WHERE release_ref IN (`+strings.Join(placeholders, ", ")+`)
+			ORDER BY release_ref, position`, args...)
+		if err != nil {
+			log.Printf("Error querying release media: %v", err)
+			return err
+		}
+		for rows.Next() {
+			var id int
+			var m ReleaseMedium
+			if err := rows.Scan(&id, &m.Position, &m.Quantity, &m.Type, &m.Size, &m.Speed, &m.Descriptions); err != nil {
+				rows.Close()
+				return err
+			}
+			r := &releases[index[id]]
+			r.Media = append(r.Media, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseReleaseMedia(t *testing.T) {
+	tests := []struct {
+		format string
+		want   []ReleaseMedium
+	}{
+		{"LP, Album, RE", []ReleaseMedium{
+			{Position: 1, Quantity: 1, Type: "Vinyl", Size: `12"`, Descriptions: "LP, Album, RE"},
+		}},
+		{`3xLP, Album + 7", 45 RPM`, []ReleaseMedium{
+			{Position: 1, Quantity: 3, Type: "Vinyl", Size: `12"`, Descriptions: "LP, Album"},
+			{Position: 2, Quantity: 1, Type: "Vinyl", Size: `7"`, Speed: "45 RPM"},
+		}},
+		// Media listed with commas only
+		{"2xLP, CD", []ReleaseMedium{
+			{Position: 1, Quantity: 2, Type: "Vinyl", Size: `12"`, Descriptions: "LP"},
+			{Position: 2, Quantity: 1, Type: "CD"},
+		}},
+		{"LP, Album, 2xCD, Comp", []ReleaseMedium{
+			{Position: 1, Quantity: 1, Type: "Vinyl", Size: `12"`, Descriptions: "LP, Album"},
+			{Position: 2, Quantity: 2, Type: "CD", Descriptions: "Comp"},
+		}},
+		// Format names followed by LP or a size are one medium
+		{"Vinyl, LP, Album", []ReleaseMedium{
+			{Position: 1, Quantity: 1, Type: "Vinyl", Size: `12"`, Descriptions: "LP, Album"},
+		}},
+		{`Shellac, 10", 78 RPM`, []ReleaseMedium{
+			{Position: 1, Quantity: 1, Type: "Shellac", Size: `10"`, Speed: "78 RPM"},
+		}},
+		{"Box Set, Comp + 5xCD", []ReleaseMedium{
+			{Position: 1, Quantity: 1, Type: "Box Set", Descriptions: "Comp"},
+			{Position: 2, Quantity: 5, Type: "CD"},
+		}},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			if got := parseReleaseMedia(tt.format); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseReleaseMedia(%q) = %+v, want %+v", tt.format, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,753 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is an in-memory ReleaseStore, meant for handler tests and
+// trying the UI without a database.
+type memoryStore struct {
+	mu       sync.Mutex
+	releases []Release
+	nextID   int
+	jobs     []Job
+	imports  map[int][]importRow // Import reports by job ID
+	changes  []ReleaseChange
+}
+
+func newMemoryStore(releases ...Release) *memoryStore {
+	s := &memoryStore{nextID: 1}
+	for _, r := range releases {
+		if r.ID == 0 {
+			r.ID = s.nextID
+		}
+		if r.ID >= s.nextID {
+			s.nextID = r.ID + 1
+		}
+		if r.Media == nil {
+			r.Media = parseReleaseMedia(r.Format)
+		}
+		s.releases = append(s.releases, r)
+	}
+	return s
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(unaccent(s)), strings.ToLower(unaccent(substr)))
+}
+
+func matchesQuery(r Release, q ReleaseQuery) bool {
+	if q.Artist != "" {
+		found := false
+		for _, a := range strings.Split(q.Artist, "/") {
+			if strings.Contains(r.Artist, a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.ExactArtist != "" && r.Artist != q.ExactArtist {
+		return false
+	}
+	if q.Year != 0 && r.Year != q.Year {
+		return false
+	}
+	if q.Tag != "" && !containsString(r.Tags, q.Tag) {
+		return false
+	}
+	if q.Physical != "" && r.Physical != q.Physical {
+		return false
+	}
+	if q.Label != "" && r.Label != q.Label {
+		return false
+	}
+	if q.Wanted != nil && r.Wanted != *q.Wanted {
+		return false
+	}
+	if q.ExcludeID != 0 && r.ID == q.ExcludeID {
+		return false
+	}
+	if !matchesStatus(r, q.Status) {
+		return false
+	}
+	if q.NeedScraping && r.Year != 0 && len(r.Tags) > 0 && r.CoverImage != "" {
+		return false
+	}
+	if q.Search != "" &&
+		!containsFold(r.Title, q.Search) &&
+		!containsFold(r.Artist, q.Search) &&
+		!strings.Contains(strconv.Itoa(r.Year), q.Search) &&
+		!containsFold(r.Physical, q.Search) &&
+		!hasTrackMatching(r.Tracks, q.Search) {
+		return false
+	}
+	return true
+}
+
+// matchesStatus applies the Status filter of a ReleaseQuery.
+func matchesStatus(r Release, status string) bool {
+	switch status {
+	case "":
+		return r.Status == ""
+	case "former":
+		return r.Status != ""
+	case "all":
+		return true
+	}
+	return r.Status == status
+}
+
+func hasTrackMatching(tracks []Track, search string) bool {
+	for _, t := range tracks {
+		if containsFold(t.Title, search) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// compareByField compares two releases on one of the sortable fields.
+func compareByField(a, b Release, field string) int {
+	switch field {
+	case "year":
+		return a.Year - b.Year
+	case "title":
+		return strings.Compare(a.Title, b.Title)
+	case "artist":
+		return strings.Compare(a.Artist, b.Artist)
+	case "physical":
+		return strings.Compare(a.Physical, b.Physical)
+	case "date_added":
+		return strings.Compare(a.DateAdded, b.DateAdded)
+	case "label":
+		return strings.Compare(a.Label, b.Label)
+	case "rating":
+		return strings.Compare(a.Rating, b.Rating)
+	case "catalog_number":
+		return strings.Compare(a.CatalogNumber, b.CatalogNumber)
+	case "status_date":
+		return strings.Compare(a.StatusDate, b.StatusDate)
+	}
+	return 0
+}
+
+func (s *memoryStore) ListReleases(q ReleaseQuery) ([]Release, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var releases []Release
+	for _, r := range s.releases {
+		if matchesQuery(r, q) {
+			r.Tracks = nil // Only loaded by GetRelease, like sqlStore
+			releases = append(releases, r)
+		}
+	}
+
+	sort.Slice(releases, func(i, j int) bool {
+		for _, key := range q.Sort {
+			c := compareByField(releases[i], releases[j], key.Field)
+			if key.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return releases[i].ID < releases[j].ID
+	})
+
+	if q.Offset > 0 {
+		if q.Offset >= len(releases) {
+			return nil, nil
+		}
+		releases = releases[q.Offset:]
+	}
+	if q.Limit > 0 && q.Limit < len(releases) {
+		releases = releases[:q.Limit]
+	}
+	return releases, nil
+}
+
+func (s *memoryStore) CountReleases(q ReleaseQuery) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, r := range s.releases {
+		if matchesQuery(r, q) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// find returns a pointer to the stored release, callers must hold the lock.
+func (s *memoryStore) find(id int) (*Release, error) {
+	for i := range s.releases {
+		if s.releases[i].ID == id {
+			return &s.releases[i], nil
+		}
+	}
+	return nil, errReleaseNotFound
+}
+
+func (s *memoryStore) GetRelease(id int) (*Release, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.find(id)
+	if err != nil {
+		return nil, err
+	}
+	release := *r
+	release.Tags = append([]string(nil), r.Tags...)
+	release.EditedFields = append([]string(nil), r.EditedFields...)
+	release.Tracks = append([]Track(nil), r.Tracks...)
+	return &release, nil
+}
+
+func (s *memoryStore) CreateRelease(r Release) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.releases {
+		if existing.ReleaseID == r.ReleaseID {
+			return existing.ID, errReleaseExists
+		}
+	}
+	r.ID = s.nextID
+	s.nextID++
+	if r.Physical == "" {
+		r.Physical = determinePhysicalFormat(r.Format)
+	}
+	r.Media = parseReleaseMedia(r.Format)
+	r.Tags = append([]string(nil), r.Tags...)
+	r.Tracks = append([]Track(nil), r.Tracks...)
+	s.releases = append(s.releases, r)
+	return r.ID, nil
+}
+
+func (s *memoryStore) UpdateRelease(id int, u ReleaseUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	updated := applyReleaseUpdate(*r, u)
+	if updated.Format != r.Format {
+		updated.Media = parseReleaseMedia(updated.Format)
+	}
+	*r = updated
+	return nil
+}
+
+func (s *memoryStore) UpdateImportedRelease(r Release) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.find(r.ID)
+	if err != nil {
+		return err
+	}
+	for _, field := range importFields {
+		*field.get(existing) = *field.get(&r)
+	}
+	existing.Wanted = r.Wanted
+	existing.Physical = r.Physical
+	existing.Media = parseReleaseMedia(r.Format)
+	return nil
+}
+
+func (s *memoryStore) DeleteRelease(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deleteRelease(id)
+}
+
+// deleteRelease removes a release, callers must hold the lock.
+func (s *memoryStore) deleteRelease(id int) error {
+	for i := range s.releases {
+		if s.releases[i].ID == id {
+			s.releases = append(s.releases[:i], s.releases[i+1:]...)
+			return nil
+		}
+	}
+	return errReleaseNotFound
+}
+
+func (s *memoryStore) RenameArtist(oldArtist, newArtist string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.releases {
+		if s.releases[i].Artist == oldArtist {
+			s.releases[i].Artist = newArtist
+			s.releases[i].EditedFields = addFields(s.releases[i].EditedFields, "artist")
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SetScrapedData(releaseID int, tags []string, year int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updated := false
+	for i := range s.releases {
+		if s.releases[i].ReleaseID == releaseID {
+			s.releases[i].Tags = append([]string(nil), tags...)
+			s.releases[i].Year = year
+			updated = true
+		}
+	}
+	return updated, nil
+}
+
+func (s *memoryStore) SetScrapedDetails(releaseID int, released, label string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updated := false
+	for i := range s.releases {
+		if s.releases[i].ReleaseID == releaseID {
+			if released != "" {
+				s.releases[i].Released = released
+			}
+			if label != "" {
+				s.releases[i].Label = label
+			}
+			updated = true
+		}
+	}
+	return updated, nil
+}
+
+func (s *memoryStore) SetPhysical(physical map[int]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range physical {
+		if _, err := s.find(id); err != nil {
+			return err
+		}
+	}
+	for id, value := range physical {
+		r, _ := s.find(id)
+		r.Physical = value
+	}
+	return nil
+}
+
+func (s *memoryStore) SetTracks(id int, tracks []Track, edited bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	r.Tracks = append([]Track(nil), tracks...)
+	if edited {
+		r.EditedFields = addFields(r.EditedFields, "tracks")
+	}
+	return nil
+}
+
+func (s *memoryStore) SetWanted(id int, wanted bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	r.Wanted = wanted
+	return nil
+}
+
+func (s *memoryStore) SetStatus(id int, status ReleaseStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	r.Status = status.Status
+	r.StatusDate = status.Date
+	r.SalePrice = status.Price
+	r.StatusNote = status.Note
+	return nil
+}
+
+func (s *memoryStore) SetCoverImage(id int, coverImage string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	r.CoverImage = coverImage
+	return nil
+}
+
+func (s *memoryStore) AddTag(id int, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	if !containsString(r.Tags, tag) {
+		r.Tags = append(r.Tags, tag)
+	}
+	return nil
+}
+
+func (s *memoryStore) RemoveTag(id int, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	var tags []string
+	for _, t := range r.Tags {
+		if t != tag {
+			tags = append(tags, t)
+		}
+	}
+	r.Tags = tags
+	return nil
+}
+
+// countOwned groups owned releases by the label returned from key, skipping
+// empty labels and the archived and sold releases.
+func (s *memoryStore) countOwned(key func(Release) string) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, r := range s.releases {
+		if r.Wanted || r.Status != "" {
+			continue
+		}
+		if label := key(r); label != "" {
+			counts[label]++
+		}
+	}
+	return counts
+}
+
+func sortedStats(counts map[string]int, less func(a, b StatItem) bool) []StatItem {
+	var stats []StatItem
+	for label, count := range counts {
+		stats = append(stats, StatItem{Label: label, Count: count})
+	}
+	sort.Slice(stats, func(i, j int) bool { return less(stats[i], stats[j]) })
+	return stats
+}
+
+func byCountDesc(a, b StatItem) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	return a.Label < b.Label
+}
+
+func (s *memoryStore) TagCounts() ([]StatItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, r := range s.releases {
+		if r.Status != "" {
+			continue
+		}
+		for _, tag := range r.Tags {
+			counts[tag]++
+		}
+	}
+	return sortedStats(counts, byCountDesc), nil
+}
+
+func (s *memoryStore) ArtistCounts() ([]StatItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, r := range s.releases {
+		if r.Artist != "" && r.Status == "" {
+			counts[r.Artist]++
+		}
+	}
+	return sortedStats(counts, func(a, b StatItem) bool { return a.Label < b.Label }), nil
+}
+
+func (s *memoryStore) StatsByDecade() ([]StatItem, error) {
+	counts := s.countOwned(func(r Release) string {
+		if r.Year <= 0 {
+			return ""
+		}
+		return strconv.Itoa((r.Year/10)*10) + "s"
+	})
+	return sortedStats(counts, func(a, b StatItem) bool { return a.Label < b.Label }), nil
+}
+
+func (s *memoryStore) StatsByFormat() ([]StatItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, r := range s.releases {
+		if r.Wanted || r.Status != "" {
+			continue
+		}
+		counted := false
+		for _, m := range r.Media {
+			if !m.Container() {
+				counts[m.Type] += m.Quantity
+				counted = true
+			}
+		}
+		if !counted {
+			counts["Unknown"]++
+		}
+	}
+	return sortedStats(counts, byCountDesc), nil
+}
+
+func (s *memoryStore) StatsTopArtists() ([]StatItem, error) {
+	stats := sortedStats(s.countOwned(func(r Release) string { return r.Artist }), byCountDesc)
+	if len(stats) > 20 {
+		stats = stats[:20]
+	}
+	return stats, nil
+}
+
+func (s *memoryStore) CreateJob(kind string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := Job{ID: len(s.jobs) + 1, Kind: kind, Status: jobRunning, CreatedAt: time.Now().UTC()}
+	s.jobs = append(s.jobs, job)
+	return &job, nil
+}
+
+func (s *memoryStore) SaveJob(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job.ID < 1 || job.ID > len(s.jobs) {
+		return errJobNotFound
+	}
+	job.Current = ""
+	s.jobs[job.ID-1] = job
+	return nil
+}
+
+func (s *memoryStore) GetJob(id int) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > len(s.jobs) {
+		return nil, errJobNotFound
+	}
+	job := s.jobs[id-1]
+	return &job, nil
+}
+
+func (s *memoryStore) ListJobs(limit int) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []Job
+	for i := len(s.jobs) - 1; i >= 0 && len(jobs) < limit; i-- {
+		jobs = append(jobs, s.jobs[i])
+	}
+	return jobs, nil
+}
+
+func (s *memoryStore) RunningJobs() ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []Job
+	for _, job := range s.jobs {
+		if job.Status == jobRunning {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+func (s *memoryStore) InterruptRunningJobs() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	now := time.Now().UTC()
+	for i := range s.jobs {
+		if s.jobs[i].Status == jobRunning {
+			s.jobs[i].Status = jobInterrupted
+			s.jobs[i].FinishedAt = &now
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) SaveImportRows(jobID int, rows []importRow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.imports == nil {
+		s.imports = make(map[int][]importRow)
+	}
+	s.imports[jobID] = append(s.imports[jobID], rows...)
+	return nil
+}
+
+func (s *memoryStore) ImportRows(jobID int) ([]importRow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]importRow(nil), s.imports[jobID]...), nil
+}
+
+// saveRelease writes every field of a release back, adding it again when it
+// was deleted, callers must hold the lock.
+func (s *memoryStore) saveRelease(r Release) error {
+	for _, existing := range s.releases {
+		if existing.ReleaseID == r.ReleaseID && existing.ID != r.ID {
+			return errReleaseExists
+		}
+	}
+	r.Media = parseReleaseMedia(r.Format)
+	r.Tags = append([]string(nil), r.Tags...)
+	r.Tracks = append([]Track(nil), r.Tracks...)
+	if existing, err := s.find(r.ID); err == nil {
+		*existing = r
+		return nil
+	}
+	s.releases = append(s.releases, r)
+	if r.ID >= s.nextID {
+		s.nextID = r.ID + 1
+	}
+	return nil
+}
+
+func (s *memoryStore) AddChange(c ReleaseChange) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.ID = len(s.changes) + 1
+	s.changes = append(s.changes, c)
+	return c.ID, nil
+}
+
+func (s *memoryStore) GetChange(id int) (*ReleaseChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > len(s.changes) {
+		return nil, errChangeNotFound
+	}
+	c := s.changes[id-1]
+	return &c, nil
+}
+
+func (s *memoryStore) ListChanges(q ChangeQuery) ([]ReleaseChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changes []ReleaseChange
+	for i := len(s.changes) - 1; i >= 0; i-- {
+		c := s.changes[i]
+		if (q.ReleaseRef != 0 && c.ReleaseRef != q.ReleaseRef) || (q.Batch != "" && c.Batch != q.Batch) {
+			continue
+		}
+		changes = append(changes, c)
+		if q.Limit > 0 && len(changes) == q.Limit {
+			break
+		}
+	}
+	return changes, nil
+}
+
+func (s *memoryStore) DeleteAndLog(c ReleaseChange) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.deleteRelease(c.ReleaseRef); err != nil {
+		return 0, err
+	}
+	c.ID = len(s.changes) + 1
+	s.changes = append(s.changes, c)
+	return c.ID, nil
+}
+
+func (s *memoryStore) Undo(steps []undoStep) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Put back on failure, like a rolled back transaction
+	releases := append([]Release(nil), s.releases...)
+	changes := append([]ReleaseChange(nil), s.changes...)
+	nextID := s.nextID
+	ids, err := s.undo(steps)
+	if err != nil {
+		s.releases, s.changes, s.nextID = releases, changes, nextID
+	}
+	return ids, err
+}
+
+// undo applies the steps of Undo, callers must hold the lock.
+func (s *memoryStore) undo(steps []undoStep) ([]int, error) {
+	ids := make([]int, len(steps))
+	for i, step := range steps {
+		if step.Release == nil {
+			if err := s.deleteRelease(step.Change.ReleaseRef); err != nil {
+				return nil, err
+			}
+		} else if err := s.saveRelease(*step.Release); err != nil {
+			return nil, err
+		}
+
+		if step.Undone < 1 || step.Undone > len(s.changes) {
+			return nil, errChangeNotFound
+		}
+		if s.changes[step.Undone-1].UndoneBy != 0 {
+			return nil, fmt.Errorf("%w: change %d was already undone", errUndoConflict, step.Undone)
+		}
+		c := step.Change
+		c.ID = len(s.changes) + 1
+		s.changes = append(s.changes, c)
+		s.changes[step.Undone-1].UndoneBy = c.ID
+		ids[i] = c.ID
+	}
+	return ids, nil
+}
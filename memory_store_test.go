@@ -0,0 +1,149 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// listingReleases is a small collection covering every ReleaseQuery filter.
+func listingReleases() []Release {
+	return []Release{
+		{ID: 1, ReleaseID: 101, Artist: "Portishead", Title: "Dummy", Label: "Go! Beat", Format: "LP, Album", Physical: "Vinyl",
+			Year: 1994, Rating: "5", DateAdded: "2024-03-09 18:30:00", Tags: []string{"trip hop"}, CoverImage: "101.jpg"},
+		{ID: 2, ReleaseID: 102, Artist: "Portishead", Title: "Third", Label: "Island", Format: "CD, Album", Physical: "CD",
+			Year: 2008, Rating: "4", DateAdded: "2023-05-01 10:00:00", Tags: []string{"trip hop"}, CoverImage: "102.jpg"},
+		{ID: 3, ReleaseID: 103, Artist: "Massive Attack", Title: "Mezzanine", Label: "Virgin", Format: "2xLP, Album", Physical: "Vinyl",
+			Year: 1998, DateAdded: "2024-01-01 09:00:00", Tags: []string{"trip hop", "electronic"}, CoverImage: "103.jpg", Wanted: true},
+		{ID: 4, ReleaseID: 104, Artist: "John Lennon / Yoko Ono", Title: "Double Fantasy", Label: "Geffen", Format: "LP, Album", Physical: "Vinyl",
+			Year: 1980, Rating: "3", DateAdded: "2022-12-08 20:00:00", Tags: []string{"rock"}, CoverImage: "104.jpg"},
+		{ID: 5, ReleaseID: 105, Artist: "Yoko Ono", Title: "Fly", Label: "Apple", Format: "2xLP, Album", Physical: "Vinyl",
+			DateAdded: "2022-12-09 20:00:00"},
+		{ID: 6, ReleaseID: 106, Artist: "Björk", Title: "Début", Label: "One Little Indian", Format: "CD, Album", Physical: "CD",
+			Year: 1993, Rating: "4", DateAdded: "2021-07-05 12:00:00", Tags: []string{"pop"}, CoverImage: "106.jpg",
+			Status: statusArchived, StatusDate: "2024-02-01"},
+		{ID: 7, ReleaseID: 107, Artist: "Massive Attack", Title: "Blue Lines", Label: "Wild Bunch", Format: "CD, Album", Physical: "CD",
+			Year: 1991, Rating: "5", DateAdded: "2020-01-01 12:00:00", Tags: []string{"trip hop"}, CoverImage: "107.jpg",
+			Status: statusSold, StatusDate: "2024-06-01", SalePrice: "12.00"},
+	}
+}
+
+// releaseQueryTests are queries whose results both stores must agree on, by ID.
+var releaseQueryTests = []struct {
+	name  string
+	query ReleaseQuery
+	want  []int
+}{
+	{"everything owned or wanted", ReleaseQuery{}, []int{1, 2, 3, 4, 5}},
+	{"artist", ReleaseQuery{Artist: "Portishead"}, []int{1, 2}},
+	{"alternative artists", ReleaseQuery{Artist: "Lennon/Ono"}, []int{4, 5}},
+	{"exact artist", ReleaseQuery{ExactArtist: "Yoko Ono"}, []int{5}},
+	{"year", ReleaseQuery{Year: 1994}, []int{1}},
+	{"tag", ReleaseQuery{Tag: "trip hop"}, []int{1, 2, 3}},
+	{"physical", ReleaseQuery{Physical: "CD"}, []int{2}},
+	{"label", ReleaseQuery{Label: "Island"}, []int{2}},
+	{"wanted", ReleaseQuery{Wanted: boolPtr(true)}, []int{3}},
+	{"owned", ReleaseQuery{Wanted: boolPtr(false)}, []int{1, 2, 4, 5}},
+	{"archived", ReleaseQuery{Status: statusArchived}, []int{6}},
+	{"sold", ReleaseQuery{Status: statusSold}, []int{7}},
+	{"formerly owned", ReleaseQuery{Status: "former"}, []int{6, 7}},
+	{"all", ReleaseQuery{Status: "all"}, []int{1, 2, 3, 4, 5, 6, 7}},
+	{"need scraping", ReleaseQuery{NeedScraping: true}, []int{5}},
+	{"search without accents", ReleaseQuery{Search: "debut", Status: "all"}, []int{6}},
+	{"search by year", ReleaseQuery{Search: "1998"}, []int{3}},
+	{"excluded release", ReleaseQuery{Artist: "Portishead", ExcludeID: 1}, []int{2}},
+	{"combined filters", ReleaseQuery{Tag: "trip hop", Physical: "Vinyl", Wanted: boolPtr(false)}, []int{1}},
+	{"sorted", ReleaseQuery{Sort: []SortKey{{Field: "artist"}, {Field: "year", Desc: true}}}, []int{4, 3, 2, 1, 5}},
+	{"sorted with ties", ReleaseQuery{Status: "all", Sort: []SortKey{{Field: "rating", Desc: true}}}, []int{1, 7, 2, 6, 4, 3, 5}},
+	{"first page", ReleaseQuery{Sort: []SortKey{{Field: "title"}}, Limit: 2}, []int{4, 1}},
+	{"second page", ReleaseQuery{Sort: []SortKey{{Field: "title"}}, Limit: 2, Offset: 2}, []int{5, 3}},
+	{"last page", ReleaseQuery{Sort: []SortKey{{Field: "title"}}, Limit: 2, Offset: 4}, []int{2}},
+	{"past the end", ReleaseQuery{Limit: 2, Offset: 10}, nil},
+}
+
+func releaseIDs(releases []Release) []int {
+	var ids []int
+	for _, r := range releases {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+// checkReleaseQueries runs releaseQueryTests against a store.
+func checkReleaseQueries(t *testing.T, s ReleaseStore) {
+	for _, tt := range releaseQueryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			releases, err := s.ListReleases(tt.query)
+			if err != nil {
+				t.Fatalf("ListReleases: %v", err)
+			}
+			if got := releaseIDs(releases); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListReleases = %v, want %v", got, tt.want)
+			}
+
+			// Counts ignore the page
+			unpaged := tt.query
+			unpaged.Limit, unpaged.Offset = 0, 0
+			all, err := s.ListReleases(unpaged)
+			if err != nil {
+				t.Fatalf("ListReleases: %v", err)
+			}
+			count, err := s.CountReleases(tt.query)
+			if err != nil {
+				t.Fatalf("CountReleases: %v", err)
+			}
+			if count != len(all) {
+				t.Errorf("CountReleases = %d, want %d", count, len(all))
+			}
+		})
+	}
+}
+
+func TestMemoryStoreListReleases(t *testing.T) {
+	checkReleaseQueries(t, newMemoryStore(listingReleases()...))
+}
+
+// newTestSQLiteStore returns a store on an empty, migrated SQLite database.
+func newTestSQLiteStore(t *testing.T) *sqlStore {
+	t.Helper()
+	t.Setenv("SQLITE_PATH", filepath.Join(t.TempDir(), "collection.db"))
+	conn, dialect, err := openDatabase("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := migrateUp(conn, dialect); err != nil {
+		t.Fatal(err)
+	}
+
+	// insertRelease writes tags with the dialect of the application database
+	previous := dbDialect
+	dbDialect = dialect
+	t.Cleanup(func() { dbDialect = previous })
+
+	return newSQLStore(conn, dialect)
+}
+
+// TestSQLiteStoreListReleases runs the same queries against SQLite, so the
+// memory store used by the handler tests filters, sorts and pages the same way.
+func TestSQLiteStoreListReleases(t *testing.T) {
+	s := newTestSQLiteStore(t)
+	for _, r := range listingReleases() {
+		id, err := s.CreateRelease(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != r.ID {
+			t.Fatalf("release %s inserted with ID %d, want %d", r.Title, id, r.ID)
+		}
+		if err := s.SetCoverImage(id, r.CoverImage); err != nil {
+			t.Fatal(err)
+		}
+		if r.Status != "" {
+			if err := s.SetStatus(id, ReleaseStatus{Status: r.Status, Date: r.StatusDate, Price: r.SalePrice}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkReleaseQueries(t, s)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// mergeRule decides what a re-import does with a field of a release that is
+// already in the collection.
+type mergeRule string
+
+const (
+	mergeImportWins mergeRule = "csv"   // Take the imported value, unless the field was edited locally
+	mergeLocalWins  mergeRule = "local" // Never change the field
+	mergeFillEmpty  mergeRule = "empty" // Only set the field when it is empty
+)
+
+// importField is a release field coming from an import, with its column in
+// the Discogs CSV export.
+type importField struct {
+	Name   string // As in Release.EditedFields and the JSON API
+	Column string
+	get    func(r *Release) *string
+}
+
+// importFields lists every field an import or sync can change. Tags, year
+// and cover come from scraping and are never touched by imports.
+var importFields = []importField{
+	{"artist", "Artist", func(r *Release) *string { return &r.Artist }},
+	{"title", "Title", func(r *Release) *string { return &r.Title }},
+	{"catalog_number", "Catalog#", func(r *Release) *string { return &r.CatalogNumber }},
+	{"label", "Label", func(r *Release) *string { return &r.Label }},
+	{"format", "Format", func(r *Release) *string { return &r.Format }},
+	{"rating", "Rating", func(r *Release) *string { return &r.Rating }},
+	{"released", "Released", func(r *Release) *string { return &r.Released }},
+	{"collection_folder", "CollectionFolder", func(r *Release) *string { return &r.CollectionFolder }},
+	{"date_added", "Date Added", func(r *Release) *string { return &r.DateAdded }},
+	{"collection_media_condition", "Collection Media Condition", func(r *Release) *string { return &r.CollectionMediaCondition }},
+	{"collection_sleeve_condition", "Collection Sleeve Condition", func(r *Release) *string { return &r.CollectionSleeveCondition }},
+	{"collection_notes", "Collection Notes", func(r *Release) *string { return &r.CollectionNotes }},
+}
+
+// defaultMergeRules apply to fields not set in IMPORT_MERGE_RULES. The
+// release date is only filled in, scraping may have stored a more exact one.
+var defaultMergeRules = map[string]mergeRule{
+	"released": mergeFillEmpty,
+}
+
+// getMergeRules reads IMPORT_MERGE_RULES, a comma separated list of
+// field=rule pairs, i.e. "rating=local,collection_notes=empty". Fields not
+// listed take their default rule, which is "csv" for most of them.
+func getMergeRules() (map[string]mergeRule, error) {
+	rules := make(map[string]mergeRule)
+	for _, field := range importFields {
+		rules[field.Name] = mergeImportWins
+		if rule, ok := defaultMergeRules[field.Name]; ok {
+			rules[field.Name] = rule
+		}
+	}
+
+	for _, pair := range strings.Split(getEnvWithDefault("IMPORT_MERGE_RULES", ""), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		rule := mergeRule(strings.TrimSpace(value))
+		name = strings.TrimSpace(name)
+		if _, known := rules[name]; !ok || !known {
+			return nil, fmt.Errorf("invalid IMPORT_MERGE_RULES entry %q", pair)
+		}
+		if rule != mergeImportWins && rule != mergeLocalWins && rule != mergeFillEmpty {
+			return nil, fmt.Errorf("invalid merge rule %q for %s, use csv, local or empty", rule, name)
+		}
+		rules[name] = rule
+	}
+	return rules, nil
+}
+
+// mergeImported applies the merge rules to an imported version of a release
+// and returns the merged release with the names of the fields that changed.
+// Only fields in present are considered, so files without a column leave it
+// alone. Locally edited fields are kept whatever the rule, the physical
+// format too when the format changes.
+func mergeImported(current, imported Release, present map[string]bool, rules map[string]mergeRule) (Release, []string) {
+	merged := current
+	var changed []string
+
+	edited := make(map[string]bool)
+	for _, field := range current.EditedFields {
+		edited[field] = true
+	}
+
+	for _, field := range importFields {
+		if !present[field.Name] || edited[field.Name] {
+			continue
+		}
+		value := *field.get(&imported)
+		target := field.get(&merged)
+
+		switch rules[field.Name] {
+		case mergeLocalWins:
+			continue
+		case mergeFillEmpty:
+			if *target != "" || value == "" {
+				continue
+			}
+		}
+		if *target != value {
+			*target = value
+			changed = append(changed, field.Name)
+		}
+	}
+
+	// A physical format edited by hand is kept, as reclassifying does
+	if containsString(changed, "format") && !edited["physical"] {
+		merged.Physical = imported.Physical
+		if merged.Physical == "" {
+			merged.Physical = determinePhysicalFormat(merged.Format)
+		}
+	}
+
+	// A wanted release found in the collection has been bought, owned
+	// releases never go back to the wanted list
+	if current.Wanted && !imported.Wanted {
+		merged.Wanted = false
+		changed = append(changed, "wanted")
+	}
+	return merged, changed
+}
+
+// updateImportedRelease writes the import fields of a merged release.
+func updateImportedRelease(q dbExecutor, r Release) error {
+	_, err := q.Exec(`
+		UPDATE releases SET artist = $1, title = $2, catalog_number = $3, label = $4, format = $5, rating = $6,
+			released = $7, collection_folder = $8, date_added = $9, collection_media_condition = $10,
+			collection_sleeve_condition = $11, collection_notes = $12, wanted = $13, physical = $14
+		WHERE id = $15
+	`, r.Artist, r.Title, r.CatalogNumber, r.Label, r.Format, r.Rating, r.Released, r.CollectionFolder, r.DateAdded,
+		r.CollectionMediaCondition, r.CollectionSleeveCondition, r.CollectionNotes, r.Wanted, r.Physical, r.ID)
+	if err != nil {
+		log.Printf("Error updating release %d: %v", r.ReleaseID, err)
+		return err
+	}
+	return replaceReleaseMedia(q, r.ID, r.Format)
+}
+
+// UpdateImportedRelease writes a release merged by a Discogs sync.
+func (s *sqlStore) UpdateImportedRelease(r Release) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateImportedRelease(tx, r); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// fieldChanges lists the old and new values of the changed fields.
+func fieldChanges(current, merged Release, changed []string) []fieldChange {
+	var changes []fieldChange
+	for _, name := range changed {
+		if name == "wanted" {
+			changes = append(changes, fieldChange{Field: name, Old: strconv.FormatBool(current.Wanted), New: strconv.FormatBool(merged.Wanted)})
+			continue
+		}
+		for _, field := range importFields {
+			if field.Name == name {
+				changes = append(changes, fieldChange{Field: name, Old: *field.get(&current), New: *field.get(&merged)})
+			}
+		}
+	}
+	return changes
+}
+
+// formatChanges writes changes for job logs, i.e. `rating: "3" -> "4"`.
+func formatChanges(changes []fieldChange) string {
+	parts := make([]string, len(changes))
+	for i, change := range changes {
+		parts[i] = fmt.Sprintf("%s: %q -> %q", change.Field, change.Old, change.New)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeImportedPhysical(t *testing.T) {
+	t.Setenv("FORMAT_RULES_FILE", "")
+	if _, err := reloadFormatRules(); err != nil {
+		t.Fatal(err)
+	}
+	present := map[string]bool{"format": true}
+	rules := map[string]mergeRule{"format": mergeImportWins}
+	imported := Release{Format: "CD, Album"}
+
+	current := Release{Format: "LP, Album", Physical: "Vinyl"}
+	if merged, _ := mergeImported(current, imported, present, rules); merged.Physical != "CD" {
+		t.Errorf("Physical = %q, want CD classified from the new format", merged.Physical)
+	}
+
+	// Fixed by hand on the edit page
+	current = Release{Format: "LP, Album", Physical: "Shellac", EditedFields: []string{"physical"}}
+	merged, changed := mergeImported(current, imported, present, rules)
+	if merged.Physical != "Shellac" {
+		t.Errorf("edited Physical = %q, want it kept as Shellac", merged.Physical)
+	}
+	if merged.Format != "CD, Album" || len(changed) != 1 {
+		t.Errorf("Format = %q, changed %v, want the format still merged", merged.Format, changed)
+	}
+}
+
+func TestGetMergeRules(t *testing.T) {
+	tests := []struct {
+		env  string
+		want map[string]mergeRule // Checked fields only
+	}{
+		{"", map[string]mergeRule{"rating": mergeImportWins, "released": mergeFillEmpty, "collection_notes": mergeImportWins}},
+		{"rating=local, collection_notes=empty", map[string]mergeRule{"rating": mergeLocalWins, "released": mergeFillEmpty, "collection_notes": mergeFillEmpty}},
+		{"released=csv,", map[string]mergeRule{"released": mergeImportWins}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("IMPORT_MERGE_RULES", tt.env)
+			rules, err := getMergeRules()
+			if err != nil {
+				t.Fatalf("getMergeRules: %v", err)
+			}
+			if len(rules) != len(importFields) {
+				t.Errorf("%d rules, want one per import field", len(rules))
+			}
+			for field, want := range tt.want {
+				if rules[field] != want {
+					t.Errorf("%s = %q, want %q", field, rules[field], want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetMergeRulesInvalid(t *testing.T) {
+	for _, env := range []string{"rating", "=local", "tags=local", "year=csv", "rating=keep", "rating=local,notes=empty"} {
+		t.Setenv("IMPORT_MERGE_RULES", env)
+		if rules, err := getMergeRules(); err == nil {
+			t.Errorf("IMPORT_MERGE_RULES=%q gave %v, want an error", env, rules)
+		}
+	}
+}
+
+func TestMergeImported(t *testing.T) {
+	current := Release{ID: 1, ReleaseID: 101, Artist: "Portishead", Title: "Dummy", Rating: "3", Released: "1994",
+		CollectionNotes: "first pressing", Format: "LP, Album", Physical: "Vinyl"}
+	imported := Release{ReleaseID: 101, Artist: "Portishead", Title: "Dummy", Rating: "4", Released: "1994-08-22",
+		CollectionNotes: "", Format: "LP, Album"}
+	all := map[string]bool{}
+	for _, field := range importFields {
+		all[field.Name] = true
+	}
+
+	tests := []struct {
+		name     string
+		rules    string // IMPORT_MERGE_RULES
+		current  func(r *Release)
+		imported func(r *Release)
+		present  map[string]bool // All columns when nil
+		want     func(r *Release)
+		changed  []string
+	}{
+		{
+			name:    "csv takes the imported values",
+			want:    func(r *Release) { r.Rating, r.CollectionNotes = "4", "" },
+			changed: []string{"rating", "collection_notes"},
+		},
+		{
+			name:    "local keeps the current values",
+			rules:   "rating=local,collection_notes=local",
+			changed: nil,
+		},
+		{
+			name:    "empty fills in empty fields only",
+			rules:   "rating=empty,collection_notes=empty",
+			current: func(r *Release) { r.Released = "" },
+			want:    func(r *Release) { r.Released = "1994-08-22" },
+			changed: []string{"released"},
+		},
+		{
+			name:     "empty never clears",
+			rules:    "rating=local,collection_notes=empty",
+			current:  func(r *Release) { r.Released = "" },
+			imported: func(r *Release) { r.Released = "" },
+			changed:  nil,
+		},
+		{
+			name:    "edited fields are kept",
+			current: func(r *Release) { r.EditedFields = []string{"rating", "collection_notes"} },
+			changed: nil,
+		},
+		{
+			name:    "missing columns are left alone",
+			present: map[string]bool{"artist": true, "title": true, "rating": true},
+			want:    func(r *Release) { r.Rating = "4" },
+			changed: []string{"rating"},
+		},
+		{
+			name:     "wanted becomes owned",
+			rules:    "rating=local,collection_notes=local",
+			current:  func(r *Release) { r.Wanted = true },
+			imported: func(r *Release) { r.Wanted = false },
+			want:     func(r *Release) { r.Wanted = false },
+			changed:  []string{"wanted"},
+		},
+		{
+			name:     "owned never becomes wanted",
+			rules:    "rating=local,collection_notes=local",
+			imported: func(r *Release) { r.Wanted = true },
+			changed:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("IMPORT_MERGE_RULES", tt.rules)
+			rules, err := getMergeRules()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cur, imp, present := current, imported, tt.present
+			if tt.current != nil {
+				tt.current(&cur)
+			}
+			if tt.imported != nil {
+				tt.imported(&imp)
+			}
+			if present == nil {
+				present = all
+			}
+			want := cur
+			if tt.want != nil {
+				tt.want(&want)
+			}
+
+			merged, changed := mergeImported(cur, imp, present, rules)
+			if !reflect.DeepEqual(merged, want) {
+				t.Errorf("merged = %+v, want %+v", merged, want)
+			}
+			if !reflect.DeepEqual(changed, tt.changed) {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// errNoMetadata is returned by providers that do not know a release.
+var errNoMetadata = errors.New("no metadata found")
+
+// Metadata is what a provider knows about a release. Zero values mean the
+// provider has nothing for that field.
+type Metadata struct {
+	Year      int
+	Released  string // Most exact release date known, i.e. "1993-07-05" or "1993"
+	Label     string
+	Tags      []string
+	CoverURLs []string // Best first
+	Tracks    []MetadataTrack
+}
+
+// MetadataTrack is one track of a release tracklist.
+type MetadataTrack struct {
+	Position string // As printed on the release, i.e. "A1" or "2-05"
+	Title    string
+	Duration string // "4:32", empty when unknown
+	Credits  []string
+}
+
+// MetadataProvider looks up release data in an external source. Lookups get
+// the whole release so providers can use the artist and title, the Discogs
+// release_id, or both.
+type MetadataProvider interface {
+	Name() string
+	Lookup(ctx context.Context, release Release) (*Metadata, error)
+}
+
+// metadataProviderFactories lists every provider that can be enabled in
+// METADATA_PROVIDERS, by name.
+var metadataProviderFactories = map[string]func() (MetadataProvider, error){
+	"discogs":     newDiscogsProvider,
+	"lastfm":      newLastFMProvider,
+	"musicbrainz": newMusicBrainzProvider,
+}
+
+// getMetadataProviders builds the providers enabled in METADATA_PROVIDERS, a
+// comma separated list in order of preference, i.e. "lastfm".
+func getMetadataProviders() ([]MetadataProvider, error) {
+	var providers []MetadataProvider
+	for _, name := range strings.Split(getEnvWithDefault("METADATA_PROVIDERS", "lastfm"), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+		factory, ok := metadataProviderFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown metadata provider %q in METADATA_PROVIDERS", name)
+		}
+		provider, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("error setting up metadata provider %s: %v", name, err)
+		}
+		providers = append(providers, provider)
+	}
+	if len(providers) == 0 {
+		return nil, errors.New("no metadata providers enabled in METADATA_PROVIDERS")
+	}
+	return providers, nil
+}
+
+// lookupMetadata asks every provider in order and merges their answers: the
+// year, release date, label and tracklist come from the first provider that
+// has them, tags are combined and cover URLs are kept in provider order.
+// Provider errors are reported through logf and do not stop the other
+// providers, the last one is returned when no provider could answer.
+func lookupMetadata(ctx context.Context, providers []MetadataProvider, release Release, logf func(format string, args ...interface{})) (*Metadata, error) {
+	merged := &Metadata{}
+	found := false
+	var lastErr error
+	seenTags := make(map[string]bool)
+
+	for _, provider := range providers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		metadata, err := provider.Lookup(ctx, release)
+		if errors.Is(err, errNoMetadata) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Metadata provider %s failed for release %d: %v", provider.Name(), release.ReleaseID, err)
+			logf("%s: %v", provider.Name(), err)
+			lastErr = err
+			continue
+		}
+
+		found = true
+		if merged.Year == 0 {
+			merged.Year = metadata.Year
+		}
+		if merged.Released == "" {
+			merged.Released = metadata.Released
+		}
+		if merged.Label == "" {
+			merged.Label = metadata.Label
+		}
+		if len(merged.Tracks) == 0 {
+			merged.Tracks = metadata.Tracks
+		}
+		for _, tag := range metadata.Tags {
+			if !seenTags[tag] {
+				seenTags[tag] = true
+				merged.Tags = append(merged.Tags, tag)
+			}
+		}
+		merged.CoverURLs = append(merged.CoverURLs, metadata.CoverURLs...)
+	}
+
+	if !found {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, errNoMetadata
+	}
+	return merged, nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// migration is a single, numbered schema change. Versions must be unique and
+// migrations are applied in the order they appear in the migrations slice.
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+
+	// SQLite variants, only needed when the PostgreSQL statements differ
+	SQLiteUp   string
+	SQLiteDown string
+}
+
+func (m migration) upSQL(dialect sqlDialect) string {
+	if dialect.Name() == "sqlite" && m.SQLiteUp != "" {
+		return m.SQLiteUp
+	}
+	return m.Up
+}
+
+func (m migration) downSQL(dialect sqlDialect) string {
+	if dialect.Name() == "sqlite" && m.SQLiteDown != "" {
+		return m.SQLiteDown
+	}
+	return m.Down
+}
+
+// migrations holds every schema change the binary knows about. Never edit a
+// migration that has been released; add a new one instead.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create releases",
+		Up: `
+			CREATE EXTENSION IF NOT EXISTS unaccent;
+			CREATE TABLE IF NOT EXISTS releases (
+				id SERIAL PRIMARY KEY,
+				catalog_number TEXT,
+				artist TEXT,
+				title TEXT,
+				label TEXT,
+				format TEXT,
+				rating TEXT,
+				released TEXT,
+				release_id INT UNIQUE,
+				collection_folder TEXT,
+				date_added TEXT,
+				collection_media_condition TEXT,
+				collection_sleeve_condition TEXT,
+				collection_notes TEXT,
+				tags TEXT[],
+				year INT,
+				cover_image TEXT,
+				wanted BOOLEAN DEFAULT FALSE,
+				physical TEXT
+			);`,
+		Down: `DROP TABLE IF EXISTS releases;`,
+		SQLiteUp: `
+			CREATE TABLE IF NOT EXISTS releases (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				catalog_number TEXT,
+				artist TEXT,
+				title TEXT,
+				label TEXT,
+				format TEXT,
+				rating TEXT,
+				released TEXT,
+				release_id INTEGER UNIQUE,
+				collection_folder TEXT,
+				date_added TEXT,
+				collection_media_condition TEXT,
+				collection_sleeve_condition TEXT,
+				collection_notes TEXT,
+				tags TEXT,
+				year INTEGER,
+				cover_image TEXT,
+				wanted BOOLEAN DEFAULT FALSE,
+				physical TEXT
+			);`,
+	},
+	{
+		Version: 2,
+		Name:    "create jobs",
+		Up: `
+			CREATE TABLE IF NOT EXISTS jobs (
+				id SERIAL PRIMARY KEY,
+				kind TEXT NOT NULL,
+				status TEXT NOT NULL,
+				total INT NOT NULL DEFAULT 0,
+				processed INT NOT NULL DEFAULT 0,
+				failed INT NOT NULL DEFAULT 0,
+				message TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				started_at TIMESTAMP,
+				finished_at TIMESTAMP
+			);`,
+		Down: `DROP TABLE IF EXISTS jobs;`,
+		SQLiteUp: `
+			CREATE TABLE IF NOT EXISTS jobs (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				kind TEXT NOT NULL,
+				status TEXT NOT NULL,
+				total INTEGER NOT NULL DEFAULT 0,
+				processed INTEGER NOT NULL DEFAULT 0,
+				failed INTEGER NOT NULL DEFAULT 0,
+				message TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				started_at TIMESTAMP,
+				finished_at TIMESTAMP
+			);`,
+	},
+	{
+		Version:    3,
+		Name:       "track locally edited fields",
+		Up:         `ALTER TABLE releases ADD COLUMN IF NOT EXISTS edited_fields TEXT[] NOT NULL DEFAULT '{}';`,
+		Down:       `ALTER TABLE releases DROP COLUMN IF EXISTS edited_fields;`,
+		SQLiteUp:   `ALTER TABLE releases ADD COLUMN edited_fields TEXT NOT NULL DEFAULT '[]';`,
+		SQLiteDown: `ALTER TABLE releases DROP COLUMN edited_fields;`,
+	},
+	{
+		Version: 4,
+		Name:    "create import reports",
+		Up: `
+			CREATE TABLE IF NOT EXISTS import_rows (
+				id SERIAL PRIMARY KEY,
+				job_id INT NOT NULL,
+				line INT NOT NULL,
+				outcome TEXT NOT NULL,
+				release_id INT NOT NULL DEFAULT 0,
+				artist TEXT NOT NULL DEFAULT '',
+				title TEXT NOT NULL DEFAULT '',
+				reason TEXT NOT NULL DEFAULT '',
+				changes TEXT NOT NULL DEFAULT '[]'
+			);
+			CREATE INDEX IF NOT EXISTS import_rows_job_id ON import_rows (job_id);`,
+		Down: `DROP TABLE IF EXISTS import_rows;`,
+		SQLiteUp: `
+			CREATE TABLE IF NOT EXISTS import_rows (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				job_id INTEGER NOT NULL,
+				line INTEGER NOT NULL,
+				outcome TEXT NOT NULL,
+				release_id INTEGER NOT NULL DEFAULT 0,
+				artist TEXT NOT NULL DEFAULT '',
+				title TEXT NOT NULL DEFAULT '',
+				reason TEXT NOT NULL DEFAULT '',
+				changes TEXT NOT NULL DEFAULT '[]'
+			);
+			CREATE INDEX IF NOT EXISTS import_rows_job_id ON import_rows (job_id);`,
+	},
+	{
+		Version: 5,
+		Name:    "create release media",
+		Up: `
+			CREATE TABLE IF NOT EXISTS release_media (
+				id SERIAL PRIMARY KEY,
+				release_ref INT NOT NULL REFERENCES releases (id) ON DELETE CASCADE,
+				position INT NOT NULL,
+				quantity INT NOT NULL DEFAULT 1,
+				type TEXT NOT NULL,
+				size TEXT NOT NULL DEFAULT '',
+				speed TEXT NOT NULL DEFAULT '',
+				descriptions TEXT NOT NULL DEFAULT ''
+			);
+			CREATE INDEX IF NOT EXISTS release_media_release_ref ON release_media (release_ref);`,
+		Down: `DROP TABLE IF EXISTS release_media;`,
+		SQLiteUp: `
+			CREATE TABLE IF NOT EXISTS release_media (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				release_ref INTEGER NOT NULL REFERENCES releases (id) ON DELETE CASCADE,
+				position INTEGER NOT NULL,
+				quantity INTEGER NOT NULL DEFAULT 1,
+				type TEXT NOT NULL,
+				size TEXT NOT NULL DEFAULT '',
+				speed TEXT NOT NULL DEFAULT '',
+				descriptions TEXT NOT NULL DEFAULT ''
+			);
+			CREATE INDEX IF NOT EXISTS release_media_release_ref ON release_media (release_ref);`,
+	},
+	{
+		Version: 6,
+		Name:    "create tracks",
+		Up: `
+			CREATE TABLE IF NOT EXISTS tracks (
+				id SERIAL PRIMARY KEY,
+				release_ref INT NOT NULL REFERENCES releases (id) ON DELETE CASCADE,
+				sequence INT NOT NULL,
+				position TEXT NOT NULL DEFAULT '',
+				title TEXT NOT NULL,
+				duration TEXT NOT NULL DEFAULT '',
+				credits TEXT NOT NULL DEFAULT ''
+			);
+			CREATE INDEX IF NOT EXISTS tracks_release_ref ON tracks (release_ref);`,
+		Down: `DROP TABLE IF EXISTS tracks;`,
+		SQLiteUp: `
+			CREATE TABLE IF NOT EXISTS tracks (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				release_ref INTEGER NOT NULL REFERENCES releases (id) ON DELETE CASCADE,
+				sequence INTEGER NOT NULL,
+				position TEXT NOT NULL DEFAULT '',
+				title TEXT NOT NULL,
+				duration TEXT NOT NULL DEFAULT '',
+				credits TEXT NOT NULL DEFAULT ''
+			);
+			CREATE INDEX IF NOT EXISTS tracks_release_ref ON tracks (release_ref);`,
+	},
+	{
+		Version: 7,
+		Name:    "archive and sell releases",
+		Up: `
+			ALTER TABLE releases ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT '';
+			ALTER TABLE releases ADD COLUMN IF NOT EXISTS status_date TEXT NOT NULL DEFAULT '';
+			ALTER TABLE releases ADD COLUMN IF NOT EXISTS sale_price TEXT NOT NULL DEFAULT '';
+			ALTER TABLE releases ADD COLUMN IF NOT EXISTS status_note TEXT NOT NULL DEFAULT '';`,
+		Down: `
+			ALTER TABLE releases DROP COLUMN IF EXISTS status;
+			ALTER TABLE releases DROP COLUMN IF EXISTS status_date;
+			ALTER TABLE releases DROP COLUMN IF EXISTS sale_price;
+			ALTER TABLE releases DROP COLUMN IF EXISTS status_note;`,
+		SQLiteUp: `
+			ALTER TABLE releases ADD COLUMN status TEXT NOT NULL DEFAULT '';
+			ALTER TABLE releases ADD COLUMN status_date TEXT NOT NULL DEFAULT '';
+			ALTER TABLE releases ADD COLUMN sale_price TEXT NOT NULL DEFAULT '';
+			ALTER TABLE releases ADD COLUMN status_note TEXT NOT NULL DEFAULT '';`,
+		SQLiteDown: `
+			ALTER TABLE releases DROP COLUMN status;
+			ALTER TABLE releases DROP COLUMN status_date;
+			ALTER TABLE releases DROP COLUMN sale_price;
+			ALTER TABLE releases DROP COLUMN status_note;`,
+	},
+	{
+		Version: 8,
+		Name:    "create release changes",
+		// No foreign key to releases, the changes of deleted releases are kept
+		Up: `
+			CREATE TABLE IF NOT EXISTS release_changes (
+				id SERIAL PRIMARY KEY,
+				release_ref INT NOT NULL,
+				artist TEXT NOT NULL DEFAULT '',
+				title TEXT NOT NULL DEFAULT '',
+				action TEXT NOT NULL,
+				source TEXT NOT NULL,
+				actor TEXT NOT NULL DEFAULT '',
+				batch TEXT NOT NULL DEFAULT '',
+				old_values TEXT NOT NULL DEFAULT '{}',
+				new_values TEXT NOT NULL DEFAULT '{}',
+				changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				undone_by INT NOT NULL DEFAULT 0
+			);
+			CREATE INDEX IF NOT EXISTS release_changes_release_ref ON release_changes (release_ref);
+			CREATE INDEX IF NOT EXISTS release_changes_batch ON release_changes (batch);`,
+		Down: `DROP TABLE IF EXISTS release_changes;`,
+		SQLiteUp: `
+			CREATE TABLE IF NOT EXISTS release_changes (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				release_ref INTEGER NOT NULL,
+				artist TEXT NOT NULL DEFAULT '',
+				title TEXT NOT NULL DEFAULT '',
+				action TEXT NOT NULL,
+				source TEXT NOT NULL,
+				actor TEXT NOT NULL DEFAULT '',
+				batch TEXT NOT NULL DEFAULT '',
+				old_values TEXT NOT NULL DEFAULT '{}',
+				new_values TEXT NOT NULL DEFAULT '{}',
+				changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				undone_by INTEGER NOT NULL DEFAULT 0
+			);
+			CREATE INDEX IF NOT EXISTS release_changes_release_ref ON release_changes (release_ref);
+			CREATE INDEX IF NOT EXISTS release_changes_batch ON release_changes (batch);`,
+	},
+}
+
+// MigrationStatus describes whether a known migration has been applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// latestMigrationVersion returns the highest version this binary knows about.
+func latestMigrationVersion() int {
+	latest := 0
+	for _, m := range migrations {
+		if m.Version > latest {
+			latest = m.Version
+		}
+	}
+	return latest
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	return err
+}
+
+// appliedMigrations returns the applied versions with their timestamps.
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// currentSchemaVersion returns the highest applied migration version, or 0.
+func currentSchemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// checkSchemaVersion refuses to continue when the database has migrations
+// applied that this binary does not know about, i.e. it was migrated by a
+// newer release.
+func checkSchemaVersion(db *sql.DB) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if latest := latestMigrationVersion(); current > latest {
+		return fmt.Errorf("database schema is at version %d but this binary only knows up to version %d; upgrade the application", current, latest)
+	}
+	return nil
+}
+
+// migrateUp applies every pending migration in order, each in its own transaction.
+func migrateUp(db *sql.DB, dialect sqlDialect) error {
+	if err := checkSchemaVersion(db); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		log.Printf("Applying migration %d: %s", m.Version, m.Name)
+		if err := runMigration(db, m.upSQL(dialect), func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+			return err
+		}); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// migrateDown rolls back the given number of most recently applied migrations.
+func migrateDown(db *sql.DB, dialect sqlDialect, steps int) error {
+	if err := checkSchemaVersion(db); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		log.Printf("Reverting migration %d: %s", m.Version, m.Name)
+		if err := runMigration(db, m.downSQL(dialect), func(tx *sql.Tx) error {
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.Version)
+			return err
+		}); err != nil {
+			return fmt.Errorf("reverting migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+func runMigration(db *sql.DB, statements string, record func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(statements); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrationStatus lists every known migration and whether it has been applied.
+func migrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses, nil
+}
+
+// runMigrateCommand implements `music-collection migrate up|down [n]|status`.
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		if err := migrateUp(db, dbDialect); err != nil {
+			return err
+		}
+		log.Printf("Database is at schema version %d", latestMigrationVersion())
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+			steps = n
+		}
+		return migrateDown(db, dbDialect, steps)
+	case "status":
+		statuses, err := migrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			if s.Applied {
+				fmt.Printf("%4d  applied  %s  %s\n", s.Version, s.AppliedAt.Format("2006-01-02 15:04:05"), s.Name)
+			} else {
+				fmt.Printf("%4d  pending  %-19s  %s\n", s.Version, "", s.Name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
+	return nil
+}
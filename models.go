@@ -3,23 +3,30 @@ package main
 import "github.com/lib/pq"
 
 type Release struct {
-	ID                        int
-	CatalogNumber             string
-	Artist                    string
-	Title                     string
-	Label                     string
-	Format                    string
-	Rating                    string
-	Released                  string
-	ReleaseID                 int
-	CollectionFolder          string
-	DateAdded                 string
-	CollectionMediaCondition  string
-	CollectionSleeveCondition string
-	CollectionNotes           string
-	Tags                      pq.StringArray
-	Year                      int
-	CoverImage                string
-	Wanted                    bool
-	Physical                  string
+	ID                        int             `json:"id"`
+	CatalogNumber             string          `json:"catalog_number"`
+	Artist                    string          `json:"artist"`
+	Title                     string          `json:"title"`
+	Label                     string          `json:"label"`
+	Format                    string          `json:"format"`
+	Rating                    string          `json:"rating"`
+	Released                  string          `json:"released"`
+	ReleaseID                 int             `json:"release_id"`
+	CollectionFolder          string          `json:"collection_folder"`
+	DateAdded                 string          `json:"date_added"`
+	CollectionMediaCondition  string          `json:"collection_media_condition"`
+	CollectionSleeveCondition string          `json:"collection_sleeve_condition"`
+	CollectionNotes           string          `json:"collection_notes"`
+	Tags                      pq.StringArray  `json:"tags"`
+	Year                      int             `json:"year"`
+	CoverImage                string          `json:"cover_image"`
+	Wanted                    bool            `json:"wanted"`
+	Physical                  string          `json:"physical"`
+	EditedFields              pq.StringArray  `json:"edited_fields"` // Fields changed locally, kept by re-imports
+	Media                     []ReleaseMedium `json:"media"`         // Parsed from Format, stored in release_media
+	Tracks                    []Track         `json:"tracks"`        // Only loaded by GetRelease
+	Status                    string          `json:"status"`        // Empty while in the collection or wantlist, "archived" or "sold"
+	StatusDate                string          `json:"status_date"`   // When it was archived or sold
+	SalePrice                 string          `json:"sale_price"`
+	StatusNote                string          `json:"status_note"` // i.e. who bought it
 }
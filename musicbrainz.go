@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// musicBrainzMinScore is the lowest search score accepted as a match.
+const musicBrainzMinScore = 90
+
+// musicBrainzProvider finds releases in the MusicBrainz web service, taking
+// the year from the release group (the original release) and the genres as
+// tags, and the front cover from the Cover Art Archive. The base URLs can be
+// pointed at the fixture-server command to work offline.
+type musicBrainzProvider struct {
+	baseURL     string
+	coverArtURL string
+	userAgent   string
+	client      *http.Client
+
+	// MusicBrainz allows one request per second per client
+	mu          sync.Mutex
+	interval    time.Duration
+	lastRequest time.Time
+}
+
+func newMusicBrainzProvider() (MetadataProvider, error) {
+	interval, err := time.ParseDuration(getEnvWithDefault("MUSICBRAINZ_REQUEST_INTERVAL", "1s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MUSICBRAINZ_REQUEST_INTERVAL: %v", err)
+	}
+	return &musicBrainzProvider{
+		baseURL:     strings.TrimRight(getEnvWithDefault("MUSICBRAINZ_BASE_URL", "https://musicbrainz.org"), "/"),
+		coverArtURL: strings.TrimRight(getEnvWithDefault("COVERARTARCHIVE_BASE_URL", "https://coverartarchive.org"), "/"),
+		userAgent:   getEnvWithDefault("MUSICBRAINZ_USER_AGENT", "music-collection/1.0 ( https://github.com/zigotica/music-collection-discogs )"),
+		client:      &http.Client{Timeout: 30 * time.Second},
+		interval:    interval,
+	}, nil
+}
+
+func (p *musicBrainzProvider) Name() string { return "musicbrainz" }
+
+type mbGenre struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type mbRelease struct {
+	ID           string `json:"id"`
+	Score        int    `json:"score"`
+	Title        string `json:"title"`
+	Date         string `json:"date"`
+	ArtistCredit []struct {
+		Name string `json:"name"`
+	} `json:"artist-credit"`
+	LabelInfo []struct {
+		CatalogNumber string `json:"catalog-number"`
+	} `json:"label-info"`
+	ReleaseGroup struct {
+		ID               string `json:"id"`
+		FirstReleaseDate string `json:"first-release-date"`
+	} `json:"release-group"`
+	Genres          []mbGenre `json:"genres"`
+	CoverArtArchive struct {
+		Front bool `json:"front"`
+	} `json:"cover-art-archive"`
+}
+
+type mbSearchResponse struct {
+	Count    int         `json:"count"`
+	Releases []mbRelease `json:"releases"`
+}
+
+type mbReleaseGroup struct {
+	Genres []mbGenre `json:"genres"`
+}
+
+func (p *musicBrainzProvider) Lookup(ctx context.Context, release Release) (*Metadata, error) {
+	match, err := p.findRelease(ctx, release)
+	if err != nil {
+		return nil, err
+	}
+
+	// Search results carry neither genres nor the original release date
+	var full mbRelease
+	if err := p.get(ctx, "/ws/2/release/"+url.PathEscape(match.ID), url.Values{"inc": {"genres release-groups"}}, &full); err != nil {
+		return nil, err
+	}
+
+	metadata := &Metadata{Year: musicBrainzYear(full.ReleaseGroup.FirstReleaseDate)}
+	if metadata.Year == 0 {
+		metadata.Year = musicBrainzYear(full.Date)
+	}
+
+	genres := full.Genres
+	if len(genres) == 0 && full.ReleaseGroup.ID != "" {
+		// Genres are usually voted on the release group rather than on each release
+		var group mbReleaseGroup
+		if err := p.get(ctx, "/ws/2/release-group/"+url.PathEscape(full.ReleaseGroup.ID), url.Values{"inc": {"genres"}}, &group); err != nil {
+			return nil, err
+		}
+		genres = group.Genres
+	}
+	for _, genre := range genres {
+		metadata.Tags = append(metadata.Tags, genre.Name)
+	}
+
+	if full.CoverArtArchive.Front {
+		metadata.CoverURLs = append(metadata.CoverURLs, fmt.Sprintf("%s/release/%s/front-500", p.coverArtURL, full.ID))
+	}
+	return metadata, nil
+}
+
+// findRelease searches by artist, title and catalog number, retrying without
+// the catalog number, which is often formatted differently than on Discogs.
+func (p *musicBrainzProvider) findRelease(ctx context.Context, release Release) (*mbRelease, error) {
+	query := fmt.Sprintf("release:%s AND artist:%s", luceneQuote(release.Title), luceneQuote(release.Artist))
+
+	queries := []string{query}
+	if release.CatalogNumber != "" {
+		queries = []string{query + " AND catno:" + luceneQuote(release.CatalogNumber), query}
+	}
+
+	for _, q := range queries {
+		var result mbSearchResponse
+		if err := p.get(ctx, "/ws/2/release/", url.Values{"query": {q}, "limit": {"5"}}, &result); err != nil {
+			return nil, err
+		}
+		if match := bestMusicBrainzMatch(result.Releases, release.CatalogNumber); match != nil {
+			return match, nil
+		}
+	}
+	return nil, errNoMetadata
+}
+
+// bestMusicBrainzMatch picks the result with a matching catalog number, or
+// else the best scored one, ignoring anything below musicBrainzMinScore.
+func bestMusicBrainzMatch(releases []mbRelease, catalogNumber string) *mbRelease {
+	var best *mbRelease
+	for i := range releases {
+		candidate := &releases[i]
+		if candidate.Score < musicBrainzMinScore {
+			continue
+		}
+		if catalogNumber != "" {
+			for _, info := range candidate.LabelInfo {
+				if normalizeCatalogNumber(info.CatalogNumber) == normalizeCatalogNumber(catalogNumber) {
+					return candidate
+				}
+			}
+		}
+		if best == nil || candidate.Score > best.Score {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// get calls the web service, waiting for the rate limit, and decodes the JSON answer.
+func (p *musicBrainzProvider) get(ctx context.Context, path string, params url.Values, v interface{}) error {
+	p.mu.Lock()
+	if wait := p.interval - time.Since(p.lastRequest); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			p.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	p.lastRequest = time.Now()
+	p.mu.Unlock()
+
+	params.Set("fmt", "json")
+	requestURL := p.baseURL + path + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", p.userAgent)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling MusicBrainz: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNoMetadata
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return fmt.Errorf("MusicBrainz rate limit exceeded")
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("MusicBrainz returned status %d for %s", resp.StatusCode, requestURL)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding MusicBrainz response: %v", err)
+	}
+	return nil
+}
+
+// luceneQuote quotes a phrase for the MusicBrainz search syntax.
+func luceneQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// normalizeCatalogNumber ignores case, spaces and dashes, "SRCD-101" matches "srcd 101".
+func normalizeCatalogNumber(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '.' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(s))
+}
+
+// musicBrainzYear reads the year of a "YYYY", "YYYY-MM" or "YYYY-MM-DD" date.
+func musicBrainzYear(date string) int {
+	if len(date) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(date[:4])
+	if err != nil {
+		return 0
+	}
+	return year
+}
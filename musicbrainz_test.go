@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// newTestMusicBrainzProvider serves testdata/musicbrainz and returns a provider
+// pointed at it, without the one request per second limit.
+func newTestMusicBrainzProvider(t *testing.T) *musicBrainzProvider {
+	t.Helper()
+	dir := "testdata/musicbrainz"
+	fixtures, err := loadFixtures(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(fixtureHandler(dir, fixtures))
+	t.Cleanup(server.Close)
+
+	return &musicBrainzProvider{
+		baseURL:     server.URL,
+		coverArtURL: server.URL,
+		userAgent:   "music-collection-test",
+		client:      server.Client(),
+	}
+}
+
+func TestMusicBrainzLookup(t *testing.T) {
+	p := newTestMusicBrainzProvider(t)
+
+	tests := []struct {
+		name    string
+		release Release
+		want    *Metadata
+	}{
+		{
+			// The catalog number picks the UK release over the better scored US one
+			name:    "catalog number",
+			release: Release{Artist: "Björk", Title: "Début", CatalogNumber: "SRCD 101"},
+			want: &Metadata{
+				Year:      1993,
+				Tags:      []string{"electronic", "pop", "art pop"},
+				CoverURLs: []string{p.coverArtURL + "/release/9a1f8a3b-2c4d-4e5f-8a6b-7c8d9e0f1a2b/front-500"},
+			},
+		},
+		{
+			// The catalog number search only finds a low scored single
+			name:    "artist and title",
+			release: Release{Artist: "The Beatles", Title: "Hey Jude", CatalogNumber: "7-123"},
+			want: &Metadata{
+				Year:      1970,
+				Tags:      []string{"rock", "pop rock"},
+				CoverURLs: []string{p.coverArtURL + "/release/0b5c6d7e-8f90-4a1b-9c2d-3e4f5a6b7c8d/front-500"},
+			},
+		},
+		{
+			name:    "release group genres",
+			release: Release{Artist: "Various", Title: "Café del Mar", CatalogNumber: "BOX1"},
+			want: &Metadata{
+				Year: 2001,
+				Tags: []string{"downtempo", "chillout"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.Lookup(context.Background(), tt.release)
+			if err != nil {
+				t.Fatalf("Lookup: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lookup = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMusicBrainzLookupNotFound(t *testing.T) {
+	p := newTestMusicBrainzProvider(t)
+
+	_, err := p.Lookup(context.Background(), Release{Artist: "Miles Davis", Title: "Kind Of Blue", CatalogNumber: "CL 1355"})
+	if !errors.Is(err, errNoMetadata) {
+		t.Errorf("Lookup of an unknown release = %v, want %v", err, errNoMetadata)
+	}
+}
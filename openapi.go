@@ -0,0 +1,833 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiBasePath is the server URL of the OpenAPI document, paths are relative to it.
+const apiBasePath = "/api/v1"
+
+// OpenAPI is the subset of an OpenAPI 3 document used to describe /api/v1.
+// The document is built in code so the Release schema follows models.go, and
+// the same document is used to validate incoming API requests.
+type OpenAPI struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       OpenAPIInfo                      `json:"info"`
+	Servers    []OpenAPIServer                  `json:"servers"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIServer struct {
+	URL string `json:"url"`
+}
+
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary"`
+	Parameters  []Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"` // path or query
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema is a JSON schema as used by OpenAPI 3.0. Only the keywords the
+// validator understands are supported.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	pattern              *regexp.Regexp     // Pattern, compiled with the document
+	MinLength            *int               `json:"minLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+}
+
+// Helpers to keep the document below readable
+func ref(name string) *Schema { return &Schema{Ref: "#/components/schemas/" + name} }
+func stringSchema() *Schema   { return &Schema{Type: "string"} }
+func integerSchema() *Schema  { return &Schema{Type: "integer"} }
+func booleanSchema() *Schema  { return &Schema{Type: "boolean"} }
+func arrayOf(items *Schema) *Schema {
+	return &Schema{Type: "array", Items: items}
+}
+func float(f float64) *float64 { return &f }
+func intPtr(i int) *int        { return &i }
+
+// objectSchema builds a closed object, every listed property is required.
+func objectSchema(properties map[string]*Schema) *Schema {
+	required := make([]string, 0, len(properties))
+	for name := range properties {
+		required = append(required, name)
+	}
+	sort.Strings(required)
+	return &Schema{Type: "object", Properties: properties, Required: required, AdditionalProperties: boolPtr(false)}
+}
+
+// optionalObjectSchema builds a closed object without required properties.
+func optionalObjectSchema(properties map[string]*Schema) *Schema {
+	return &Schema{Type: "object", Properties: properties, AdditionalProperties: boolPtr(false)}
+}
+
+// dataEnvelope wraps a schema in the {"data": ...} success envelope.
+func dataEnvelope(data *Schema) *Schema {
+	return objectSchema(map[string]*Schema{"data": data})
+}
+
+// schemaFromStruct describes a struct through its json tags.
+func schemaFromStruct(t reflect.Type) *Schema {
+	properties := make(map[string]*Schema)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		switch field.Type {
+		case reflect.TypeOf(time.Time{}):
+			properties[name] = &Schema{Type: "string", Format: "date-time"}
+			continue
+		case reflect.TypeOf(&time.Time{}):
+			properties[name] = &Schema{Type: "string", Format: "date-time", Nullable: true}
+			continue
+		}
+
+		switch field.Type.Kind() {
+		case reflect.String:
+			properties[name] = stringSchema()
+		case reflect.Int, reflect.Int64:
+			properties[name] = integerSchema()
+		case reflect.Bool:
+			properties[name] = booleanSchema()
+		case reflect.Slice:
+			// Slices come back as null when empty, i.e. releases without tags
+			items := stringSchema()
+			if field.Type.Elem().Kind() == reflect.Struct {
+				items = schemaFromStruct(field.Type.Elem())
+			}
+			properties[name] = &Schema{Type: "array", Items: items, Nullable: true}
+		case reflect.Map:
+			// Free-form, i.e. the fields of a change
+			properties[name] = &Schema{Type: "object", Nullable: true}
+		default:
+			panic(fmt.Sprintf("schemaFromStruct: unsupported type %s for field %s", field.Type, field.Name))
+		}
+	}
+	return objectSchema(properties)
+}
+
+func jsonContent(s *Schema) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: s}}
+}
+
+func jsonResponse(description string, s *Schema) *Response {
+	return &Response{Description: description, Content: jsonContent(s)}
+}
+
+func errorResponse(description string) *Response {
+	return jsonResponse(description, ref("Error"))
+}
+
+func jsonBody(s *Schema) *RequestBody {
+	return &RequestBody{Required: true, Content: jsonContent(s)}
+}
+
+// releaseFieldSchemas describes the editable fields of a release.
+func releaseFieldSchemas() map[string]*Schema {
+	return map[string]*Schema{
+		"title":                       {Type: "string", MinLength: intPtr(1)},
+		"artist":                      {Type: "string", MinLength: intPtr(1)},
+		"year":                        {Type: "integer", Minimum: float(0)},
+		"catalog_number":              stringSchema(),
+		"label":                       stringSchema(),
+		"format":                      {Type: "string", Description: "Discogs format string, its media are parsed again"},
+		"physical":                    {Type: "string", Description: "Classified from a new format when left out"},
+		"rating":                      {Type: "string", Pattern: `^[0-5]?$`},
+		"released":                    {Type: "string", Pattern: `^(\d{4}(-\d{2}(-\d{2})?)?)?$`},
+		"collection_folder":           stringSchema(),
+		"date_added":                  {Type: "string", Description: "i.e. 2023-01-02 10:00:00"},
+		"collection_media_condition":  {Type: "string", Enum: append([]string{""}, mediaConditions...)},
+		"collection_sleeve_condition": {Type: "string", Enum: append([]string{""}, sleeveConditions...)},
+		"collection_notes":            stringSchema(),
+		"wanted":                      booleanSchema(),
+	}
+}
+
+// releaseInputSchema describes a release added by hand, the fields of
+// releaseDraft.
+func releaseInputSchema(track *Schema) *Schema {
+	properties := releaseFieldSchemas()
+	properties["release_id"] = &Schema{Type: "integer", Minimum: float(0), Description: "Discogs release ID, 0 or left out for releases not on Discogs"}
+	properties["format"] = &Schema{Type: "string", Description: "Discogs format string, i.e. 2xLP, Album"}
+	properties["physical"] = &Schema{Type: "string", Description: "Classified from the format when left out"}
+	properties["date_added"] = &Schema{Type: "string", Description: "i.e. 2023-01-02 10:00:00, now when left out"}
+	properties["tags"] = &Schema{Type: "array", Items: stringSchema(), Nullable: true}
+	properties["tracks"] = &Schema{Type: "array", Items: track, Nullable: true}
+	properties["cover_url"] = &Schema{Type: "string", Description: "http or https URL of an image downloaded as the cover"}
+	schema := optionalObjectSchema(properties)
+	schema.Required = []string{"artist", "title"}
+	return schema
+}
+
+var releaseIDParam = Parameter{Name: "id", In: "path", Required: true, Schema: integerSchema()}
+
+// buildOpenAPISpec describes every /api/v1 endpoint handled in api.go.
+func buildOpenAPISpec() *OpenAPI {
+	doc := &OpenAPI{
+		OpenAPI: "3.0.3",
+		Info:    OpenAPIInfo{Title: "Music Collection API", Version: "1.0.0"},
+		Servers: []OpenAPIServer{{URL: apiBasePath}},
+	}
+
+	statList := arrayOf(ref("StatItem"))
+	trackSchema := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"position": stringSchema(),
+			"title":    {Type: "string", MinLength: intPtr(1)},
+			"duration": {Type: "string", Description: "Minutes and seconds, i.e. 4:32", Pattern: `^(\d{1,3}:\d{2}(:\d{2})?)?$`},
+			"credits":  stringSchema(),
+		},
+		Required:             []string{"title"},
+		AdditionalProperties: boolPtr(false),
+	}
+	doc.Components.Schemas = map[string]*Schema{
+		"Release":  schemaFromStruct(reflect.TypeOf(Release{})),
+		"StatItem": schemaFromStruct(reflect.TypeOf(StatItem{})),
+		"Meta":     schemaFromStruct(reflect.TypeOf(apiMeta{})),
+		"Error": objectSchema(map[string]*Schema{
+			"error": schemaFromStruct(reflect.TypeOf(apiError{})),
+		}),
+		"Job":           schemaFromStruct(reflect.TypeOf(Job{})),
+		"ReleaseChange": schemaFromStruct(reflect.TypeOf(ReleaseChange{})),
+		"Stats": objectSchema(map[string]*Schema{
+			"decades":     statList,
+			"formats":     statList,
+			"top_artists": statList,
+		}),
+		"ReleasePatch": optionalObjectSchema(releaseFieldSchemas()),
+		"ReleaseInput": releaseInputSchema(trackSchema),
+		"TagInput": objectSchema(map[string]*Schema{
+			"tag": {Type: "string", MinLength: intPtr(1)},
+		}),
+		"WantedInput": objectSchema(map[string]*Schema{
+			"wanted": booleanSchema(),
+		}),
+		"TracksInput": objectSchema(map[string]*Schema{
+			"tracks": arrayOf(trackSchema),
+		}),
+		"StatusInput": {
+			Type: "object",
+			Properties: map[string]*Schema{
+				"status": {Type: "string", Description: "Empty to put the release back in the collection", Enum: []string{"", statusArchived, statusSold}},
+				"date":   {Type: "string", Description: "Defaults to today, i.e. 2024-05-01", Pattern: `^(\d{4}-\d{2}-\d{2})?$`},
+				"price":  {Type: "string", Description: "Sold releases only, i.e. 25 or 12.50"},
+				"note":   {Type: "string", Description: "i.e. who bought it"},
+			},
+			Required:             []string{"status"},
+			AdditionalProperties: boolPtr(false),
+		},
+	}
+
+	jobStarted := jsonResponse("The job was started, follow it with getJob", dataEnvelope(ref("Job")))
+	jobConflict := errorResponse("Another scrape, import or sync is already running")
+	jobResponse := jsonResponse("The job", dataEnvelope(ref("Job")))
+	jobIDParam := Parameter{Name: "id", In: "path", Required: true, Schema: integerSchema()}
+	releaseResponse := jsonResponse("The release", dataEnvelope(ref("Release")))
+	notFound := errorResponse("Release not found")
+	badRequest := errorResponse("Invalid request")
+	changesResponse := jsonResponse("Changes, newest first", dataEnvelope(arrayOf(ref("ReleaseChange"))))
+	undoResponse := jsonResponse("The changes made by the undo", dataEnvelope(arrayOf(ref("ReleaseChange"))))
+	undoConflict := errorResponse("Already undone, or the release changed since and the later changes must be undone first")
+
+	doc.Paths = map[string]map[string]*Operation{
+		"/releases": {
+			"get": {
+				OperationID: "listReleases",
+				Summary:     "List releases, filters are combined",
+				Parameters: []Parameter{
+					{Name: "artist", In: "query", Description: "Substring of the artist, / separates alternatives", Schema: stringSchema()},
+					{Name: "year", In: "query", Schema: integerSchema()},
+					{Name: "tag", In: "query", Schema: stringSchema()},
+					{Name: "physical", In: "query", Description: "Physical format, i.e. Vinyl", Schema: stringSchema()},
+					{Name: "label", In: "query", Description: "Exact label name", Schema: stringSchema()},
+					{Name: "wanted", In: "query", Schema: booleanSchema()},
+					{Name: "need_scraping", In: "query", Description: "Only releases missing a year, tags or cover", Schema: booleanSchema()},
+					{Name: "status", In: "query", Description: "Archived or sold releases, or former for both and all for every release, instead of the collection and wantlist", Schema: &Schema{Type: "string", Enum: releaseStatusFilters}},
+					{Name: "q", In: "query", Description: "Accent insensitive search on title, artist, year, format and track titles", Schema: stringSchema()},
+					{Name: "sort", In: "query", Description: "Comma separated fields, prefix with - for descending, i.e. artist,-year", Schema: &Schema{Type: "string", Pattern: `^-?[a-z_]+(,-?[a-z_]+)*$`}},
+					{Name: "page", In: "query", Schema: &Schema{Type: "integer", Minimum: float(1)}},
+					{Name: "page_size", In: "query", Schema: &Schema{Type: "integer", Minimum: float(1), Maximum: float(maxPageSize)}},
+				},
+				Responses: map[string]*Response{
+					"200": jsonResponse("A page of releases", objectSchema(map[string]*Schema{
+						"data": arrayOf(ref("Release")),
+						"meta": ref("Meta"),
+					})),
+					"400": badRequest,
+				},
+			},
+			"post": {
+				OperationID: "createRelease",
+				Summary:     "Add a release by hand, without release_id for releases not on Discogs",
+				RequestBody: jsonBody(ref("ReleaseInput")),
+				Responses: map[string]*Response{
+					"201": jsonResponse("The new release", dataEnvelope(ref("Release"))),
+					"400": badRequest,
+					"409": errorResponse("A release with the same release_id, or the same artist, title and catalog number without one, is already in the collection"),
+				},
+			},
+		},
+		"/lookup": {
+			"get": {
+				OperationID: "lookupRelease",
+				Summary:     "Prefill a new release from Discogs by release_id, barcode or artist and title, or from the other metadata providers by artist and title",
+				Parameters: []Parameter{
+					{Name: "release_id", In: "query", Schema: &Schema{Type: "integer", Minimum: float(1)}},
+					{Name: "barcode", In: "query", Schema: stringSchema()},
+					{Name: "artist", In: "query", Schema: stringSchema()},
+					{Name: "title", In: "query", Schema: stringSchema()},
+				},
+				Responses: map[string]*Response{
+					"200": jsonResponse("A release ready to be posted to createRelease", dataEnvelope(ref("ReleaseInput"))),
+					"400": badRequest,
+					"404": errorResponse("No release found"),
+					"502": errorResponse("A metadata provider failed or is not configured"),
+				},
+			},
+		},
+		"/releases/{id}": {
+			"get": {
+				OperationID: "getRelease",
+				Summary:     "Get a release",
+				Parameters:  []Parameter{releaseIDParam},
+				Responses:   map[string]*Response{"200": releaseResponse, "400": badRequest, "404": notFound},
+			},
+			"patch": {
+				OperationID: "updateRelease",
+				Summary:     "Update a release, omitted fields are kept and changed ones marked as edited",
+				Parameters:  []Parameter{releaseIDParam},
+				RequestBody: jsonBody(ref("ReleasePatch")),
+				Responses:   map[string]*Response{"200": releaseResponse, "400": badRequest, "404": notFound},
+			},
+			"delete": {
+				OperationID: "deleteRelease",
+				Summary:     "Delete a release and its cover image, setStatus keeps its history instead",
+				Parameters:  []Parameter{releaseIDParam},
+				Responses:   map[string]*Response{"204": {Description: "Deleted"}, "400": badRequest, "404": notFound},
+			},
+		},
+		"/releases/{id}/tags": {
+			"post": {
+				OperationID: "addTag",
+				Summary:     "Add a tag to a release",
+				Parameters:  []Parameter{releaseIDParam},
+				RequestBody: jsonBody(ref("TagInput")),
+				Responses:   map[string]*Response{"200": releaseResponse, "400": badRequest, "404": notFound},
+			},
+		},
+		"/releases/{id}/tags/{tag}": {
+			"delete": {
+				OperationID: "removeTag",
+				Summary:     "Remove a tag from a release",
+				Parameters:  []Parameter{releaseIDParam, {Name: "tag", In: "path", Required: true, Schema: stringSchema()}},
+				Responses:   map[string]*Response{"200": releaseResponse, "400": badRequest, "404": notFound},
+			},
+		},
+		"/releases/{id}/wanted": {
+			"put": {
+				OperationID: "setWanted",
+				Summary:     "Move a release to or from the wanted list",
+				Parameters:  []Parameter{releaseIDParam},
+				RequestBody: jsonBody(ref("WantedInput")),
+				Responses:   map[string]*Response{"200": releaseResponse, "400": badRequest, "404": notFound},
+			},
+		},
+		"/releases/{id}/tracks": {
+			"put": {
+				OperationID: "setTracks",
+				Summary:     "Replace the tracklist of a release, scraping keeps it afterwards",
+				Parameters:  []Parameter{releaseIDParam},
+				RequestBody: jsonBody(ref("TracksInput")),
+				Responses:   map[string]*Response{"200": releaseResponse, "400": badRequest, "404": notFound},
+			},
+		},
+		"/releases/{id}/status": {
+			"put": {
+				OperationID: "setStatus",
+				Summary:     "Archive, sell or restore a release, archived and sold releases leave the listings and statistics",
+				Parameters:  []Parameter{releaseIDParam},
+				RequestBody: jsonBody(ref("StatusInput")),
+				Responses:   map[string]*Response{"200": releaseResponse, "400": badRequest, "404": notFound},
+			},
+		},
+		"/releases/{id}/history": {
+			"get": {
+				OperationID: "getReleaseHistory",
+				Summary:     "Every recorded change of a release, also once it was deleted",
+				Parameters:  []Parameter{releaseIDParam},
+				Responses:   map[string]*Response{"200": changesResponse, "400": badRequest, "404": notFound},
+			},
+		},
+		"/history": {
+			"get": {
+				OperationID: "listChanges",
+				Summary:     "The 200 most recent changes to the collection, with who made them and where from",
+				Parameters: []Parameter{
+					{Name: "batch", In: "query", Description: "Only the changes of one operation, i.e. an import or renaming an artist everywhere", Schema: stringSchema()},
+				},
+				Responses: map[string]*Response{"200": changesResponse, "400": badRequest},
+			},
+		},
+		"/history/{id}/undo": {
+			"post": {
+				OperationID: "undoChange",
+				Summary:     "Undo a change, as long as the release was not changed again since",
+				Parameters:  []Parameter{{Name: "id", In: "path", Required: true, Schema: integerSchema()}},
+				Responses: map[string]*Response{
+					"200": undoResponse,
+					"400": badRequest,
+					"404": errorResponse("Change not found"),
+					"409": undoConflict,
+				},
+			},
+		},
+		"/history/batches/{batch}/undo": {
+			"post": {
+				OperationID: "undoBatch",
+				Summary:     "Undo every change of an operation, the latest first, or none of them",
+				Parameters:  []Parameter{{Name: "batch", In: "path", Required: true, Schema: stringSchema()}},
+				Responses: map[string]*Response{
+					"200": undoResponse,
+					"400": badRequest,
+					"404": errorResponse("Operation not found"),
+					"409": undoConflict,
+				},
+			},
+		},
+		"/tags": {
+			"get": {
+				OperationID: "listTags",
+				Summary:     "Tags with their number of releases",
+				Responses:   map[string]*Response{"200": jsonResponse("Tag counts", dataEnvelope(statList))},
+			},
+		},
+		"/artists": {
+			"get": {
+				OperationID: "listArtists",
+				Summary:     "Artists with their number of releases",
+				Responses:   map[string]*Response{"200": jsonResponse("Artist counts", dataEnvelope(statList))},
+			},
+		},
+		"/stats": {
+			"get": {
+				OperationID: "getStats",
+				Summary:     "Collection statistics shown on the stats page",
+				Responses:   map[string]*Response{"200": jsonResponse("Statistics", dataEnvelope(ref("Stats")))},
+			},
+		},
+		"/imports": {
+			"post": {
+				OperationID: "importCSV",
+				Summary:     "Import a Discogs CSV export, or another CSV or TSV file with an import profile",
+				RequestBody: &RequestBody{Required: true, Content: map[string]*MediaType{
+					"multipart/form-data": {Schema: &Schema{
+						Type:     "object",
+						Required: []string{"file"},
+						Properties: map[string]*Schema{
+							"file":    {Type: "string", Format: "binary"},
+							"wanted":  {Type: "boolean", Description: "Import into the wanted list"},
+							"update":  {Type: "boolean", Description: "Merge releases already in the collection following IMPORT_MERGE_RULES instead of skipping them"},
+							"profile": {Type: "string", Description: "Import profile mapping the columns of the file, discogs by default"},
+						},
+					}},
+				}},
+				Responses: map[string]*Response{
+					"202": jobStarted,
+					"400": badRequest,
+					"409": jobConflict,
+				},
+			},
+		},
+		"/scrape": {
+			"post": {
+				OperationID: "scrape",
+				Summary:     "Start looking up covers, tags and years of every release in the metadata providers",
+				Responses:   map[string]*Response{"202": jobStarted, "409": jobConflict},
+			},
+		},
+		"/jobs": {
+			"get": {
+				OperationID: "listJobs",
+				Summary:     "The 50 most recent scrape and import jobs",
+				Responses:   map[string]*Response{"200": jsonResponse("Jobs, newest first", dataEnvelope(arrayOf(ref("Job"))))},
+			},
+		},
+		"/jobs/{id}": {
+			"get": {
+				OperationID: "getJob",
+				Summary:     "Get a job with its progress. /jobs/{id}/events on the web server streams it as Server-Sent Events",
+				Parameters:  []Parameter{jobIDParam},
+				Responses:   map[string]*Response{"200": jobResponse, "400": badRequest, "404": errorResponse("Job not found")},
+			},
+		},
+		"/jobs/{id}/cancel": {
+			"post": {
+				OperationID: "cancelJob",
+				Summary:     "Ask a running job to stop after the current item",
+				Parameters:  []Parameter{jobIDParam},
+				Responses: map[string]*Response{
+					"200": jobResponse,
+					"400": badRequest,
+					"404": errorResponse("Job not found"),
+					"409": errorResponse("The job is not running"),
+				},
+			},
+		},
+	}
+	if err := doc.compilePatterns(); err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+// compilePatterns compiles the pattern of every schema once, so validating
+// does not, and a bad pattern stops the application from starting.
+func (doc *OpenAPI) compilePatterns() error {
+	var compile func(s *Schema) error
+	compile = func(s *Schema) error {
+		if s == nil {
+			return nil
+		}
+		if s.Pattern != "" && s.pattern == nil {
+			pattern, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %s: %v", s.Pattern, err)
+			}
+			s.pattern = pattern
+		}
+		for _, property := range s.Properties {
+			if err := compile(property); err != nil {
+				return err
+			}
+		}
+		return compile(s.Items)
+	}
+
+	var schemas []*Schema
+	for _, s := range doc.Components.Schemas {
+		schemas = append(schemas, s)
+	}
+	for _, item := range doc.Paths {
+		for _, op := range item {
+			for _, param := range op.Parameters {
+				schemas = append(schemas, param.Schema)
+			}
+			if op.RequestBody != nil {
+				for _, media := range op.RequestBody.Content {
+					schemas = append(schemas, media.Schema)
+				}
+			}
+			for _, response := range op.Responses {
+				for _, media := range response.Content {
+					schemas = append(schemas, media.Schema)
+				}
+			}
+		}
+	}
+	for _, s := range schemas {
+		if err := compile(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openAPISpec is the document served at /api/openapi.json.
+var openAPISpec = buildOpenAPISpec()
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(openAPISpec); err != nil {
+		log.Printf("Error encoding OpenAPI document: %v", err)
+	}
+}
+
+// resolve follows a local $ref.
+func (doc *OpenAPI) resolve(s *Schema) *Schema {
+	for s.Ref != "" {
+		s = doc.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// findOperation returns the operation matching a path relative to the API
+// base path, along with the path parameters. A nil operation with a non-nil
+// pathItem means the path exists but not for that method.
+func (doc *OpenAPI) findOperation(method, path string) (op *Operation, pathItem map[string]*Operation, params map[string]string) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for template, item := range doc.Paths {
+		templateSegments := strings.Split(strings.Trim(template, "/"), "/")
+		if len(templateSegments) != len(segments) {
+			continue
+		}
+
+		params = make(map[string]string)
+		matched := true
+		for i, segment := range templateSegments {
+			if strings.HasPrefix(segment, "{") {
+				params[strings.Trim(segment, "{}")] = segments[i]
+			} else if segment != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return item[strings.ToLower(method)], item, params
+		}
+	}
+	return nil, nil, nil
+}
+
+// validate checks a decoded JSON value against a schema, returning an error
+// naming the offending location, i.e. "body.year: must be an integer".
+func (doc *OpenAPI) validate(s *Schema, value interface{}, at string) error {
+	s = doc.resolve(s)
+	if value == nil {
+		if s.Nullable || s.Type == "" {
+			return nil
+		}
+		return fmt.Errorf("%s: must not be null", at)
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an object", at)
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s.%s: is required", at, name)
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s.%s: unknown property", at, name)
+				}
+				continue
+			}
+			if err := doc.validate(property, obj[name], at+"."+name); err != nil {
+				return err
+			}
+		}
+
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an array", at)
+		}
+		for i, item := range items {
+			if err := doc.validate(s.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: must be a string", at)
+		}
+		if s.MinLength != nil && len(strings.TrimSpace(str)) < *s.MinLength {
+			return fmt.Errorf("%s: must not be empty", at)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return fmt.Errorf("%s: must match %s", at, s.Pattern)
+		}
+		if len(s.Enum) > 0 && !containsString(s.Enum, str) {
+			return fmt.Errorf("%s: must be one of %s", at, strings.Join(s.Enum, ", "))
+		}
+
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok || (s.Type == "integer" && n != math.Trunc(n)) {
+			return fmt.Errorf("%s: must be an %s", at, s.Type)
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			return fmt.Errorf("%s: must be at least %v", at, *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fmt.Errorf("%s: must be at most %v", at, *s.Maximum)
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: must be a boolean", at)
+		}
+	}
+	return nil
+}
+
+// parameterValue converts a path or query string into the JSON value its
+// schema expects, so it can go through validate.
+func parameterValue(s *Schema, raw string) (interface{}, bool) {
+	switch s.Type {
+	case "integer":
+		n, err := strconv.Atoi(raw)
+		return float64(n), err == nil
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		return b, err == nil
+	}
+	return raw, true
+}
+
+// validateRequest checks the parameters and JSON body of an API request
+// against the document. Paths or methods the document does not know about are
+// left to the handlers, which answer with 404 or 405. The body is restored so
+// handlers can still decode it.
+func (doc *OpenAPI) validateRequest(r *http.Request) error {
+	op, _, pathParams := doc.findOperation(r.Method, strings.TrimPrefix(r.URL.Path, apiBasePath))
+	if op == nil {
+		return nil
+	}
+
+	query := r.URL.Query()
+	for _, param := range op.Parameters {
+		var raw string
+		var present bool
+		if param.In == "path" {
+			raw, present = pathParams[param.Name]
+		} else {
+			raw, present = query.Get(param.Name), query.Has(param.Name)
+		}
+		if !present {
+			if param.Required {
+				return fmt.Errorf("%s: is required", param.Name)
+			}
+			continue
+		}
+
+		value, ok := parameterValue(param.Schema, raw)
+		if !ok {
+			return fmt.Errorf("%s: must be a %s", param.Name, param.Schema.Type)
+		}
+		if err := doc.validate(param.Schema, value, param.Name); err != nil {
+			return err
+		}
+	}
+
+	if op.RequestBody == nil {
+		return nil
+	}
+	media, ok := op.RequestBody.Content["application/json"]
+	if !ok {
+		return nil // Multipart bodies are checked by the handler
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("error reading body: %v", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			return fmt.Errorf("body: is required")
+		}
+		return nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Errorf("body: invalid JSON: %v", err)
+	}
+	return doc.validate(media.Schema, value, "body")
+}
+
+// validateResponse checks a recorded API response against the document.
+func (doc *OpenAPI) validateResponse(method, path string, status int, body []byte) error {
+	op, _, _ := doc.findOperation(method, path)
+	if op == nil {
+		// Unknown paths and methods must still use the error envelope
+		return doc.validateJSON(ref("Error"), body)
+	}
+
+	response, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		return fmt.Errorf("status %d is not documented", status)
+	}
+	media, ok := response.Content["application/json"]
+	if !ok {
+		if len(bytes.TrimSpace(body)) > 0 {
+			return fmt.Errorf("status %d documents no body but got %q", status, body)
+		}
+		return nil
+	}
+	return doc.validateJSON(media.Schema, body)
+}
+
+func (doc *OpenAPI) validateJSON(s *Schema, body []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Errorf("invalid JSON response: %v", err)
+	}
+	return doc.validate(s, value, "response")
+}
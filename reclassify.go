@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// physicalChange is a release whose physical format changes with the current
+// format rules.
+type physicalChange struct {
+	Release Release
+	Old     string
+	New     string
+}
+
+// physicalTransition counts the releases moving between two physical formats.
+type physicalTransition struct {
+	Old   string
+	New   string
+	Count int
+}
+
+// planReclassify classifies the format of every release with rules. Releases
+// whose physical format was edited by hand are left alone.
+func planReclassify(rules []formatRule) ([]physicalChange, error) {
+	releases, err := store.ListReleases(ReleaseQuery{Status: "all", Sort: []SortKey{{Field: "artist"}, {Field: "title"}}})
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []physicalChange
+	for _, release := range releases {
+		if containsString(release.EditedFields, "physical") {
+			continue
+		}
+		if physical := classifyFormat(release.Format, rules); physical != release.Physical {
+			changes = append(changes, physicalChange{Release: release, Old: release.Physical, New: physical})
+		}
+	}
+	return changes, nil
+}
+
+// physicalTransitions summarizes changes, the most common transitions first.
+func physicalTransitions(changes []physicalChange) []physicalTransition {
+	counts := make(map[[2]string]int)
+	for _, change := range changes {
+		counts[[2]string{change.Old, change.New}]++
+	}
+	var transitions []physicalTransition
+	for key, count := range counts {
+		transitions = append(transitions, physicalTransition{Old: key[0], New: key[1], Count: count})
+	}
+	sort.Slice(transitions, func(i, j int) bool {
+		if transitions[i].Count != transitions[j].Count {
+			return transitions[i].Count > transitions[j].Count
+		}
+		return transitions[i].Old+transitions[i].New < transitions[j].Old+transitions[j].New
+	})
+	return transitions
+}
+
+// reclassifyPreviewHandler reloads the format rules and lists the releases
+// whose physical format would change, with a button to apply the changes.
+func reclassifyPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rules, err := reloadFormatRules()
+	if err != nil {
+		log.Printf("Error loading format rules: %v", err)
+		http.Error(w, "Error loading format rules: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	changes, err := planReclassify(rules)
+	if err != nil {
+		log.Printf("Error classifying formats: %v", err)
+		http.Error(w, "Error classifying formats", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Changes     []physicalChange
+		Transitions []physicalTransition
+	}{
+		Changes:     changes,
+		Transitions: physicalTransitions(changes),
+	}
+	if err := Templates.ExecuteTemplate(w, "reclassify-preview", data); err != nil {
+		log.Printf("Error rendering reclassify preview template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// reclassifyHandler applies the current format rules to every release.
+func reclassifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	changes, err := planReclassify(currentFormatRules())
+	if err != nil {
+		log.Printf("Error classifying formats: %v", err)
+		http.Error(w, "Error classifying formats", http.StatusInternalServerError)
+		return
+	}
+	physical := make(map[int]string, len(changes))
+	ids := make([]int, 0, len(changes))
+	for _, change := range changes {
+		physical[change.Release.ID] = change.New
+		ids = append(ids, change.Release.ID)
+	}
+	err = auditReleases(requestOrigin(r, sourceBulk), ids, func() error { return store.SetPhysical(physical) })
+	if err != nil {
+		http.Error(w, "Error saving physical formats", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Reclassified the physical format of %d releases", len(changes))
+	fmt.Fprintf(w, "Reclassified the physical format of %d releases.", len(changes))
+}
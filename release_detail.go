@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// relatedReleasesLimit is the number of other releases by the same artist or
+// on the same label shown on a release page, the rest are a link away.
+const relatedReleasesLimit = 6
+
+// relatedReleases lists other releases matching a query, and how many there
+// are in total.
+type relatedReleases struct {
+	Releases []Release
+	Total    int
+	URL      string // Listing of all of them
+}
+
+func findRelatedReleases(release *Release, q ReleaseQuery, listURL string) (relatedReleases, error) {
+	q.ExcludeID = release.ID
+	q.Sort = []SortKey{{Field: "year"}, {Field: "title"}}
+	q.Limit = relatedReleasesLimit
+	releases, err := store.ListReleases(q)
+	if err != nil {
+		return relatedReleases{}, err
+	}
+	total, err := store.CountReleases(q)
+	if err != nil {
+		return relatedReleases{}, err
+	}
+	return relatedReleases{Releases: releases, Total: total, URL: listURL}, nil
+}
+
+// discogsReleaseURL links to the Discogs page of a release, "" for releases
+// that do not come from Discogs (i.e. imported with a profile without release_id).
+func discogsReleaseURL(releaseID int) string {
+	if releaseID <= 0 {
+		return ""
+	}
+	base := strings.TrimSuffix(getEnvWithDefault("DISCOGS_WEB_URL", "https://www.discogs.com"), "/")
+	return fmt.Sprintf("%s/release/%d", base, releaseID)
+}
+
+// releaseDetailHandler shows every field of a release at /release/{id}, with
+// its tracklist and links to other releases by the same artist and on the
+// same label.
+func releaseDetailHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	release, err := store.GetRelease(id)
+	if err != nil {
+		http.Error(w, "Release not found", http.StatusNotFound)
+		return
+	}
+
+	var byArtist, onLabel relatedReleases
+	if release.Artist != "" {
+		byArtist, err = findRelatedReleases(release, ReleaseQuery{ExactArtist: release.Artist}, "/artist/"+url.PathEscape(release.Artist))
+		if err != nil {
+			log.Printf("Error fetching releases by %s: %v", release.Artist, err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if release.Label != "" {
+		onLabel, err = findRelatedReleases(release, ReleaseQuery{Label: release.Label}, "/releases?label="+url.QueryEscape(release.Label))
+		if err != nil {
+			log.Printf("Error fetching releases on %s: %v", release.Label, err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data := struct {
+		*Release
+		Title      string
+		Template   string
+		DiscogsURL string
+		ByArtist   relatedReleases
+		OnLabel    relatedReleases
+	}{
+		Release:    release,
+		Title:      release.Title,
+		Template:   "release-detail",
+		DiscogsURL: discogsReleaseURL(release.ReleaseID),
+		ByArtist:   byArtist,
+		OnLabel:    onLabel,
+	}
+	if err := Templates.ExecuteTemplate(w, "base.html", data); err != nil {
+		log.Printf("Error rendering release detail template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFindRelatedReleases(t *testing.T) {
+	// The release sorts after the releases shown, and its artist is part of
+	// another one's name
+	releases := []Release{
+		{ID: 1, ReleaseID: 1, Artist: "Yoko Ono", Title: "Take Me to the Land of Hell", Year: 2013},
+		{ID: 2, ReleaseID: 2, Artist: "John Lennon / Yoko Ono", Title: "Double Fantasy", Year: 1980},
+	}
+	for i := 0; i < relatedReleasesLimit+2; i++ {
+		releases = append(releases, Release{ID: 10 + i, ReleaseID: 10 + i, Artist: "Yoko Ono", Title: fmt.Sprintf("Album %d", i), Year: 1970 + i})
+	}
+	store = newMemoryStore(releases...)
+
+	release, err := store.GetRelease(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	related, err := findRelatedReleases(release, ReleaseQuery{ExactArtist: release.Artist}, "/artist/Yoko%20Ono")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if related.Total != relatedReleasesLimit+2 {
+		t.Errorf("Total = %d, want %d", related.Total, relatedReleasesLimit+2)
+	}
+	if len(related.Releases) != relatedReleasesLimit {
+		t.Fatalf("shows %d releases, want %d", len(related.Releases), relatedReleasesLimit)
+	}
+	for i, r := range related.Releases {
+		if r.ID != 10+i {
+			t.Errorf("release %d is %d %s, want the albums by year", i, r.ID, r.Title)
+		}
+	}
+}
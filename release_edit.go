@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mediaConditions are the Goldmine grades used by Discogs for records, from
+// best to worst.
+var mediaConditions = []string{
+	"Mint (M)",
+	"Near Mint (NM or M-)",
+	"Very Good Plus (VG+)",
+	"Very Good (VG)",
+	"Good Plus (G+)",
+	"Good (G)",
+	"Fair (F)",
+	"Poor (P)",
+}
+
+// sleeveConditions adds the sleeve-only grades of Discogs.
+var sleeveConditions = append(append([]string{}, mediaConditions...), "Generic", "Not Graded", "No Cover")
+
+// releasedDate matches the release dates of the Discogs export, a year with
+// an optional month and day, i.e. "1993" or "1993-07-05".
+var releasedDate = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// Edited reports whether a field, named as in EditedFields, was changed
+// locally rather than imported.
+func (r Release) Edited(field string) bool {
+	return containsString(r.EditedFields, field)
+}
+
+// releaseUpdateFrom returns an update keeping every field of a release, for
+// callers changing only some of them.
+func releaseUpdateFrom(r Release) ReleaseUpdate {
+	return ReleaseUpdate{
+		Title:                     r.Title,
+		Artist:                    r.Artist,
+		Year:                      r.Year,
+		CatalogNumber:             r.CatalogNumber,
+		Label:                     r.Label,
+		Format:                    r.Format,
+		Physical:                  r.Physical,
+		Rating:                    r.Rating,
+		Released:                  r.Released,
+		CollectionFolder:          r.CollectionFolder,
+		DateAdded:                 r.DateAdded,
+		CollectionMediaCondition:  r.CollectionMediaCondition,
+		CollectionSleeveCondition: r.CollectionSleeveCondition,
+		CollectionNotes:           r.CollectionNotes,
+	}
+}
+
+// trimmed removes the surrounding spaces of the text fields, notes excepted.
+func (u ReleaseUpdate) trimmed() ReleaseUpdate {
+	for _, value := range []*string{&u.Title, &u.Artist, &u.CatalogNumber, &u.Label, &u.Format, &u.Physical,
+		&u.Rating, &u.Released, &u.CollectionFolder, &u.DateAdded, &u.CollectionMediaCondition, &u.CollectionSleeveCondition} {
+		*value = strings.TrimSpace(*value)
+	}
+	return u
+}
+
+// applyReleaseUpdate returns the release as changed by an update, with the
+// changed fields added to EditedFields so re-imports keep them. A new format
+// is classified again unless the physical format was changed too.
+func applyReleaseUpdate(current Release, u ReleaseUpdate) Release {
+	updated := current
+	updated.Title = u.Title
+	updated.Artist = u.Artist
+	updated.Year = u.Year
+	updated.CatalogNumber = u.CatalogNumber
+	updated.Label = u.Label
+	updated.Format = u.Format
+	updated.Physical = u.Physical
+	updated.Rating = u.Rating
+	updated.Released = u.Released
+	updated.CollectionFolder = u.CollectionFolder
+	updated.DateAdded = u.DateAdded
+	updated.CollectionMediaCondition = u.CollectionMediaCondition
+	updated.CollectionSleeveCondition = u.CollectionSleeveCondition
+	updated.CollectionNotes = u.CollectionNotes
+	if u.CoverImage != "" {
+		updated.CoverImage = u.CoverImage
+	}
+	if u.ConvertToOwned {
+		updated.Wanted = false
+	}
+	updated.Tags = replaceDecadeTag(current.Tags, u.Year)
+
+	edited := editedFields(current, updated)
+	if updated.Format != current.Format && updated.Physical == current.Physical {
+		// Not an edit of the physical format, reclassify may change it again
+		if physical := determinePhysicalFormat(updated.Format); physical != "" {
+			updated.Physical = physical
+		}
+	}
+	updated.EditedFields = addFields(current.EditedFields, edited...)
+	return updated
+}
+
+// releaseFieldErrors maps field names, as in EditedFields, to what is wrong
+// with their new value.
+type releaseFieldErrors map[string]string
+
+func (e releaseFieldErrors) Error() string {
+	var messages []string
+	for field, message := range e {
+		messages = append(messages, field+": "+message)
+	}
+	sort.Strings(messages)
+	return "invalid release: " + strings.Join(messages, ", ")
+}
+
+// validateReleaseUpdate checks an update of a release. Imported values are
+// only checked when changed, so a release with an unusual grade from Discogs
+// can still be edited.
+func validateReleaseUpdate(current Release, u ReleaseUpdate) error {
+	errs := make(releaseFieldErrors)
+	changed := func(field, value string) bool {
+		for _, f := range importFields {
+			if f.Name == field {
+				return value != "" && value != *f.get(&current)
+			}
+		}
+		return value != ""
+	}
+
+	if u.Title == "" {
+		errs["title"] = "cannot be empty"
+	}
+	if u.Artist == "" {
+		errs["artist"] = "cannot be empty"
+	}
+	if u.Year < 0 {
+		errs["year"] = "cannot be negative"
+	}
+	if changed("rating", u.Rating) {
+		if rating, err := strconv.Atoi(u.Rating); err != nil || rating < 0 || rating > 5 {
+			errs["rating"] = "must be a whole number from 0 to 5"
+		}
+	}
+	if changed("released", u.Released) && !releasedDate.MatchString(u.Released) {
+		errs["released"] = "must be a year or a date like 1993-07-05"
+	}
+	if changed("date_added", u.DateAdded) {
+		if _, err := time.Parse(discogsDateAddedLayout, u.DateAdded); err != nil {
+			errs["date_added"] = fmt.Sprintf("must be a date and time like %s", discogsDateAddedLayout)
+		}
+	}
+	if changed("collection_media_condition", u.CollectionMediaCondition) && !containsString(mediaConditions, u.CollectionMediaCondition) {
+		errs["collection_media_condition"] = "must be a Goldmine grade, i.e. " + mediaConditions[1]
+	}
+	if changed("collection_sleeve_condition", u.CollectionSleeveCondition) && !containsString(sleeveConditions, u.CollectionSleeveCondition) {
+		errs["collection_sleeve_condition"] = "must be a Goldmine grade, Generic, Not Graded or No Cover"
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// releaseUpdateFromForm reads the fields of the edit form.
+func releaseUpdateFromForm(r *http.Request) (ReleaseUpdate, error) {
+	u := ReleaseUpdate{
+		Title:                     r.FormValue("title"),
+		Artist:                    r.FormValue("artist"),
+		CatalogNumber:             r.FormValue("catalog_number"),
+		Label:                     r.FormValue("label"),
+		Format:                    r.FormValue("format"),
+		Physical:                  r.FormValue("physical"),
+		Rating:                    r.FormValue("rating"),
+		Released:                  r.FormValue("released"),
+		CollectionFolder:          r.FormValue("collection_folder"),
+		DateAdded:                 r.FormValue("date_added"),
+		CollectionMediaCondition:  r.FormValue("collection_media_condition"),
+		CollectionSleeveCondition: r.FormValue("collection_sleeve_condition"),
+		CollectionNotes:           r.FormValue("collection_notes"),
+		ConvertToOwned:            r.FormValue("convert_to_owned") == "on",
+	}.trimmed()
+
+	if year := strings.TrimSpace(r.FormValue("year")); year != "" {
+		var err error
+		if u.Year, err = strconv.Atoi(year); err != nil {
+			return u, releaseFieldErrors{"year": "must be a number"}
+		}
+	}
+	return u, nil
+}
+
+// renderEditPage shows the edit form of a release, with the errors of a
+// rejected update next to their fields.
+func renderEditPage(w http.ResponseWriter, release *Release, errs releaseFieldErrors, status int) {
+	data := struct {
+		*Release
+		Title            string
+		Template         string
+		Errors           releaseFieldErrors
+		MediaConditions  []string
+		SleeveConditions []string
+	}{
+		Release:          release,
+		Title:            release.Title,
+		Template:         "edit",
+		Errors:           errs,
+		MediaConditions:  mediaConditions,
+		SleeveConditions: sleeveConditions,
+	}
+	w.WriteHeader(status)
+	if err := Templates.ExecuteTemplate(w, "base.html", data); err != nil {
+		log.Printf("Error rendering edit template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// updateReleaseHandler saves the edit form posted to /release/{id}/update and
+// goes to the release page, or shows the form again with what is invalid.
+func updateReleaseHandler(w http.ResponseWriter, r *http.Request, id int) {
+	// Parse the multipart form data
+	if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB max
+		log.Printf("Error parsing multipart form: %v", err)
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	release, err := store.GetRelease(id)
+	if err != nil {
+		http.Error(w, "Release not found", http.StatusNotFound)
+		return
+	}
+
+	update, err := releaseUpdateFromForm(r)
+	if err == nil {
+		err = validateReleaseUpdate(*release, update)
+	}
+	if errs, ok := err.(releaseFieldErrors); ok {
+		// Show the submitted values, marked as edited only once saved
+		submitted := applyReleaseUpdate(*release, update)
+		submitted.EditedFields = release.EditedFields
+		renderEditPage(w, &submitted, errs, http.StatusBadRequest)
+		return
+	}
+
+	update.CoverImage, err = saveUploadedCover(r, release)
+	if err != nil {
+		http.Error(w, "Error saving cover image", http.StatusInternalServerError)
+		return
+	}
+	origin := requestOrigin(r, sourceEdit)
+	err = auditRelease(origin, id, func() error { return store.UpdateRelease(id, update) })
+	if err != nil {
+		http.Error(w, "Error updating release", http.StatusInternalServerError)
+		return
+	}
+
+	// The rename shares the batch of the edit, undoing the operation undoes both
+	oldArtist := r.FormValue("old_artist")
+	if r.FormValue("update_all_artist_occurrencies") == "on" && update.Artist != oldArtist {
+		if err := renameArtist(origin.withSource(sourceBulk), oldArtist, update.Artist); err != nil {
+			log.Printf("Error updating all artist occurrences: %v", err)
+			http.Error(w, "Error updating release", http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Redirect(w, r, "/release/"+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// renameArtist renames an artist on every release, logging the change of
+// each one, formerly owned releases included.
+func renameArtist(origin changeOrigin, oldArtist, newArtist string) error {
+	releases, err := store.ListReleases(ReleaseQuery{Artist: oldArtist, Status: "all"})
+	if err != nil {
+		return err
+	}
+	// The artist filter also matches parts of names
+	var ids []int
+	for _, release := range releases {
+		if release.Artist == oldArtist {
+			ids = append(ids, release.ID)
+		}
+	}
+	return auditReleases(origin, ids, func() error { return store.RenameArtist(oldArtist, newArtist) })
+}
+
+// saveUploadedCover stores the cover uploaded with the edit form as
+// web/static/covers/{release_id}.{ext}, "" when none was uploaded.
+func saveUploadedCover(r *http.Request, release *Release) (string, error) {
+	file, header, err := r.FormFile("cover")
+	if err == http.ErrMissingFile {
+		return "", nil
+	}
+	if err != nil {
+		log.Printf("Error getting form file: %v", err)
+		return "", err
+	}
+	defer file.Close()
+
+	// Create the covers directory if it doesn't exist
+	coverDir := "web/static/covers"
+	if err := os.MkdirAll(coverDir, 0755); err != nil {
+		log.Printf("Error creating covers directory: %v", err)
+		return "", err
+	}
+
+	// Name the cover after the release_id, keeping the extension of the upload
+	coverImage := strconv.Itoa(release.ReleaseID) + filepath.Ext(header.Filename)
+	dst, err := os.Create(filepath.Join(coverDir, coverImage))
+	if err != nil {
+		log.Printf("Error creating destination file: %v", err)
+		return "", err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, file); err != nil {
+		log.Printf("Error copying file: %v", err)
+		return "", err
+	}
+	return coverImage, nil
+}
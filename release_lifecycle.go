@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Releases leave the collection in one of two ways. Deleting one removes it,
+// with its cover image, and is meant for mistakes; only its history keeps
+// it. Archiving or selling one keeps it, with when and to whom it went, out
+// of the listings and statistics and on the "formerly owned" page instead.
+
+// statusDateLayout is the layout of the date a release was archived or sold.
+const statusDateLayout = "2006-01-02"
+
+// salePrice matches the amounts accepted as a sale price, i.e. "25" or "12,50".
+var salePrice = regexp.MustCompile(`^\d+([.,]\d{1,2})?$`)
+
+// checkReleaseStatus trims and checks a new status for a release. The date
+// defaults to today, and restoring a release clears its history.
+func checkReleaseStatus(current Release, s ReleaseStatus) (ReleaseStatus, error) {
+	s = ReleaseStatus{
+		Status: strings.TrimSpace(s.Status),
+		Date:   strings.TrimSpace(s.Date),
+		Price:  strings.TrimSpace(s.Price),
+		Note:   strings.TrimSpace(s.Note),
+	}
+	if s.Status == "" {
+		return ReleaseStatus{}, nil
+	}
+
+	errs := make(releaseFieldErrors)
+	switch {
+	case s.Status != statusArchived && s.Status != statusSold:
+		errs["status"] = "must be archived or sold"
+	case current.Wanted:
+		errs["status"] = "wanted releases are deleted, not archived or sold"
+	}
+	if s.Date == "" {
+		s.Date = time.Now().Format(statusDateLayout)
+	} else if _, err := time.Parse(statusDateLayout, s.Date); err != nil {
+		errs["date"] = "must be a date like 2024-05-01"
+	}
+	if s.Price != "" {
+		if s.Status != statusSold {
+			errs["price"] = "only sold releases have a price"
+		} else if !salePrice.MatchString(s.Price) {
+			errs["price"] = "must be an amount like 25 or 12.50"
+		}
+	}
+
+	if len(errs) > 0 {
+		return s, errs
+	}
+	return s, nil
+}
+
+// deleteRelease deletes a release, along with its cover image. Its
+// fields stay in the history, where undoing the deletion brings it back.
+func deleteRelease(origin changeOrigin, id int) error {
+	auditWrites.Lock()
+	defer auditWrites.Unlock()
+
+	release, err := store.GetRelease(id)
+	if err != nil {
+		return err
+	}
+	// Logged with the deletion, a release gone from the history could not be restored
+	change, _ := newReleaseChange(origin, release, nil)
+	if _, err := changeStore.DeleteAndLog(change); err != nil {
+		return err
+	}
+	removeCoverImage(release.CoverImage)
+	return nil
+}
+
+// removeCoverImage deletes a cover from web/static/covers. The release is
+// already gone by then, so a failure is only logged.
+func removeCoverImage(coverImage string) {
+	if coverImage == "" {
+		return
+	}
+	err := os.Remove(filepath.Join("web/static/covers", filepath.Base(coverImage)))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing cover image %s: %v", coverImage, err)
+	}
+}
+
+// releaseStatusFromForm reads the archive form of the remove page.
+func releaseStatusFromForm(r *http.Request) ReleaseStatus {
+	return ReleaseStatus{
+		Status: r.FormValue("status"),
+		Date:   r.FormValue("date"),
+		Price:  r.FormValue("price"),
+		Note:   r.FormValue("note"),
+	}
+}
+
+// renderRemovePage shows the page offering to archive, sell or delete a
+// release, with the errors of a rejected status next to their fields.
+func renderRemovePage(w http.ResponseWriter, release *Release, form ReleaseStatus, errs releaseFieldErrors, status int) {
+	data := struct {
+		*Release
+		Title    string
+		Template string
+		Form     ReleaseStatus
+		Errors   releaseFieldErrors
+	}{
+		Release:  release,
+		Title:    release.Title,
+		Template: "remove-release",
+		Form:     form,
+		Errors:   errs,
+	}
+	w.WriteHeader(status)
+	if err := Templates.ExecuteTemplate(w, "base.html", data); err != nil {
+		log.Printf("Error rendering remove release template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// removeReleaseHandler shows the remove page of a release at
+// /release/{id}/remove, prefilled with its current status if it has one.
+func removeReleaseHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	release, err := store.GetRelease(id)
+	if err != nil {
+		http.Error(w, "Release not found", http.StatusNotFound)
+		return
+	}
+
+	form := ReleaseStatus{Status: statusSold, Date: time.Now().Format(statusDateLayout)}
+	if release.Status != "" {
+		form = ReleaseStatus{Status: release.Status, Date: release.StatusDate, Price: release.SalePrice, Note: release.StatusNote}
+	}
+	renderRemovePage(w, release, form, nil, http.StatusOK)
+}
+
+// archiveReleaseHandler saves the archive form posted to /release/{id}/archive.
+// It also corrects the history of a release already archived or sold.
+func archiveReleaseHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	release, err := store.GetRelease(id)
+	if err != nil {
+		http.Error(w, "Release not found", http.StatusNotFound)
+		return
+	}
+
+	form := releaseStatusFromForm(r)
+	if form.Status == "" {
+		// Restoring goes through its own button
+		form.Status = statusArchived
+	}
+	status, err := checkReleaseStatus(*release, form)
+	if errs, ok := err.(releaseFieldErrors); ok {
+		renderRemovePage(w, release, status, errs, http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Marking release ID %d as %s", id, status.Status)
+	err = auditRelease(requestOrigin(r, sourceEdit), id, func() error { return store.SetStatus(id, status) })
+	if err != nil {
+		http.Error(w, "Error updating release", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/release/"+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// restoreReleaseHandler puts an archived or sold release back in the
+// collection, at /release/{id}/restore.
+func restoreReleaseHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	log.Printf("Restoring release ID %d", id)
+	err := auditRelease(requestOrigin(r, sourceEdit), id, func() error { return store.SetStatus(id, ReleaseStatus{}) })
+	if err != nil {
+		if err == errReleaseNotFound {
+			http.Error(w, "Release not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error updating release", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/release/"+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// deleteReleaseHandler deletes a release confirmed on the remove page, at
+// /release/{id}/delete.
+func deleteReleaseHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	log.Printf("Deleting release ID %d", id)
+	if err := deleteRelease(requestOrigin(r, sourceEdit), id); err != nil {
+		if err == errReleaseNotFound {
+			http.Error(w, "Release not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error deleting release", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// formerStatusTitles are the titles of the formerly owned listing by status.
+var formerStatusTitles = map[string]string{
+	"former":       "Formerly Owned",
+	statusArchived: "Archived Releases",
+	statusSold:     "Sold Releases",
+}
+
+// formerReleasesHandler lists the archived and sold releases at
+// /releases/former, the last ones to go first. ?status=sold or
+// ?status=archived narrows it to one status.
+func formerReleasesHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "former"
+	}
+	title, ok := formerStatusTitles[status]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Invalid status: %s", status), http.StatusBadRequest)
+		return
+	}
+
+	sortKeys, err := parseSort(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(sortKeys) == 0 {
+		sortKeys = []SortKey{{Field: "status_date", Desc: true}}
+	}
+
+	releases, pagination, err := listReleasesPage(r, ReleaseQuery{Status: status, Sort: sortKeys})
+	if err != nil {
+		log.Printf("Error fetching former releases: %v", err)
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Releases   []Release
+		Title      string
+		Template   string
+		Status     string
+		Pagination Pagination
+	}{
+		Releases:   releases,
+		Title:      constructTitle(title, pagination.Total),
+		Template:   "former-releases",
+		Status:     status,
+		Pagination: pagination,
+	}
+	if err := Templates.ExecuteTemplate(w, "base.html", data); err != nil {
+		log.Printf("Error rendering former releases template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
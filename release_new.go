@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// releaseDraft is a release added by hand, as posted by the add release form
+// or to POST /api/v1/releases, and as prefilled by a lookup. Only the title
+// and artist are required.
+type releaseDraft struct {
+	ReleaseID                 int      `json:"release_id"` // 0 for releases not on Discogs
+	Title                     string   `json:"title"`
+	Artist                    string   `json:"artist"`
+	Year                      int      `json:"year"`
+	CatalogNumber             string   `json:"catalog_number"`
+	Label                     string   `json:"label"`
+	Format                    string   `json:"format"`
+	Physical                  string   `json:"physical"` // Classified from the format when empty
+	Rating                    string   `json:"rating"`
+	Released                  string   `json:"released"`
+	CollectionFolder          string   `json:"collection_folder"`
+	DateAdded                 string   `json:"date_added"` // Now when empty
+	CollectionMediaCondition  string   `json:"collection_media_condition"`
+	CollectionSleeveCondition string   `json:"collection_sleeve_condition"`
+	CollectionNotes           string   `json:"collection_notes"`
+	Wanted                    bool     `json:"wanted"`
+	Tags                      []string `json:"tags"`
+	Tracks                    []Track  `json:"tracks"`
+	CoverURL                  string   `json:"cover_url"` // Downloaded as the cover image
+}
+
+// update returns the fields a draft shares with the edit form, so they are
+// checked the same way.
+func (d releaseDraft) update() ReleaseUpdate {
+	return ReleaseUpdate{
+		Title:                     d.Title,
+		Artist:                    d.Artist,
+		Year:                      d.Year,
+		CatalogNumber:             d.CatalogNumber,
+		Label:                     d.Label,
+		Format:                    d.Format,
+		Physical:                  d.Physical,
+		Rating:                    d.Rating,
+		Released:                  d.Released,
+		CollectionFolder:          d.CollectionFolder,
+		DateAdded:                 d.DateAdded,
+		CollectionMediaCondition:  d.CollectionMediaCondition,
+		CollectionSleeveCondition: d.CollectionSleeveCondition,
+		CollectionNotes:           d.CollectionNotes,
+	}
+}
+
+// draftFromUpdate is the inverse of update.
+func draftFromUpdate(u ReleaseUpdate) releaseDraft {
+	return releaseDraft{
+		Title:                     u.Title,
+		Artist:                    u.Artist,
+		Year:                      u.Year,
+		CatalogNumber:             u.CatalogNumber,
+		Label:                     u.Label,
+		Format:                    u.Format,
+		Physical:                  u.Physical,
+		Rating:                    u.Rating,
+		Released:                  u.Released,
+		CollectionFolder:          u.CollectionFolder,
+		DateAdded:                 u.DateAdded,
+		CollectionMediaCondition:  u.CollectionMediaCondition,
+		CollectionSleeveCondition: u.CollectionSleeveCondition,
+		CollectionNotes:           u.CollectionNotes,
+	}
+}
+
+// checkReleaseDraft trims a draft and checks it like an edit of an empty
+// release, along with the release_id, tracklist and cover URL.
+func checkReleaseDraft(d releaseDraft) (releaseDraft, error) {
+	checked := draftFromUpdate(d.update().trimmed())
+	checked.ReleaseID = d.ReleaseID
+	checked.Wanted = d.Wanted
+	checked.CoverURL = strings.TrimSpace(d.CoverURL)
+	for _, tag := range d.Tags {
+		if tag = strings.TrimSpace(tag); tag != "" && !containsString(checked.Tags, tag) {
+			checked.Tags = append(checked.Tags, tag)
+		}
+	}
+
+	errs := make(releaseFieldErrors)
+	if err := validateReleaseUpdate(Release{}, checked.update()); err != nil {
+		errs = err.(releaseFieldErrors)
+	}
+	if checked.ReleaseID < 0 {
+		errs["release_id"] = "cannot be negative"
+	}
+	var err error
+	if checked.Tracks, err = cleanTracks(d.Tracks); err != nil {
+		errs["tracks"] = err.Error()
+	}
+	if checked.CoverURL != "" {
+		if u, err := url.Parse(checked.CoverURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs["cover_url"] = "must be an http or https URL"
+		}
+	}
+
+	if len(errs) > 0 {
+		return checked, errs
+	}
+	return checked, nil
+}
+
+// release returns the release to store for a checked draft. Releases that are
+// not on Discogs get a synthetic release_id, like rows imported with a
+// profile without one, so adding them twice is noticed too.
+func (d releaseDraft) release() Release {
+	r := applyReleaseUpdate(Release{}, d.update())
+	r.EditedFields = nil // Nothing to keep from imports yet
+	r.ReleaseID = d.ReleaseID
+	if r.ReleaseID == 0 {
+		r.ReleaseID = syntheticReleaseID(r.Artist, r.Title, r.CatalogNumber, r.Format)
+	}
+	if r.DateAdded == "" {
+		r.DateAdded = time.Now().Format(discogsDateAddedLayout)
+	}
+	r.Wanted = d.Wanted
+	r.Tags = replaceDecadeTag(d.Tags, d.Year)
+	r.Tracks = d.Tracks
+	return r
+}
+
+// addMetadata fills the draft fields still empty with what a provider knows.
+func (d *releaseDraft) addMetadata(metadata *Metadata) {
+	if d.Year == 0 {
+		d.Year = metadata.Year
+	}
+	if len(metadata.Released) > len(d.Released) {
+		d.Released = metadata.Released
+	}
+	if d.Label == "" {
+		d.Label = metadata.Label
+	}
+	d.Tags = append(d.Tags, metadata.Tags...)
+	if len(d.Tracks) == 0 {
+		d.Tracks = tracksFromMetadata(metadata.Tracks)
+	}
+	if d.CoverURL == "" && len(metadata.CoverURLs) > 0 {
+		d.CoverURL = metadata.CoverURLs[0]
+	}
+}
+
+// CreateRelease inserts a release with its media and tracklist, unless its
+// release_id is already in the collection.
+func (s *sqlStore) CreateRelease(r Release) (int, error) {
+	var existing int
+	err := s.db.QueryRow("SELECT id FROM releases WHERE release_id = $1", r.ReleaseID).Scan(&existing)
+	if err == nil {
+		return existing, errReleaseExists
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("Error looking up release %d: %v", r.ReleaseID, err)
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := insertRelease(tx, r)
+	if err != nil {
+		return 0, err
+	}
+	if err := insertTracks(tx, id, r.Tracks); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// addRelease stores a checked draft and downloads its cover, returning the ID
+// of the new release, or of the existing one with errReleaseExists. The cover
+// is downloaded first, so the release is created and logged with it as one
+// change without waiting on the network.
+func addRelease(ctx context.Context, origin changeOrigin, d releaseDraft) (int, error) {
+	release := d.release()
+
+	// The release is kept without a cover, scraping can find one later
+	var cover []byte
+	if d.CoverURL != "" {
+		var err error
+		if cover, err = downloadCoverImage(ctx, d.CoverURL); err != nil {
+			log.Printf("Error downloading the cover of release %d: %v", release.ReleaseID, err)
+		}
+	}
+
+	auditWrites.Lock()
+	defer auditWrites.Unlock()
+
+	id, err := store.CreateRelease(release)
+	if err != nil {
+		return id, err
+	}
+	log.Printf("Added release %d: %s - %s", release.ReleaseID, release.Artist, release.Title)
+
+	if cover != nil {
+		coverImage, err := saveCoverImage(release.ReleaseID, cover)
+		if err == nil {
+			err = store.SetCoverImage(id, coverImage)
+		}
+		if err != nil {
+			return id, err
+		}
+	}
+
+	created, err := store.GetRelease(id)
+	if err != nil {
+		return id, err
+	}
+	_, err = recordChange(origin, nil, created)
+	return id, err
+}
+
+// releaseLookup is what a new release can be prefilled from.
+type releaseLookup struct {
+	ReleaseID int // Discogs release_id
+	Barcode   string
+	Artist    string
+	Title     string
+}
+
+func releaseLookupFromQuery(query url.Values) (releaseLookup, error) {
+	lookup := releaseLookup{
+		Barcode: strings.TrimSpace(query.Get("barcode")),
+		Artist:  strings.TrimSpace(query.Get("artist")),
+		Title:   strings.TrimSpace(query.Get("title")),
+	}
+	if id := strings.TrimSpace(query.Get("release_id")); id != "" {
+		var err error
+		if lookup.ReleaseID, err = strconv.Atoi(id); err != nil || lookup.ReleaseID <= 0 {
+			return lookup, errors.New("invalid release ID: " + id)
+		}
+	}
+	return lookup, nil
+}
+
+func (l releaseLookup) empty() bool {
+	return l == releaseLookup{}
+}
+
+// complete reports whether there is enough to look a release up with.
+func (l releaseLookup) complete() bool {
+	return l.ReleaseID > 0 || l.Barcode != "" || (l.Artist != "" && l.Title != "")
+}
+
+// prefillRelease looks up a release to add. Discogs is asked first, by
+// release_id or searching the barcode or the artist and title, then the
+// providers in METADATA_PROVIDERS by artist and title, which know no format
+// or catalog number.
+func prefillRelease(ctx context.Context, lookup releaseLookup) (releaseDraft, error) {
+	client, err := newDiscogsClient()
+	if err == nil {
+		draft, err := prefillFromDiscogs(ctx, client, lookup)
+		if !errors.Is(err, errNoMetadata) {
+			return draft, err
+		}
+	} else if lookup.Artist == "" || lookup.Title == "" {
+		// Release IDs and barcodes are only known to Discogs
+		return releaseDraft{}, err
+	}
+	if lookup.Artist == "" || lookup.Title == "" {
+		return releaseDraft{}, errNoMetadata
+	}
+
+	providers, err := getMetadataProviders()
+	if err != nil {
+		return releaseDraft{}, err
+	}
+	metadata, err := lookupMetadata(ctx, providers, Release{Artist: lookup.Artist, Title: lookup.Title}, log.Printf)
+	if err != nil {
+		return releaseDraft{}, err
+	}
+	draft := releaseDraft{Artist: lookup.Artist, Title: lookup.Title}
+	draft.addMetadata(metadata)
+	return draft, nil
+}
+
+// prefillFromDiscogs gets the release with the release_id of the lookup, or
+// else the first one found by barcode, or else by artist and title.
+func prefillFromDiscogs(ctx context.Context, client *discogsClient, lookup releaseLookup) (releaseDraft, error) {
+	releaseID := lookup.ReleaseID
+	err := errNoMetadata
+	if releaseID == 0 && lookup.Barcode != "" {
+		releaseID, err = client.searchRelease(ctx, url.Values{"barcode": {lookup.Barcode}})
+	}
+	if releaseID == 0 && errors.Is(err, errNoMetadata) && lookup.Artist != "" && lookup.Title != "" {
+		releaseID, err = client.searchRelease(ctx, url.Values{"artist": {lookup.Artist}, "release_title": {lookup.Title}})
+	}
+	if releaseID == 0 {
+		return releaseDraft{}, err
+	}
+
+	dr, err := client.release(ctx, releaseID)
+	if err != nil {
+		return releaseDraft{}, err
+	}
+	// The same fields as a Discogs sync, and the rest like scraping does
+	release := syncedFromBasicInformation(dr.discogsBasicInformation)
+	draft := releaseDraft{
+		ReleaseID:     release.ReleaseID,
+		Title:         release.Title,
+		Artist:        release.Artist,
+		CatalogNumber: release.CatalogNumber,
+		Label:         release.Label,
+		Format:        release.Format,
+		Released:      release.Released,
+	}
+	draft.addMetadata(client.metadata(dr))
+	return draft, nil
+}
+
+// releaseDraftFromForm reads and checks the add release form, the same fields
+// as the edit form plus the release_id, tags, tracklist and looked up cover.
+func releaseDraftFromForm(r *http.Request) (releaseDraft, error) {
+	u, err := releaseUpdateFromForm(r)
+	errs, _ := err.(releaseFieldErrors)
+	if errs == nil {
+		errs = make(releaseFieldErrors)
+	}
+
+	draft := draftFromUpdate(u)
+	if id := strings.TrimSpace(r.FormValue("release_id")); id != "" {
+		if draft.ReleaseID, err = strconv.Atoi(id); err != nil {
+			errs["release_id"] = "must be a number"
+		}
+	}
+	draft.Wanted = r.FormValue("wanted") == "on"
+	draft.Tags = strings.Split(r.FormValue("tags"), ",")
+	draft.Tracks = tracksFromForm(r)
+	draft.CoverURL = r.FormValue("cover_url")
+
+	draft, err = checkReleaseDraft(draft)
+	if checkErrs, ok := err.(releaseFieldErrors); ok {
+		for field, message := range checkErrs {
+			if _, ok := errs[field]; !ok {
+				errs[field] = message
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return draft, errs
+	}
+	return draft, nil
+}
+
+// newReleasePage is what the add release form shows.
+type newReleasePage struct {
+	Draft    releaseDraft
+	Lookup   releaseLookup
+	Errors   releaseFieldErrors
+	Message  string
+	Existing int // ID of the release already in the collection
+}
+
+// renderNewReleasePage shows the add release form with a lookup form above it.
+func renderNewReleasePage(w http.ResponseWriter, page newReleasePage, status int) {
+	rows := append(append([]Track{}, page.Draft.Tracks...), make([]Track, blankTrackRows)...)
+	data := struct {
+		newReleasePage
+		Title            string
+		Template         string
+		TagList          string
+		Rows             []Track
+		MediaConditions  []string
+		SleeveConditions []string
+	}{
+		newReleasePage:   page,
+		Title:            "Add Release",
+		Template:         "new-release",
+		TagList:          strings.Join(page.Draft.Tags, ", "),
+		Rows:             rows,
+		MediaConditions:  mediaConditions,
+		SleeveConditions: sleeveConditions,
+	}
+	w.WriteHeader(status)
+	if err := Templates.ExecuteTemplate(w, "base.html", data); err != nil {
+		log.Printf("Error rendering new release template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// newReleaseHandler shows the add release form at /release/new, prefilled
+// when the lookup form asks for a release_id, barcode or artist and title,
+// and adds the release posted to it.
+func newReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		page := newReleasePage{}
+		lookup, err := releaseLookupFromQuery(r.URL.Query())
+		page.Lookup = lookup
+		switch {
+		case err != nil:
+			page.Message = err.Error()
+		case lookup.empty():
+		case !lookup.complete():
+			page.Message = "Enter a Discogs release ID, a barcode, or both an artist and a title."
+		default:
+			page.Draft, err = prefillRelease(r.Context(), lookup)
+			if errors.Is(err, errNoMetadata) {
+				page.Message = "Nothing found, fill in the release below."
+			} else if err != nil {
+				page.Message = "Error looking up the release: " + err.Error()
+			}
+		}
+		if page.Draft.Title == "" && page.Draft.Artist == "" {
+			// Keep what was looked up for releases entered by hand
+			page.Draft = releaseDraft{ReleaseID: lookup.ReleaseID, Artist: lookup.Artist, Title: lookup.Title}
+		}
+		page.Draft.DateAdded = time.Now().Format(discogsDateAddedLayout)
+		renderNewReleasePage(w, page, http.StatusOK)
+
+	case http.MethodPost:
+		if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB max
+			log.Printf("Error parsing multipart form: %v", err)
+			http.Error(w, "Invalid form", http.StatusBadRequest)
+			return
+		}
+		draft, err := releaseDraftFromForm(r)
+		if errs, ok := err.(releaseFieldErrors); ok {
+			renderNewReleasePage(w, newReleasePage{Draft: draft, Errors: errs}, http.StatusBadRequest)
+			return
+		}
+
+		// An uploaded cover replaces the looked up one
+		if len(r.MultipartForm.File["cover"]) > 0 {
+			draft.CoverURL = ""
+		}
+		origin := requestOrigin(r, sourceEdit)
+		id, err := addRelease(r.Context(), origin, draft)
+		if errors.Is(err, errReleaseExists) {
+			renderNewReleasePage(w, newReleasePage{Draft: draft, Existing: id}, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error adding release", http.StatusInternalServerError)
+			return
+		}
+
+		release, err := store.GetRelease(id)
+		if err != nil {
+			http.Error(w, "Release not found", http.StatusNotFound)
+			return
+		}
+		coverImage, err := saveUploadedCover(r, release)
+		if err != nil {
+			http.Error(w, "Error saving cover image", http.StatusInternalServerError)
+			return
+		}
+		if coverImage != "" {
+			err := auditRelease(origin, id, func() error { return store.SetCoverImage(id, coverImage) })
+			if err != nil {
+				http.Error(w, "Error saving cover image", http.StatusInternalServerError)
+				return
+			}
+		}
+		http.Redirect(w, r, "/release/"+strconv.Itoa(id), http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAddRelease(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("cover of " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	// Covers are written to web/static/covers
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	s := newMemoryStore()
+	store, changeStore = s, s
+	origin := changeOrigin{Source: sourceEdit, Actor: "test", Batch: "add"}
+
+	draft := releaseDraft{ReleaseID: 2001, Artist: "Portishead", Title: "Dummy", Format: "LP, Album", CoverURL: server.URL + "/dummy.jpg"}
+	id, err := addRelease(context.Background(), origin, draft)
+	if err != nil {
+		t.Fatalf("addRelease: %v", err)
+	}
+	release, err := store.GetRelease(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if release.CoverImage != "2001.jpg" {
+		t.Errorf("CoverImage = %q, want 2001.jpg", release.CoverImage)
+	}
+
+	// Created with its cover, as one change
+	changes, err := s.ListChanges(ChangeQuery{ReleaseRef: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Action != changeCreate || string(changes[0].After["cover_image"]) != `"2001.jpg"` {
+		t.Errorf("logged %+v, want one creation with the cover", changes)
+	}
+
+	// Adding it again leaves the cover of the existing release alone
+	draft.CoverURL = server.URL + "/other.jpg"
+	if existing, err := addRelease(context.Background(), origin, draft); !errors.Is(err, errReleaseExists) || existing != id {
+		t.Errorf("adding it again = %d, %v, want %d, %v", existing, err, id, errReleaseExists)
+	}
+	data, err := os.ReadFile("web/static/covers/2001.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "cover of /dummy.jpg" {
+		t.Errorf("cover overwritten with %q", data)
+	}
+}
@@ -1,221 +1,195 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net/url"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
-
-	"github.com/gocolly/colly"
+	"time"
 )
 
-func scrapeLastFM(logMessages *strings.Builder) (string, error) {
-	var result strings.Builder
+// coverClient downloads the cover images found by the metadata providers.
+var coverClient = &http.Client{Timeout: 30 * time.Second}
 
-	releases, err := fetchReleases("", "")
-		if err != nil {
-			log.Fatalf("Error fetching releases: %v", err)
-		}
+// scrapeMetadata is the work of a scrape job. It asks the configured metadata
+// providers about every release missing data, reporting progress per release.
+func scrapeMetadata(job *jobContext) (string, error) {
+	providers, err := getMetadataProviders()
+	if err != nil {
+		return "", err
+	}
 
-	c := createCollector()
-	releaseTags := make(map[int][]string)
-	setupHandlers(c, &result, releaseTags, logMessages)
+	releases, err := store.ListReleases(ReleaseQuery{})
+	if err != nil {
+		return "", fmt.Errorf("error fetching releases: %v", err)
+	}
+	job.SetTotal(len(releases))
+	origin := jobOrigin(job, sourceScrape)
 
 	for _, release := range releases {
-	err := scrapeRelease(c, release, releaseTags, &result, logMessages)
-		if err != nil {
-			result.WriteString(fmt.Sprintf("<br>Error scraping release %d: %v\n", release.ReleaseID, err))
+		if err := job.Err(); err != nil {
+			progress, _ := job.snapshot()
+			return fmt.Sprintf("Scraped %d of %d releases", progress.Processed, len(releases)), err
 		}
-	}
 
-	return result.String(), nil
-}
-
-func createCollector() *colly.Collector {
-	return colly.NewCollector(
-		colly.AllowedDomains("www.last.fm", "lastfm.freetls.fastly.net"),
-	)
-}
-
-func setupHandlers(c *colly.Collector, result *strings.Builder, releaseTags map[int][]string, logMessages *strings.Builder) {
-	c.OnResponse(func(r *colly.Response) {
-		handleImageResponse(r)
-	})
-
-	c.OnHTML("a.cover-art img", func(e *colly.HTMLElement) {
-		handleCoverArt(e, c)
-	})
-
-	c.OnHTML(".catalogue-metadata-description", func(e *colly.HTMLElement) {
-		handleMetadata(e, result, releaseTags)
-	})
-
-	c.OnHTML("a[href*='/tag/']", func(e *colly.HTMLElement) {
-		handleTag(e, result, releaseTags)
-	})
-
-	// c.OnRequest(func(r *colly.Request) {
-	// 	log.Printf("Visiting release URL: %s", r.URL.String())
-	// })
-
-	c.OnError(func(r *colly.Response, err error) {
-		log.Printf("Error visiting %s: %v", r.Request.URL, err)
-		result.WriteString(fmt.Sprintf("<br>Error fetching %s: %v\n", r.Request.URL, err))
-	})
+		item := release.Artist + " - " + release.Title
+		job.Start(item)
+		err := scrapeRelease(job.ctx, providers, origin, release, job.Logf)
+		job.Done(item, err)
+	}
 
-	// c.OnResponse(func(r *colly.Response) {
-	// 	logMessages.WriteString(fmt.Sprintf("Response from %s (status: %d)\n", r.Request.URL, r.StatusCode))
-	// })
+	return fmt.Sprintf("Scraped %d releases", len(releases)), nil
 }
 
-func scrapeRelease(c *colly.Collector, release Release, releaseTags map[int][]string, result *strings.Builder, logMessages *strings.Builder) error {
+// scrapeRelease looks up a release and downloads its cover, then writes what
+// was found as one change in the history.
+func scrapeRelease(ctx context.Context, providers []MetadataProvider, origin changeOrigin, release Release, logf func(format string, args ...interface{})) error {
 	if release.CoverImage != "" && len(release.Tags) > 0 && release.Year != 0 {
 		// log.Printf("Skipping scrape for release %s as cover_image, tags, and year are already populated.", release.Title)
 		return nil
 	}
 
-	url := buildLastFMURL(release)
-
-	ctx := colly.NewContext()
-	ctx.Put("releaseID", release.ReleaseID)
-
-	err := c.Request("GET", url, nil, ctx, nil)
+	metadata, err := lookupMetadata(ctx, providers, release, logf)
+	if errors.Is(err, errNoMetadata) {
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("error visiting %s: %v", url, err)
+		return err
 	}
 
-	// logMessages.WriteString(fmt.Sprintf("Successfully scraped: %s ", url))
-
-	if tags, ok := releaseTags[release.ReleaseID]; ok {
-		err := updateReleaseFromScraping(release, tags, result)
-		if err != nil {
-			return fmt.Errorf("error updating database for release %d: %v", release.ReleaseID, err)
+	coverImage := ""
+	if release.CoverImage == "" {
+		for _, coverURL := range metadata.CoverURLs {
+			image, err := fetchCoverImage(ctx, release.ReleaseID, coverURL)
+			if err != nil {
+				logf("%s - %s: %v", release.Artist, release.Title, err)
+				continue
+			}
+			coverImage = image
+			break
 		}
 	}
 
-	return nil
-}
-
-func buildLastFMURL(release Release) string {
-	artist := strings.TrimSpace(release.Artist)
-	artist = strings.ReplaceAll(artist, " ", "+")
-	title := strings.TrimSpace(release.Title)
-	title = strings.ReplaceAll(title, " ", "+")
-	artist = strings.TrimRight(artist, "+")
-	title = strings.TrimRight(title, "+")
-	return fmt.Sprintf("https://www.last.fm/music/%s/%s", artist, title)
+	return auditRelease(origin, release.ID, func() error {
+		return applyMetadata(release, metadata, coverImage)
+	})
 }
 
-func handleImageResponse(r *colly.Response) {
-	if strings.HasPrefix(r.Headers.Get("Content-Type"), "image/") {
-		releaseID, ok := r.Ctx.GetAny("releaseID").(int)
-		if !ok {
-			log.Printf("Error: could not get release ID from context for image")
-			return
-		}
-
-		if err := os.MkdirAll("web/static/covers", 0755); err != nil {
-			log.Printf("Error creating covers directory: %v", err)
-			return
+// applyMetadata writes what the providers know about a release, and the
+// downloaded cover, if any.
+func applyMetadata(release Release, metadata *Metadata, coverImage string) error {
+	if coverImage != "" {
+		if err := store.SetCoverImage(release.ID, coverImage); err != nil {
+			return fmt.Errorf("error setting the cover of release %d: %v", release.ReleaseID, err)
 		}
+	}
 
-		fsPath := fmt.Sprintf("web/static/covers/%d.jpg", releaseID)
-		if err := os.WriteFile(fsPath, r.Body, 0644); err != nil {
-			log.Printf("Error saving image for release %d: %v", releaseID, err)
-			return
+	// Imported rows often only have the year as release date, keep the
+	// more exact one, and the label only when the release has none
+	released := ""
+	if len(metadata.Released) > len(release.Released) {
+		released = metadata.Released
+	}
+	label := ""
+	if release.Label == "" {
+		label = metadata.Label
+	}
+	if released != "" || label != "" {
+		if _, err := store.SetScrapedDetails(release.ReleaseID, released, label); err != nil {
+			return fmt.Errorf("error updating release date and label for release %d: %v", release.ReleaseID, err)
 		}
+	}
 
-		urlPath := fmt.Sprintf("%d.jpg", releaseID)
-		_, err := db.Exec("UPDATE releases SET cover_image = $1 WHERE release_id = $2", urlPath, releaseID)
-		if err != nil {
-			log.Printf("Error updating cover image for release %d: %v", releaseID, err)
+	// Tracklists entered by hand are kept
+	if len(metadata.Tracks) > 0 && !containsString(release.EditedFields, "tracks") {
+		if err := store.SetTracks(release.ID, tracksFromMetadata(metadata.Tracks), false); err != nil {
+			return fmt.Errorf("error updating tracks for release %d: %v", release.ReleaseID, err)
 		}
 	}
-}
 
-func handleCoverArt(e *colly.HTMLElement, c *colly.Collector) {
-	releaseID, ok := e.Request.Ctx.GetAny("releaseID").(int)
-	if !ok {
-		log.Printf("Error: could not get release ID from context")
-		return
+	// updateReleaseFromScraping reads the year from a "year:YYYY" tag, keep
+	// the current year when no provider knows it
+	year := metadata.Year
+	if year == 0 {
+		year = release.Year
+	}
+	tags := append([]string{}, metadata.Tags...)
+	if year > 0 {
+		tags = append(tags, fmt.Sprintf("year:%d", year))
+	}
+	if len(tags) == 0 {
+		return nil
 	}
 
-	imgSrc := e.Attr("src")
-	if imgSrc != "" {
-		ctx := colly.NewContext()
-		ctx.Put("releaseID", releaseID)
-
-		parsedURL, err := url.Parse(imgSrc)
-		if err != nil {
-			log.Printf("Error parsing image URL: %v", err)
-			return
-		}
-		absoluteURL := ""
-		if parsedURL.IsAbs() {
-			absoluteURL = parsedURL.String()
-		} else {
-			baseURL, _ := url.Parse("https://www.last.fm")
-			absoluteURL = baseURL.ResolveReference(parsedURL).String()
-		}
+	var result strings.Builder
+	if err := updateReleaseFromScraping(release, tags, &result); err != nil {
+		return fmt.Errorf("error updating database for release %d: %v", release.ReleaseID, err)
+	}
+	return nil
+}
 
-		err = c.Request("GET", absoluteURL, nil, ctx, nil)
-		if err != nil {
-			log.Printf("Error downloading image for release %d: %v", releaseID, err)
-		}
+// fetchCoverImage downloads a cover image to web/static/covers/{release_id}.jpg
+// and returns its name relative to the covers directory.
+func fetchCoverImage(ctx context.Context, releaseID int, coverURL string) (string, error) {
+	body, err := downloadCoverImage(ctx, coverURL)
+	if err != nil {
+		return "", err
 	}
+	return saveCoverImage(releaseID, body)
 }
 
-func handleMetadata(e *colly.HTMLElement, result *strings.Builder, releaseTags map[int][]string) {
-	releaseID, ok := e.Request.Ctx.GetAny("releaseID").(int)
-	if !ok {
-		log.Printf("Error: could not get release ID from context")
-		result.WriteString("<br>Error: could not get release ID from context\n")
-		return
+// downloadCoverImage downloads a cover image, checking it is one.
+func downloadCoverImage(ctx context.Context, coverURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, coverURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := coverClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading cover %s: %v", coverURL, err)
 	}
+	defer resp.Body.Close()
 
-	dateStr := strings.TrimSpace(e.Text)
-	if dateStr != "" {
-		if strings.Contains(dateStr, " ") {
-			parts := strings.Split(dateStr, " ")
-			if len(parts) > 0 {
-				year, err := strconv.Atoi(parts[len(parts)-1])
-				if err == nil {
-					releaseTags[releaseID] = append(releaseTags[releaseID], fmt.Sprintf("year:%d", year))
-				}
-			}
-		} else {
-			year, err := strconv.Atoi(dateStr)
-			if err == nil {
-				releaseTags[releaseID] = append(releaseTags[releaseID], fmt.Sprintf("year:%d", year))
-			}
-		}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		return nil, fmt.Errorf("no cover image at %s (status %d, %s)", coverURL, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading cover %s: %v", coverURL, err)
 	}
+	return body, nil
 }
 
-func handleTag(e *colly.HTMLElement, result *strings.Builder, releaseTags map[int][]string) {
-	tag := strings.TrimSpace(e.Text)
-	releaseID, ok := e.Request.Ctx.GetAny("releaseID").(int)
-	if !ok {
-		log.Printf("Error: could not get release ID from context")
-		result.WriteString("<br>Error: could not get release ID from context\n")
-		return
+// saveCoverImage writes a cover image as web/static/covers/{release_id}.jpg
+// and returns its name relative to the covers directory.
+func saveCoverImage(releaseID int, body []byte) (string, error) {
+	if err := os.MkdirAll("web/static/covers", 0755); err != nil {
+		log.Printf("Error creating covers directory: %v", err)
+		return "", err
 	}
 
-	releaseTags[releaseID] = append(releaseTags[releaseID], tag)
+	fsPath := fmt.Sprintf("web/static/covers/%d.jpg", releaseID)
+	if err := os.WriteFile(fsPath, body, 0644); err != nil {
+		log.Printf("Error saving image for release %d: %v", releaseID, err)
+		return "", err
+	}
+	return fmt.Sprintf("%d.jpg", releaseID), nil
 }
 
+// handleScrape starts a scrape job, the admin page follows its progress.
 func handleScrape(w http.ResponseWriter, r *http.Request) {
-	var logMessages strings.Builder
-	logMessages.WriteString("<br>Started data scraping from lastFM, please be patient...<br><br>\n")
-	result, err := scrapeLastFM(&logMessages)
+	job, err := jobs.start(jobKindScrape, scrapeMetadata)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Scraping failed: %v", err), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		if err == errJobAlreadyRunning {
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("Scraping failed: %v", err), status)
 		return
 	}
-	fmt.Fprintln(w, logMessages.String(), result)
-	logMessages.WriteString("<br>Scraping completed<br>\n")
-	log.Println("Scraping completed")
+	renderJob(w, job)
 }
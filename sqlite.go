@@ -0,0 +1,42 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"modernc.org/sqlite"
+)
+
+func init() {
+	// SQLite has no unaccent extension, provide the same function from Go
+	sqlite.MustRegisterDeterministicScalarFunction("unaccent", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		switch v := args[0].(type) {
+		case string:
+			return unaccent(v), nil
+		case []byte:
+			return unaccent(string(v)), nil
+		default:
+			return v, nil
+		}
+	})
+}
+
+// getSQLitePath returns the database file used when DB_DRIVER=sqlite.
+func getSQLitePath() string {
+	return getEnvWithDefault("SQLITE_PATH", "data/music_collection.db")
+}
+
+// openSQLite opens (and creates if needed) the SQLite database at path.
+func openSQLite(path string) (*sql.DB, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating SQLite directory: %v", err)
+		}
+	}
+
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	return sql.Open("sqlite", dsn)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// errReleaseNotFound is returned by stores when no release matches an ID.
+var errReleaseNotFound = errors.New("release not found")
+
+// errReleaseExists is returned by CreateRelease when a release with the same
+// release_id is already in the collection.
+var errReleaseExists = errors.New("release already in the collection")
+
+// ReleaseQuery describes which releases to list. Zero values mean "no filter",
+// so filters can be freely combined and are ANDed together.
+type ReleaseQuery struct {
+	Artist       string // Substring match, "/" separates alternative artists (i.e. Lennon/Ono)
+	ExactArtist  string // Exact match, for artists whose name contains another one
+	Year         int
+	Tag          string
+	Physical     string
+	Label        string // Exact match
+	Wanted       *bool
+	NeedScraping bool   // Missing year, tags or cover image
+	Search       string // Accent insensitive match on title, artist, year, physical or track titles
+	ExcludeID    int    // Leaves a release out, i.e. the one others are related to
+
+	// Status is the exception to the rule above: the zero value only lists
+	// releases still in the collection or wantlist, archived and sold ones
+	// have to be asked for with "archived", "sold", "former" (both) or "all".
+	Status string
+
+	Sort []SortKey // Always followed by id so paging is stable
+
+	Limit  int // 0 means no limit
+	Offset int
+}
+
+// SortKey is one field of a sort spec such as "artist,-year,title".
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// sortableFields maps the fields accepted in a sort spec to their column.
+// Nothing else ever reaches an ORDER BY clause.
+var sortableFields = map[string]string{
+	"title":          "title",
+	"artist":         "artist",
+	"year":           "year",
+	"physical":       "physical",
+	"date_added":     "date_added",
+	"label":          "label",
+	"rating":         "rating",
+	"catalog_number": "catalog_number",
+	"status_date":    "status_date",
+}
+
+// parseSortSpec parses a comma separated list of fields, each optionally
+// prefixed with "-" for descending order, i.e. "artist,-year,title".
+func parseSortSpec(spec string) ([]SortKey, error) {
+	var keys []SortKey
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		key := SortKey{Field: strings.TrimPrefix(part, "-"), Desc: strings.HasPrefix(part, "-")}
+		if _, ok := sortableFields[key.Field]; !ok {
+			return nil, fmt.Errorf("invalid sort field: %s", key.Field)
+		}
+		if seen[key.Field] {
+			continue
+		}
+		seen[key.Field] = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// formatSortSpec is the inverse of parseSortSpec.
+func formatSortSpec(keys []SortKey) string {
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key.Field
+		if key.Desc {
+			parts[i] = "-" + key.Field
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ReleaseUpdate holds the editable core fields of a release.
+type ReleaseUpdate struct {
+	Title                     string
+	Artist                    string
+	Year                      int
+	CatalogNumber             string
+	Label                     string
+	Format                    string // Changing it parses the media again
+	Physical                  string // Classified from the format when left unchanged with a new format
+	Rating                    string // Empty or 0 to 5
+	Released                  string
+	CollectionFolder          string
+	DateAdded                 string
+	CollectionMediaCondition  string
+	CollectionSleeveCondition string
+	CollectionNotes           string
+	CoverImage                string // Empty keeps the current cover
+	ConvertToOwned            bool
+}
+
+// Lifecycle statuses of a release no longer in the collection, kept with its
+// history instead of being deleted.
+const (
+	statusArchived = "archived" // Lost, broken or given away
+	statusSold     = "sold"
+)
+
+// releaseStatusFilters are the accepted values of ReleaseQuery.Status.
+var releaseStatusFilters = []string{statusArchived, statusSold, "former", "all"}
+
+// ReleaseStatus is what became of a release that left the collection. The
+// zero value puts a release back in the collection.
+type ReleaseStatus struct {
+	Status string `json:"status"` // statusArchived or statusSold
+	Date   string `json:"date"`   // i.e. 2024-05-01
+	Price  string `json:"price"`  // Sold releases only, i.e. 25.50
+	Note   string `json:"note"`   // i.e. who bought it
+}
+
+// ReleaseStore is the storage used by the handlers. Every listing goes through
+// ListReleases so new filters only need to be added to ReleaseQuery.
+type ReleaseStore interface {
+	ListReleases(q ReleaseQuery) ([]Release, error)
+	CountReleases(q ReleaseQuery) (int, error) // Ignores ordering, limit and offset
+	GetRelease(id int) (*Release, error)
+
+	CreateRelease(r Release) (int, error) // With its tags and tracks, returns the ID of the existing release with errReleaseExists
+	UpdateRelease(id int, u ReleaseUpdate) error
+	UpdateImportedRelease(r Release) error // Writes the import fields, wanted and physical format of a merged release
+	DeleteRelease(id int) error
+	RenameArtist(oldArtist, newArtist string) error
+	SetWanted(id int, wanted bool) error
+	SetCoverImage(id int, coverImage string) error // Name of the image in web/static/covers
+	SetStatus(id int, status ReleaseStatus) error  // Archives, sells or restores a release
+	AddTag(id int, tag string) error
+	RemoveTag(id int, tag string) error
+	SetScrapedData(releaseID int, tags []string, year int) (bool, error)
+	SetScrapedDetails(releaseID int, released, label string) (bool, error) // Empty values keep the current ones
+	SetPhysical(physical map[int]string) error                             // Release ID -> physical format, all or none
+	SetTracks(id int, tracks []Track, edited bool) error                   // Replaces the tracklist, edited ones are kept by scraping
+
+	TagCounts() ([]StatItem, error)
+	ArtistCounts() ([]StatItem, error)
+	StatsByDecade() ([]StatItem, error)
+	StatsByFormat() ([]StatItem, error)
+	StatsTopArtists() ([]StatItem, error)
+}
+
+// editedFields names the fields of a release changed by an update, as listed
+// in Release.EditedFields.
+func editedFields(current, updated Release) []string {
+	var fields []string
+	for _, field := range importFields {
+		if *field.get(&current) != *field.get(&updated) {
+			fields = append(fields, field.Name)
+		}
+	}
+	if updated.Year != current.Year {
+		fields = append(fields, "year")
+	}
+	if updated.Physical != current.Physical {
+		fields = append(fields, "physical")
+	}
+	if updated.CoverImage != current.CoverImage {
+		fields = append(fields, "cover_image")
+	}
+	return fields
+}
+
+// addFields returns fields with the new ones appended, without duplicates.
+func addFields(fields []string, added ...string) []string {
+	result := append([]string{}, fields...)
+	for _, field := range added {
+		if !containsString(result, field) {
+			result = append(result, field)
+		}
+	}
+	return result
+}
+
+// store is the ReleaseStore used by the application, set up in initDB.
+var store ReleaseStore
+
+// boolPtr is a helper to build optional boolean filters.
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// isDecadeTag reports whether tag has the decade format "YYYYs".
+func isDecadeTag(tag string) bool {
+	if len(tag) != 5 || !strings.HasSuffix(tag, "s") {
+		return false
+	}
+	_, err := strconv.Atoi(tag[:4])
+	return err == nil
+}
+
+// replaceDecadeTag drops any decade tags and adds the one matching year.
+func replaceDecadeTag(tags []string, year int) []string {
+	newTags := []string{}
+	for _, tag := range tags {
+		if isDecadeTag(tag) {
+			continue
+		}
+		newTags = append(newTags, tag)
+	}
+
+	if year > 0 {
+		newTags = append(newTags, fmt.Sprintf("%ds", (year/10)*10))
+	}
+	return newTags
+}
+
+// unaccent removes diacritics, mirroring the PostgreSQL extension of the same name.
+func unaccent(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	result, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	return result
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Track is one track of a release tracklist, looked up by the metadata
+// providers or entered on the tracklist page. Tracks are stored in the tracks
+// table, in tracklist order.
+type Track struct {
+	Position string `json:"position"` // As printed on the release, i.e. "A1" or "2-05"
+	Title    string `json:"title"`
+	Duration string `json:"duration"` // "4:32", empty when unknown
+	Credits  string `json:"credits"`  // Extra artists, i.e. "Producer: Quincy Jones; Bass: Louis Johnson"
+}
+
+// trackDuration matches durations as written by Discogs, i.e. "4:32" or "1:02:10".
+var trackDuration = regexp.MustCompile(`^\d{1,3}:\d{2}(:\d{2})?$`)
+
+// tracksFromMetadata converts the tracklist of a metadata provider.
+func tracksFromMetadata(tracks []MetadataTrack) []Track {
+	var result []Track
+	for _, t := range tracks {
+		if title := strings.TrimSpace(t.Title); title != "" {
+			result = append(result, Track{
+				Position: strings.TrimSpace(t.Position),
+				Title:    title,
+				Duration: strings.TrimSpace(t.Duration),
+				Credits:  strings.Join(t.Credits, "; "),
+			})
+		}
+	}
+	return result
+}
+
+// cleanTracks checks a tracklist entered by hand: fields are trimmed, rows
+// without a title dropped, and durations must look like "4:32".
+func cleanTracks(tracks []Track) ([]Track, error) {
+	var result []Track
+	for i, t := range tracks {
+		t = Track{
+			Position: strings.TrimSpace(t.Position),
+			Title:    strings.TrimSpace(t.Title),
+			Duration: strings.TrimSpace(t.Duration),
+			Credits:  strings.TrimSpace(t.Credits),
+		}
+		if t.Title == "" {
+			if t.Position != "" || t.Duration != "" || t.Credits != "" {
+				return nil, fmt.Errorf("track %d has no title", i+1)
+			}
+			continue
+		}
+		if t.Duration != "" && !trackDuration.MatchString(t.Duration) {
+			return nil, fmt.Errorf("invalid duration %q for %s, expected minutes and seconds like 4:32", t.Duration, t.Title)
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// SetTracks replaces the tracklist of a release. Edited tracklists are marked
+// in edited_fields so scraping no longer replaces them.
+func (s *sqlStore) SetTracks(id int, tracks []Track, edited bool) error {
+	current, err := s.GetRelease(id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM tracks WHERE release_ref = $1", id); err != nil {
+		log.Printf("Error deleting tracks of release %d: %v", id, err)
+		return err
+	}
+	if err := insertTracks(tx, id, tracks); err != nil {
+		return err
+	}
+	if edited {
+		_, err := tx.Exec("UPDATE releases SET edited_fields = $1 WHERE id = $2",
+			s.dialect.TagsValue(addFields(current.EditedFields, "tracks")), id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insertTracks adds a tracklist to a release without one.
+func insertTracks(q dbExecutor, id int, tracks []Track) error {
+	for i, t := range tracks {
+		_, err := q.Exec(`
+			INSERT INTO tracks (release_ref, sequence, position, title, duration, credits)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			id, i+1, t.Position, t.Title, t.Duration, t.Credits)
+		if err != nil {
+			log.Printf("Error storing tracks of release %d: %v", id, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// attachTracks loads the tracklist of a release.
+func (s *sqlStore) attachTracks(release *Release) error {
+	rows, err := s.db.Query(`
+		SELECT position, title, duration, credits FROM tracks
+		WHERE release_ref = $1 ORDER BY sequence`, release.ID)
+	if err != nil {
+		log.Printf("Error querying tracks of release %d: %v", release.ID, err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Track
+		if err := rows.Scan(&t.Position, &t.Title, &t.Duration, &t.Credits); err != nil {
+			return err
+		}
+		release.Tracks = append(release.Tracks, t)
+	}
+	return rows.Err()
+}
+
+// blankTrackRows are the empty rows of the tracklist form, for adding tracks.
+const blankTrackRows = 3
+
+// renderTracksPage shows the tracklist of a release with the form editing it.
+func renderTracksPage(w http.ResponseWriter, release *Release, message string) {
+	rows := append(append([]Track{}, release.Tracks...), make([]Track, blankTrackRows)...)
+	data := struct {
+		*Release
+		Title    string
+		Template string
+		Rows     []Track
+		Message  string
+	}{
+		Release:  release,
+		Title:    release.Title,
+		Template: "tracks",
+		Rows:     rows,
+		Message:  message,
+	}
+	if err := Templates.ExecuteTemplate(w, "base.html", data); err != nil {
+		log.Printf("Error rendering tracks template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// releaseTracksHandler shows the tracklist of a release at
+// /release/{id}/tracks, and saves the tracklist form posted to it.
+func releaseTracksHandler(w http.ResponseWriter, r *http.Request, id int) {
+	release, err := store.GetRelease(id)
+	if err != nil {
+		http.Error(w, "Release not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		renderTracksPage(w, release, "")
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form", http.StatusBadRequest)
+			return
+		}
+		tracks, err := cleanTracks(tracksFromForm(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = auditRelease(requestOrigin(r, sourceEdit), id, func() error { return store.SetTracks(id, tracks, true) })
+		if err != nil {
+			http.Error(w, "Error saving tracks", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/release/"+strconv.Itoa(id)+"/tracks", http.StatusSeeOther)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// tracksFromForm reads the rows of the "tracklist-form" template, every row
+// has the four inputs, in order.
+func tracksFromForm(r *http.Request) []Track {
+	titles := r.PostForm["track_title"]
+	tracks := make([]Track, len(titles))
+	for i := range titles {
+		tracks[i] = Track{
+			Position: formValueAt(r, "track_position", i),
+			Title:    titles[i],
+			Duration: formValueAt(r, "track_duration", i),
+			Credits:  formValueAt(r, "track_credits", i),
+		}
+	}
+	return tracks
+}
+
+func formValueAt(r *http.Request, key string, i int) string {
+	if values := r.PostForm[key]; i < len(values) {
+		return values[i]
+	}
+	return ""
+}
+
+// fetchTracksHandler looks up the tracklist of a release with the metadata
+// providers, replacing the current one, at /release/{id}/fetch-tracks.
+func fetchTracksHandler(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	release, err := store.GetRelease(id)
+	if err != nil {
+		http.Error(w, "Release not found", http.StatusNotFound)
+		return
+	}
+
+	providers, err := getMetadataProviders()
+	if err != nil {
+		renderTracksPage(w, release, err.Error())
+		return
+	}
+	metadata, err := lookupMetadata(r.Context(), providers, *release, log.Printf)
+	if errors.Is(err, errNoMetadata) || (err == nil && len(metadata.Tracks) == 0) {
+		renderTracksPage(w, release, "No metadata provider knows the tracklist of this release.")
+		return
+	}
+	if err != nil {
+		renderTracksPage(w, release, "Error looking up the tracklist: "+err.Error())
+		return
+	}
+
+	err = auditRelease(requestOrigin(r, sourceScrape), id, func() error {
+		return store.SetTracks(id, tracksFromMetadata(metadata.Tracks), false)
+	})
+	if err != nil {
+		http.Error(w, "Error saving tracks", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/release/"+strconv.Itoa(id)+"/tracks", http.StatusSeeOther)
+}